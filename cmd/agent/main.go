@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/rsa"
 	"log"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	config2 "github.com/sgladkov/harvester/internal/config"
 	"github.com/sgladkov/harvester/internal/connection"
+	"github.com/sgladkov/harvester/internal/encryption"
+	"github.com/sgladkov/harvester/internal/interfaces"
 	"github.com/sgladkov/harvester/internal/logger"
 	"github.com/sgladkov/harvester/internal/reporter"
-	"github.com/sgladkov/harvester/internal/utils"
 	"go.uber.org/zap"
 )
 
@@ -24,38 +30,123 @@ func main() {
 		logger.Log.Fatal("failed to read config params", zap.Error(err))
 	}
 
-	r := connection.NewRestyClient(*config.Endpoint)
-	m := reporter.NewReporter(r)
-	pollTicker := time.NewTicker(time.Duration(*config.PollInterval) * time.Second)
-	defer pollTicker.Stop()
-	go func() {
-		for range pollTicker.C {
-			err := m.Poll()
+	var publicKey *rsa.PublicKey
+	if len(*config.CryptoKey) > 0 {
+		publicKey, err = encryption.LoadPublicKey(*config.CryptoKey)
+		if err != nil {
+			logger.Log.Fatal("failed to load public key", zap.Error(err))
+		}
+	}
+
+	var r interfaces.ServerConnection
+	if *config.Transport == "grpc" {
+		client, err := connection.NewGRPCClient(*config.GRPCAddress, *config.Key)
+		if err != nil {
+			logger.Log.Fatal("failed to create gRPC client", zap.Error(err))
+		}
+		defer func() {
+			err := client.Close()
 			if err != nil {
-				logger.Log.Warn("Failed to poll", zap.Error(err))
+				logger.Log.Warn("failed to close gRPC connection", zap.Error(err))
 			}
-			logger.Log.Info("Metrics are read")
+		}()
+		r = client
+	} else {
+		r = connection.NewRestyClient(*config.Endpoint, *config.Key, publicKey)
+	}
+	var outbox *reporter.Outbox
+	if len(*config.OutboxDir) > 0 {
+		outbox, err = reporter.NewOutbox(*config.OutboxDir, *config.OutboxMaxSize,
+			time.Duration(*config.OutboxMaxAge)*time.Second)
+		if err != nil {
+			logger.Log.Fatal("failed to open outbox", zap.Error(err))
 		}
-	}()
+	}
+	m := reporter.NewReporter(r, config.Labels(), outbox)
+	registry := reporter.NewDefaultRegistry(*config.ProcRoot)
+	intervals, err := config.CollectorIntervals()
+	if err != nil {
+		logger.Log.Fatal("failed to read collectors settings", zap.Error(err))
+	}
+	for name := range intervals {
+		if _, exists := registry.Get(name); !exists {
+			logger.Log.Fatal("unknown collector", zap.String("name", name), zap.Strings("known", registry.Names()))
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	pool := reporter.NewPool(m, *config.RateLimit)
+	var wg sync.WaitGroup
+	var pollTickers []*time.Ticker
+	for _, name := range registry.Names() {
+		interval, exists := intervals[name]
+		if !exists {
+			interval = *config.PollInterval
+		}
+		if interval <= 0 {
+			logger.Log.Info("Collector is disabled", zap.String("name", name))
+			continue
+		}
+		collector, _ := registry.Get(name)
+		pollTicker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer pollTicker.Stop()
+		pollTickers = append(pollTickers, pollTicker)
+		logger.Log.Info("Collector is enabled", zap.String("name", name), zap.Int("interval", interval))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-pollTicker.C:
+				}
+				pool.Collect(ctx, collector)
+				logger.Log.Info("Metrics are read", zap.String("collector", collector.Name()))
+			}
+		}()
+	}
 	reportTicker := time.NewTicker(time.Duration(*config.ReportInterval) * time.Second)
 	defer reportTicker.Stop()
+	wg.Add(1)
 	go func() {
-		for range reportTicker.C {
-			err := utils.RetryOnError(
-				func() error {
-					return m.BatchReport()
-				},
-				func(err error) bool {
-					return true
-				},
-			)
-			if err != nil {
-				logger.Log.Warn("Failed to report", zap.Error(err))
+		defer wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reportTicker.C:
 			}
-			logger.Log.Info("Metrics are reported")
+			if !pool.Report() {
+				logger.Log.Warn("All report workers are busy, metrics will be sent by the pending report")
+			}
+		}
+	}()
+
+	<-ctx.Done()
+	logger.Log.Info("Shutting down agent")
+	for _, pollTicker := range pollTickers {
+		pollTicker.Stop()
+	}
+	reportTicker.Stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// wait for the reports in progress and send the final one
+		wg.Wait()
+		pool.Stop()
+		err := m.BatchReport()
+		if err != nil {
+			logger.Log.Warn("Failed to send final report", zap.Error(err))
+			return
 		}
+		logger.Log.Info("Final report is sent")
 	}()
-	for {
-		time.Sleep(time.Second)
+	select {
+	case <-done:
+		logger.Log.Info("Agent is stopped")
+	case <-time.After(time.Duration(*config.ShutdownTimeout) * time.Second):
+		logger.Log.Warn("Shutdown timeout is exceeded, final report may be lost")
 	}
 }
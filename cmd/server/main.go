@@ -1,24 +1,41 @@
 package main
 
 import (
+	"context"
+	"crypto/rsa"
 	"database/sql"
 	"errors"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/sgladkov/harvester/internal/alerting"
 	"github.com/sgladkov/harvester/internal/config"
+	"github.com/sgladkov/harvester/internal/encryption"
+	"github.com/sgladkov/harvester/internal/graphite"
+	"github.com/sgladkov/harvester/internal/grpcserver"
 	"github.com/sgladkov/harvester/internal/httprouter"
+	"github.com/sgladkov/harvester/internal/hub"
 	"github.com/sgladkov/harvester/internal/interfaces"
 	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/statsd"
 	storage2 "github.com/sgladkov/harvester/internal/storage"
 	"github.com/sgladkov/harvester/internal/utils"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
+// expireInterval is the period of checks for series which aren't updated for the ttl
+const expireInterval = time.Minute
+
 var storage interfaces.Storage
 var db *sql.DB
 
@@ -33,7 +50,31 @@ func main() {
 		log.Fatal(err)
 	}
 
+	var privateKey *rsa.PrivateKey
+	if len(*config.CryptoKey) > 0 {
+		privateKey, err = encryption.LoadPrivateKey(*config.CryptoKey)
+		if err != nil {
+			logger.Log.Fatal("failed to load private key", zap.Error(err))
+		}
+	}
+
+	var influxCounters *regexp.Regexp
+	if len(*config.InfluxCounters) > 0 {
+		influxCounters, err = regexp.Compile(*config.InfluxCounters)
+		if err != nil {
+			logger.Log.Fatal("invalid regular expression of line protocol counters", zap.Error(err))
+		}
+	}
+
+	graphiteTemplates, err := graphite.ParseTemplates(*config.GraphiteTemplates)
+	if err != nil {
+		logger.Log.Fatal("invalid Graphite templates", zap.Error(err))
+	}
+
+	ctx := context.Background()
 	saveSettingsOnChange := *config.StoreInterval == 0
+	historyRetention := time.Duration(*config.HistoryRetention) * time.Second
+	var pgStorage *storage2.PgStorage
 	if len(*config.DatabaseDSN) > 0 {
 		logger.Log.Info("Trying to open database", zap.String("DSN", *config.DatabaseDSN))
 		err := utils.RetryOnError(
@@ -61,7 +102,7 @@ func main() {
 
 		err = utils.RetryOnError(
 			func() error {
-				storage, err = storage2.NewPgStorage(db, true)
+				pgStorage, err = storage2.NewPgStorage(ctx, db, historyRetention)
 				return err
 			},
 			func(err error) bool {
@@ -72,13 +113,14 @@ func main() {
 		if err != nil {
 			logger.Log.Fatal("Failed to create PgStorage", zap.Error(err))
 		}
+		storage = pgStorage
 	} else {
-		storage = storage2.NewMemStorage(*config.FileStorage, saveSettingsOnChange)
+		storage = storage2.NewMemStorage(*config.FileStorage, saveSettingsOnChange, historyRetention)
 	}
 	if *config.RestoreFlag {
 		err := utils.RetryOnError(
 			func() error {
-				return storage.Read()
+				return storage.Read(ctx)
 			},
 			func(err error) bool {
 				return errors.Is(err, os.ErrPermission)
@@ -89,14 +131,30 @@ func main() {
 		}
 	}
 
+	// updates accepted by any receiver are published for /api/v1/stream
+	eventHub := hub.New(*config.StreamBuffer)
+	storage = hub.NewNotifyingStorage(storage, eventHub)
+
+	// stop on signals, storage operations use ctx which isn't canceled
+	stopCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	var storeWG sync.WaitGroup
 	if *config.StoreInterval > 0 {
 		storeTicker := time.NewTicker(time.Duration(*config.StoreInterval) * time.Second)
 		defer storeTicker.Stop()
+		storeWG.Add(1)
 		go func() {
-			for range storeTicker.C {
+			defer storeWG.Done()
+			for {
+				select {
+				case <-stopCtx.Done():
+					return
+				case <-storeTicker.C:
+				}
 				err := utils.RetryOnError(
 					func() error {
-						return storage.Save()
+						return storage.Save(ctx)
 					},
 					func(err error) bool {
 						var pgErr *pgconn.PgError
@@ -113,22 +171,199 @@ func main() {
 		}()
 	}
 
-	logger.Log.Info("Starting server", zap.String("address", *config.Endpoint))
-	err = http.ListenAndServe(*config.Endpoint, httprouter.MetricsRouter(storage, db))
+	if *config.MetricsTTL > 0 {
+		ttl := time.Duration(*config.MetricsTTL) * time.Minute
+		expireTicker := time.NewTicker(expireInterval)
+		defer expireTicker.Stop()
+		storeWG.Add(1)
+		go func() {
+			defer storeWG.Done()
+			for {
+				select {
+				case <-stopCtx.Done():
+					return
+				case <-expireTicker.C:
+				}
+				expired, err := storage.Expire(ctx, time.Now().Add(-ttl))
+				if err != nil {
+					logger.Log.Warn("Failed to expire metrics", zap.Error(err))
+					continue
+				}
+				httprouter.ForgetSeries(expired)
+				for _, m := range expired {
+					value := zap.Skip()
+					if m.Value != nil {
+						value = zap.Float64("value", *m.Value)
+					} else if m.Delta != nil {
+						value = zap.Int64("value", *m.Delta)
+					}
+					logger.Log.Info("Metrics is expired", zap.String("type", m.MType),
+						zap.String("series", m.SeriesKey()), value)
+				}
+			}
+		}()
+	}
+
+	// outdated samples are deleted apart from writes, as often as the history window moves by a tenth
+	if pgStorage != nil && historyRetention > 0 {
+		pruneTicker := time.NewTicker(historyRetention / 10)
+		defer pruneTicker.Stop()
+		storeWG.Add(1)
+		go func() {
+			defer storeWG.Done()
+			for {
+				select {
+				case <-stopCtx.Done():
+					return
+				case <-pruneTicker.C:
+				}
+				err := pgStorage.PruneHistory(ctx)
+				if err != nil {
+					logger.Log.Warn("Failed to delete outdated samples", zap.Error(err))
+				}
+			}
+		}()
+	}
+
+	var alertEngine *alerting.Engine
+	if len(*config.AlertRules) > 0 {
+		alertConfig, err := alerting.LoadConfig(*config.AlertRules)
+		if err != nil {
+			logger.Log.Fatal("failed to load alerting rules", zap.Error(err))
+		}
+		alertEngine, err = alerting.NewEngine(storage, alertConfig, time.Duration(*config.StorageTimeout)*time.Second)
+		if err != nil {
+			logger.Log.Fatal("failed to start alerting", zap.Error(err))
+		}
+		storeWG.Add(1)
+		go func() {
+			defer storeWG.Done()
+			logger.Log.Info("Starting alerting", zap.Int("rules", len(alertConfig.Rules)))
+			alertEngine.Run(stopCtx)
+		}()
+	}
+
+	server := &http.Server{
+		Addr: *config.Endpoint,
+		Handler: httprouter.MetricsRouter(storage, db, httprouter.RouterConfig{
+			StorageTimeout:       time.Duration(*config.StorageTimeout) * time.Second,
+			Key:                  *config.Key,
+			PrivateKey:           privateKey,
+			InfluxCounterPattern: influxCounters,
+			Hub:                  eventHub,
+			Alerts:               alertEngine,
+		}),
+	}
+	// streams are endless, so they are closed for Shutdown to wait for other requests only
+	server.RegisterOnShutdown(eventHub.Close)
+	go func() {
+		logger.Log.Info("Starting server", zap.String("address", *config.Endpoint))
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Log.Fatal("failed to start server", zap.Error(err))
+		}
+	}()
+
+	var grpcServer *grpc.Server
+	if len(*config.GRPCAddress) > 0 {
+		listener, err := net.Listen("tcp", *config.GRPCAddress)
+		if err != nil {
+			logger.Log.Fatal("failed to listen for gRPC", zap.Error(err))
+		}
+		grpcServer = grpcserver.NewServer(storage, grpcserver.Config{
+			StorageTimeout: time.Duration(*config.StorageTimeout) * time.Second,
+			Key:            *config.Key,
+		})
+		go func() {
+			logger.Log.Info("Starting gRPC server", zap.String("address", *config.GRPCAddress))
+			err := grpcServer.Serve(listener)
+			if err != nil {
+				logger.Log.Fatal("failed to start gRPC server", zap.Error(err))
+			}
+		}()
+	}
+
+	var statsdListener *statsd.Listener
+	if len(*config.StatsDAddress) > 0 {
+		statsdListener, err = statsd.NewListener(*config.StatsDAddress, storage,
+			time.Duration(*config.StorageTimeout)*time.Second)
+		if err != nil {
+			logger.Log.Fatal("failed to listen for StatsD", zap.Error(err))
+		}
+		go func() {
+			logger.Log.Info("Starting StatsD listener", zap.String("address", *config.StatsDAddress))
+			err := statsdListener.Serve()
+			if err != nil {
+				logger.Log.Fatal("failed to receive StatsD metrics", zap.Error(err))
+			}
+		}()
+	}
+
+	var graphiteListener *graphite.Listener
+	if len(*config.GraphiteAddress) > 0 {
+		graphiteListener, err = graphite.NewListener(*config.GraphiteAddress, storage, graphite.Config{
+			Templates:      graphiteTemplates,
+			MaxConnections: *config.GraphiteMaxConnections,
+			IdleTimeout:    time.Duration(*config.GraphiteIdleTimeout) * time.Second,
+			StorageTimeout: time.Duration(*config.StorageTimeout) * time.Second,
+		})
+		if err != nil {
+			logger.Log.Fatal("failed to listen for Graphite", zap.Error(err))
+		}
+		go func() {
+			logger.Log.Info("Starting Graphite listener", zap.String("address", *config.GraphiteAddress))
+			err := graphiteListener.Serve()
+			if err != nil {
+				logger.Log.Fatal("failed to receive Graphite metrics", zap.Error(err))
+			}
+		}()
+	}
+
+	<-stopCtx.Done()
+	logger.Log.Info("Shutting down server")
+	if statsdListener != nil {
+		err = statsdListener.Close()
+		if err != nil {
+			logger.Log.Warn("failed to close StatsD listener", zap.Error(err))
+		}
+	}
+	shutdownCtx, cancel := context.WithTimeout(ctx, time.Duration(*config.ShutdownTimeout)*time.Second)
+	defer cancel()
+	// stop accepting connections and wait for in-flight requests
+	var grpcStopped chan struct{}
+	if grpcServer != nil {
+		grpcStopped = make(chan struct{})
+		go func() {
+			defer close(grpcStopped)
+			grpcServer.GracefulStop()
+		}()
+	}
+	err = server.Shutdown(shutdownCtx)
 	if err != nil {
-		logger.Log.Fatal("failed to start server", zap.Error(err))
-	}
-	err = utils.RetryOnError(
-		func() error {
-			return storage.Save()
-		},
-		func(err error) bool {
-			var pgErr *pgconn.PgError
-			return errors.Is(err, os.ErrPermission) ||
-				(errors.As(err, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code))
-		},
-	)
+		logger.Log.Warn("failed to shutdown server gracefully", zap.Error(err))
+	}
+	if graphiteListener != nil {
+		err = graphiteListener.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.Log.Warn("failed to shutdown Graphite listener gracefully", zap.Error(err))
+		}
+	}
+	if grpcServer != nil {
+		select {
+		case <-grpcStopped:
+		case <-shutdownCtx.Done():
+			logger.Log.Warn("failed to shutdown gRPC server gracefully", zap.Error(shutdownCtx.Err()))
+			grpcServer.Stop()
+		}
+	}
+	storeWG.Wait()
+	// draining may take the whole shutdown timeout, so the final save gets its own one
+	saveCtx, cancelSave := context.WithTimeout(ctx, time.Duration(*config.ShutdownTimeout)*time.Second)
+	defer cancelSave()
+	err = storage.Save(saveCtx)
 	if err != nil {
-		logger.Log.Fatal("failed to store metrics", zap.Error(err))
+		logger.Log.Error("failed to store metrics", zap.Error(err))
+		return
 	}
+	logger.Log.Info("Server is stopped")
 }
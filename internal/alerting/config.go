@@ -0,0 +1,156 @@
+package alerting
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/models"
+)
+
+const (
+	defaultEvaluationInterval = 15 * time.Second
+	defaultRepeatInterval     = 4 * time.Hour
+)
+
+// Duration is time.Duration written in JSON as a string like "90s" or "5m"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return fmt.Errorf("duration should be a string like \"5m\", got [%s]", data)
+	}
+	val, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(val)
+	return nil
+}
+
+// Rule describes the alert which fires for every series of the metrics with the value satisfying
+// the comparison with the threshold for the For duration
+type Rule struct {
+	Name       string            `json:"name"`
+	Metric     string            `json:"metric"`
+	Type       string            `json:"type"`   // gauge (by default) or counter
+	Labels     map[string]string `json:"labels"` // labels the series should have, other labels are ignored
+	Comparator string            `json:"comparator"`
+	Threshold  float64           `json:"threshold"`
+	For        Duration          `json:"for"`
+}
+
+// Config is the rules file
+type Config struct {
+	EvaluationInterval Duration `json:"evaluation_interval"` // 15s by default
+	RepeatInterval     Duration `json:"repeat_interval"`     // period to notify about firing alerts again, 4h by default
+	Webhooks           []string `json:"webhooks"`            // URLs notifications are posted to
+	Rules              []Rule   `json:"rules"`
+}
+
+var comparators = map[string]func(value float64, threshold float64) bool{
+	">":  func(value float64, threshold float64) bool { return value > threshold },
+	">=": func(value float64, threshold float64) bool { return value >= threshold },
+	"<":  func(value float64, threshold float64) bool { return value < threshold },
+	"<=": func(value float64, threshold float64) bool { return value <= threshold },
+	"==": func(value float64, threshold float64) bool { return value == threshold },
+	"!=": func(value float64, threshold float64) bool { return value != threshold },
+}
+
+// LoadConfig reads and validates the rules file, omitted settings get default values
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, fmt.Errorf("failed to parse alerting rules [%s]: %w", path, err)
+	}
+	err = config.validate()
+	if err != nil {
+		return config, fmt.Errorf("invalid alerting rules [%s]: %w", path, err)
+	}
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	if c.EvaluationInterval == 0 {
+		c.EvaluationInterval = Duration(defaultEvaluationInterval)
+	}
+	if c.RepeatInterval == 0 {
+		c.RepeatInterval = Duration(defaultRepeatInterval)
+	}
+	if c.EvaluationInterval < 0 || c.RepeatInterval < 0 {
+		return errors.New("intervals should be positive")
+	}
+	for _, webhook := range c.Webhooks {
+		u, err := url.Parse(webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("invalid webhook URL [%s]", webhook)
+		}
+	}
+	names := make(map[string]bool)
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if len(r.Name) == 0 {
+			return fmt.Errorf("rule %d has no name", i)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("rule [%s] is duplicated", r.Name)
+		}
+		names[r.Name] = true
+		err := r.validate()
+		if err != nil {
+			return fmt.Errorf("rule [%s]: %w", r.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) validate() error {
+	if len(r.Type) == 0 {
+		r.Type = "gauge"
+	}
+	err := models.ValidateMetricsID(r.Metric)
+	if err != nil {
+		return err
+	}
+	err = models.ValidateLabels(r.Labels)
+	if err != nil {
+		return err
+	}
+	if r.Type != "gauge" && r.Type != "counter" {
+		return fmt.Errorf("unknown metrics type [%s]", r.Type)
+	}
+	if _, exists := comparators[r.Comparator]; !exists {
+		return fmt.Errorf("unknown comparator [%s]", r.Comparator)
+	}
+	if r.For < 0 {
+		return errors.New("for duration should not be negative")
+	}
+	return nil
+}
+
+// matches checks m is the series of the rule metrics with the rule labels
+func (r *Rule) matches(m models.Metrics) bool {
+	if m.ID != r.Metric || m.MType != r.Type {
+		return false
+	}
+	for name, value := range r.Labels {
+		if m.Labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,240 @@
+package alerting
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/interfaces"
+	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/models"
+	"go.uber.org/zap"
+)
+
+// resolvedRetention is the period resolved alerts are still reported by Alerts
+const resolvedRetention = 15 * time.Minute
+
+const (
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// Alert is the state of the rule for one series
+type Alert struct {
+	Fingerprint string            `json:"fingerprint"` // rule name and series key, identifies the alert
+	Rule        string            `json:"rule"`
+	Metric      string            `json:"metric"`
+	Type        string            `json:"type"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Comparator  string            `json:"comparator"`
+	Threshold   float64           `json:"threshold"`
+	Value       float64           `json:"value"`
+	State       string            `json:"state"`
+	ActiveAt    time.Time         `json:"activeAt"`             // when the condition became true
+	FiredAt     *time.Time        `json:"firedAt,omitempty"`    // when the condition was true for the rule duration
+	ResolvedAt  *time.Time        `json:"resolvedAt,omitempty"` // when the condition became false again
+	notifiedAt  time.Time
+}
+
+// Engine evaluates rules against the storage periodically and notifies webhooks about firing and resolved alerts.
+// Firing alerts are notified again every repeat interval.
+type Engine struct {
+	storage  interfaces.Storage
+	config   Config
+	timeout  time.Duration // limit of storage queries of one rule
+	notifier *notifier
+	alerts   map[string]*Alert
+	now      func() time.Time
+	lock     sync.Mutex
+}
+
+// NewEngine creates Engine, config is validated if it isn't loaded by LoadConfig. Reading metrics of a rule
+// is limited by storageTimeout, or by the evaluation interval if storageTimeout is 0.
+func NewEngine(storage interfaces.Storage, config Config, storageTimeout time.Duration) (*Engine, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	if storageTimeout <= 0 {
+		storageTimeout = time.Duration(config.EvaluationInterval)
+	}
+	return &Engine{
+		storage:  storage,
+		config:   config,
+		timeout:  storageTimeout,
+		notifier: newNotifier(config.Webhooks),
+		alerts:   make(map[string]*Alert),
+		now:      time.Now,
+	}, nil
+}
+
+// Run evaluates rules every evaluation interval and delivers notifications until ctx is done
+func (e *Engine) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		e.notifier.run(ctx)
+	}()
+	ticker := time.NewTicker(time.Duration(e.config.EvaluationInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case <-ticker.C:
+			e.evaluate(ctx)
+		}
+	}
+}
+
+// Alerts returns pending, firing and recently resolved alerts sorted by fingerprint
+func (e *Engine) Alerts() []Alert {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	alerts := make([]Alert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		alerts = append(alerts, *a)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].Fingerprint < alerts[j].Fingerprint
+	})
+	return alerts
+}
+
+func metricsValue(m models.Metrics) (float64, bool) {
+	switch {
+	case m.MType == "gauge" && m.Value != nil:
+		return *m.Value, true
+	case m.MType == "counter" && m.Delta != nil:
+		return float64(*m.Delta), true
+	}
+	return 0, false
+}
+
+// ruleSeries is a series selected by the rule with its current value
+type ruleSeries struct {
+	fingerprint string
+	metrics     models.Metrics
+	value       float64
+}
+
+// query reads series of the rule, the engine isn't locked meanwhile
+func (e *Engine) query(ctx context.Context, rule *Rule) ([]ruleSeries, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	var series []ruleSeries
+	filter := models.MetricsFilter{MType: rule.Type, Prefix: rule.Metric}
+	err := e.storage.ListMetrics(ctx, filter, func(m models.Metrics) error {
+		value, ok := metricsValue(m)
+		if ok && rule.matches(m) {
+			series = append(series, ruleSeries{fingerprint: rule.Name + "/" + m.SeriesKey(), metrics: m, value: value})
+		}
+		return nil
+	})
+	return series, err
+}
+
+// evaluate checks every rule against current metrics values and updates alerts
+func (e *Engine) evaluate(ctx context.Context) {
+	results := make([][]ruleSeries, len(e.config.Rules))
+	failed := make(map[string]bool)
+	for i := range e.config.Rules {
+		rule := &e.config.Rules[i]
+		series, err := e.query(ctx, rule)
+		if err != nil {
+			logger.Log.Warn("Failed to evaluate alerting rule", zap.String("rule", rule.Name), zap.Error(err))
+			failed[rule.Name] = true
+			continue
+		}
+		results[i] = series
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	now := e.now()
+	seen := make(map[string]bool)
+	for i, series := range results {
+		rule := &e.config.Rules[i]
+		for _, s := range series {
+			seen[s.fingerprint] = true
+			value := s.value
+			if comparators[rule.Comparator](value, rule.Threshold) {
+				e.activate(rule, s.fingerprint, s.metrics, value, now)
+			} else {
+				e.deactivate(s.fingerprint, &value, now)
+			}
+		}
+	}
+	for fingerprint, a := range e.alerts {
+		switch {
+		case failed[a.Rule]:
+			// keep alerts of the rule as they are until metrics can be read again
+		case !seen[fingerprint]:
+			// series which are deleted or expired don't satisfy the condition anymore
+			e.deactivate(fingerprint, nil, now)
+		}
+	}
+}
+
+func (e *Engine) activate(rule *Rule, fingerprint string, m models.Metrics, value float64, now time.Time) {
+	a, exists := e.alerts[fingerprint]
+	if !exists || a.State == StateResolved {
+		a = &Alert{
+			Fingerprint: fingerprint,
+			Rule:        rule.Name,
+			Metric:      m.ID,
+			Type:        m.MType,
+			Labels:      m.Labels,
+			Comparator:  rule.Comparator,
+			Threshold:   rule.Threshold,
+			State:       StatePending,
+			ActiveAt:    now,
+		}
+		e.alerts[fingerprint] = a
+	}
+	a.Value = value
+	switch {
+	case a.State == StatePending && now.Sub(a.ActiveAt) >= time.Duration(rule.For):
+		a.State = StateFiring
+		a.FiredAt = &now
+		e.notify(a, now)
+	case a.State == StateFiring && now.Sub(a.notifiedAt) >= time.Duration(e.config.RepeatInterval):
+		e.notify(a, now)
+	}
+}
+
+// deactivate handles the alert whose condition is false, value is nil if the series is gone
+func (e *Engine) deactivate(fingerprint string, value *float64, now time.Time) {
+	a, exists := e.alerts[fingerprint]
+	if !exists {
+		return
+	}
+	switch a.State {
+	case StatePending:
+		delete(e.alerts, fingerprint)
+	case StateFiring:
+		if value != nil {
+			a.Value = *value
+		}
+		a.State = StateResolved
+		a.ResolvedAt = &now
+		e.notify(a, now)
+	case StateResolved:
+		if now.Sub(*a.ResolvedAt) >= resolvedRetention {
+			delete(e.alerts, fingerprint)
+		}
+	}
+}
+
+func (e *Engine) notify(a *Alert, now time.Time) {
+	a.notifiedAt = now
+	logger.Log.Info("Alert state is notified",
+		zap.String("fingerprint", a.Fingerprint),
+		zap.String("state", a.State),
+		zap.Float64("value", a.Value))
+	e.notifier.notify(Notification{Status: a.State, Alerts: []Alert{*a}})
+}
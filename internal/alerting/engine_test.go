@@ -0,0 +1,206 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/interfaces"
+	"github.com/sgladkov/harvester/internal/models"
+	"github.com/sgladkov/harvester/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			content: `{"evaluation_interval": "5s", "webhooks": ["http://localhost/hook"],
+				"rules": [{"name": "heap", "metric": "HeapInuse", "comparator": ">", "threshold": 100, "for": "1m"}]}`,
+		},
+		{name: "invalid json", content: `{"rules": [`, wantErr: true},
+		{name: "invalid duration", content: `{"evaluation_interval": "soon"}`, wantErr: true},
+		{name: "numeric duration", content: `{"evaluation_interval": 5}`, wantErr: true},
+		{name: "invalid webhook", content: `{"webhooks": ["ftp://localhost"]}`, wantErr: true},
+		{name: "no name", content: `{"rules": [{"metric": "HeapInuse", "comparator": ">"}]}`, wantErr: true},
+		{name: "unknown comparator", content: `{"rules": [{"name": "a", "metric": "HeapInuse", "comparator": "=>"}]}`, wantErr: true},
+		{name: "unknown type", content: `{"rules": [{"name": "a", "metric": "HeapInuse", "type": "histogram", "comparator": ">"}]}`, wantErr: true},
+		{name: "invalid metric", content: `{"rules": [{"name": "a", "metric": "heap-inuse", "comparator": ">"}]}`, wantErr: true},
+		{
+			name: "duplicated rule",
+			content: `{"rules": [{"name": "a", "metric": "HeapInuse", "comparator": ">"},
+				{"name": "a", "metric": "HeapSys", "comparator": ">"}]}`,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.json")
+			require.NoError(t, os.WriteFile(path, []byte(test.content), 0600))
+			config, err := LoadConfig(path)
+			if test.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, Duration(5*time.Second), config.EvaluationInterval)
+			require.Equal(t, Duration(defaultRepeatInterval), config.RepeatInterval)
+			require.Equal(t, "gauge", config.Rules[0].Type)
+			require.Equal(t, Duration(time.Minute), config.Rules[0].For)
+		})
+	}
+	_, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json"))
+	require.Error(t, err)
+}
+
+func TestEngine(t *testing.T) {
+	webhookRetryDelays = []time.Duration{10 * time.Millisecond}
+	notifications := make(chan Notification, 10)
+	failures := 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first notification is delivered on retry
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var n Notification
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+		notifications <- n
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := storage.NewMemStorage("", false, 0)
+	e, err := NewEngine(s, Config{
+		RepeatInterval: Duration(time.Hour),
+		Webhooks:       []string{ts.URL},
+		Rules: []Rule{
+			{Name: "heap", Metric: "HeapInuse", Labels: map[string]string{"host": "a"},
+				Comparator: ">", Threshold: 100, For: Duration(time.Minute)},
+			{Name: "polls", Metric: "PollCount", Type: "counter", Comparator: ">=", Threshold: 10},
+		},
+	}, time.Second)
+	require.NoError(t, err)
+	go e.notifier.run(ctx)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	e.now = func() time.Time { return now }
+	states := func() map[string]string {
+		result := make(map[string]string)
+		for _, a := range e.Alerts() {
+			result[a.Fingerprint] = a.State
+		}
+		return result
+	}
+	receive := func() Notification {
+		select {
+		case n := <-notifications:
+			return n
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "notification is not received")
+		}
+		return Notification{}
+	}
+
+	require.NoError(t, s.SetGauge(ctx, "HeapInuse{host=a}", 150))
+	require.NoError(t, s.SetGauge(ctx, "HeapInuse{host=b}", 150))
+	require.NoError(t, s.SetCounter(ctx, "PollCount", 5))
+	e.evaluate(ctx)
+	require.Equal(t, map[string]string{"heap/HeapInuse{host=a}": StatePending}, states())
+
+	// the condition is true for the rule duration
+	now = now.Add(time.Minute)
+	e.evaluate(ctx)
+	require.Equal(t, map[string]string{"heap/HeapInuse{host=a}": StateFiring}, states())
+	n := receive()
+	require.Equal(t, StateFiring, n.Status)
+	require.Len(t, n.Alerts, 1)
+	require.Equal(t, "heap/HeapInuse{host=a}", n.Alerts[0].Fingerprint)
+	require.Equal(t, 150.0, n.Alerts[0].Value)
+	require.Equal(t, map[string]string{"host": "a"}, n.Alerts[0].Labels)
+
+	// the firing alert isn't notified again before the repeat interval
+	require.NoError(t, s.SetCounter(ctx, "PollCount", 5))
+	now = now.Add(time.Minute)
+	e.evaluate(ctx)
+	require.Equal(t, map[string]string{
+		"heap/HeapInuse{host=a}": StateFiring,
+		"polls/PollCount":        StateFiring,
+	}, states())
+	n = receive()
+	require.Equal(t, "polls/PollCount", n.Alerts[0].Fingerprint)
+	require.Equal(t, 10.0, n.Alerts[0].Value)
+
+	now = now.Add(time.Hour)
+	require.NoError(t, s.SetGauge(ctx, "HeapInuse{host=a}", 50))
+	_, err = s.Delete(ctx, []models.Metrics{{ID: "PollCount", MType: "counter"}})
+	require.NoError(t, err)
+	e.evaluate(ctx)
+	require.Equal(t, map[string]string{
+		"heap/HeapInuse{host=a}": StateResolved,
+		"polls/PollCount":        StateResolved,
+	}, states())
+	resolved := map[string]Notification{}
+	for i := 0; i < 2; i++ {
+		n = receive()
+		resolved[n.Alerts[0].Fingerprint] = n
+	}
+	require.Equal(t, StateResolved, resolved["heap/HeapInuse{host=a}"].Status)
+	require.Equal(t, 50.0, resolved["heap/HeapInuse{host=a}"].Alerts[0].Value)
+	require.NotNil(t, resolved["heap/HeapInuse{host=a}"].Alerts[0].ResolvedAt)
+	require.Equal(t, StateResolved, resolved["polls/PollCount"].Status)
+
+	// resolved alerts are forgotten after the retention
+	now = now.Add(resolvedRetention)
+	e.evaluate(ctx)
+	require.Empty(t, states())
+	select {
+	case n = <-notifications:
+		require.FailNow(t, "unexpected notification", n)
+	default:
+	}
+}
+
+// blockingStorage doesn't return metrics until the context is done
+type blockingStorage struct {
+	interfaces.Storage
+	started chan struct{}
+}
+
+func (s blockingStorage) ListMetrics(ctx context.Context, _ models.MetricsFilter, _ func(m models.Metrics) error) error {
+	s.started <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestEngine_SlowStorage(t *testing.T) {
+	ctx := context.Background()
+	s := blockingStorage{Storage: storage.NewMemStorage("", false, 0), started: make(chan struct{}, 1)}
+	e, err := NewEngine(s, Config{
+		Rules: []Rule{{Name: "heap", Metric: "HeapInuse", Comparator: ">", Threshold: 100}},
+	}, 50*time.Millisecond)
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.evaluate(ctx)
+	}()
+	<-s.started
+	// alerts are available while metrics are read
+	require.Empty(t, e.Alerts())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "evaluation isn't limited by the storage timeout")
+	}
+}
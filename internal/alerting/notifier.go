@@ -0,0 +1,128 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	notificationQueueSize = 100
+	webhookTimeout        = 10 * time.Second
+)
+
+// webhookRetryDelays are pauses between attempts to deliver a notification
+var webhookRetryDelays = []time.Duration{time.Second, 3 * time.Second, 5 * time.Second}
+
+// Notification is the body posted to webhooks
+type Notification struct {
+	Status string  `json:"status"` // firing or resolved
+	Alerts []Alert `json:"alerts"`
+}
+
+// webhook delivers notifications to one URL in its own goroutine, so a slow receiver doesn't delay others
+type webhook struct {
+	url    string
+	client *http.Client
+	queue  chan Notification
+}
+
+type notifier struct {
+	webhooks []*webhook
+	wg       sync.WaitGroup
+}
+
+func newNotifier(urls []string) *notifier {
+	n := &notifier{}
+	for _, url := range urls {
+		n.webhooks = append(n.webhooks, &webhook{
+			url:    url,
+			client: &http.Client{Timeout: webhookTimeout},
+			queue:  make(chan Notification, notificationQueueSize),
+		})
+	}
+	return n
+}
+
+// run delivers queued notifications until ctx is done
+func (n *notifier) run(ctx context.Context) {
+	for _, w := range n.webhooks {
+		n.wg.Add(1)
+		go func(w *webhook) {
+			defer n.wg.Done()
+			w.run(ctx)
+		}(w)
+	}
+	n.wg.Wait()
+}
+
+// notify queues the notification to every webhook, it's dropped for webhooks with the full queue
+func (n *notifier) notify(notification Notification) {
+	for _, w := range n.webhooks {
+		select {
+		case w.queue <- notification:
+		default:
+			logger.Log.Warn("Alert notification is dropped, webhook queue is full", zap.String("url", w.url))
+		}
+	}
+}
+
+func (w *webhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notification := <-w.queue:
+			err := w.deliver(ctx, notification)
+			if err != nil {
+				logger.Log.Warn("Failed to deliver alert notification", zap.String("url", w.url), zap.Error(err))
+			}
+		}
+	}
+}
+
+// deliver posts the notification retrying on network errors, 5xx and 429 replies
+func (w *webhook) deliver(ctx context.Context, notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(ctx, body)
+		if err == nil || !retry || attempt == len(webhookRetryDelays) {
+			return err
+		}
+		logger.Log.Info("Alert notification is not delivered, retrying", zap.String("url", w.url), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(webhookRetryDelays[attempt]):
+		}
+	}
+}
+
+// post sends body once and tells if the failure is worth retrying
+func (w *webhook) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("webhook replied with status %d", resp.StatusCode)
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
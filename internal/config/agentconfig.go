@@ -6,18 +6,47 @@ import (
 	"os"
 	"strconv"
 	"strings"
+
+	"github.com/sgladkov/harvester/internal/models"
 )
 
 type AgentConfig struct {
-	Endpoint       *string
-	PollInterval   *int
-	ReportInterval *int
+	Endpoint        *string
+	PollInterval    *int
+	ReportInterval  *int
+	Host            *string
+	Instance        *string
+	Key             *string
+	CryptoKey       *string
+	ShutdownTimeout *int
+	ProcRoot        *string
+	Collectors      *string
+	RateLimit       *int
+	OutboxDir       *string
+	OutboxMaxSize   *int64
+	OutboxMaxAge    *int
+	Transport       *string
+	GRPCAddress     *string
 }
 
 func (ac *AgentConfig) Read() error {
 	ac.Endpoint = flag.String("a", "localhost:8080", "endpoint to start server (localhost:8080 by default)")
 	ac.PollInterval = flag.Int("p", 2, "poll interval")
 	ac.ReportInterval = flag.Int("r", 10, "report interval")
+	ac.RateLimit = flag.Int("l", 1, "maximum number of concurrent requests to server")
+	ac.Key = flag.String("k", "", "key to sign requests with HMAC-SHA256 (requests aren't signed by default)")
+	ac.CryptoKey = flag.String("crypto-key", "", "path to public key to encrypt requests (not encrypted by default)")
+	ac.ShutdownTimeout = flag.Int("shutdown-timeout", 10, "time in seconds to send the final report on shutdown")
+	ac.Host = flag.String("host", "", "value of host label attached to metrics (not attached by default)")
+	ac.Instance = flag.String("instance", "", "value of instance label attached to metrics (not attached by default)")
+	ac.ProcRoot = flag.String("proc-root", "/proc", "path to procfs to read host metrics from, empty disables host metrics")
+	ac.Collectors = flag.String("collectors", "",
+		"comma separated collectors settings name[:interval|off], e.g. runtime:5,host:off (all with poll interval by default)")
+	ac.OutboxDir = flag.String("outbox-dir", "", "directory to keep unsent metrics in (not kept by default)")
+	ac.OutboxMaxSize = flag.Int64("outbox-max-size", 10*1024*1024, "maximum size in bytes of unsent metrics")
+	ac.OutboxMaxAge = flag.Int("outbox-max-age", 86400, "time in seconds to keep unsent metrics for")
+	ac.Transport = flag.String("transport", "http", "protocol to report metrics with (http or grpc)")
+	ac.GRPCAddress = flag.String("g", "localhost:3200", "gRPC endpoint of server, used with grpc transport")
 	flag.Parse()
 
 	// check environment
@@ -43,6 +72,95 @@ func (ac *AgentConfig) Read() error {
 		}
 		*ac.PollInterval = int(val)
 	}
+	rateLimitStr := os.Getenv("RATE_LIMIT")
+	if len(rateLimitStr) > 0 {
+		val, err := strconv.ParseInt(rateLimitStr, 10, 32)
+		if err != nil {
+			return fmt.Errorf("failed to interpret RATE_LIMIT (=%s) environment variable, error is [%s]",
+				rateLimitStr, err)
+		}
+		*ac.RateLimit = int(val)
+	}
+	if *ac.RateLimit < 1 {
+		return fmt.Errorf("rate limit should be positive, got %d", *ac.RateLimit)
+	}
+	outboxDir, exist := os.LookupEnv("OUTBOX_DIR")
+	if exist {
+		*ac.OutboxDir = outboxDir
+	}
+	outboxMaxSizeStr := os.Getenv("OUTBOX_MAX_SIZE")
+	if len(outboxMaxSizeStr) > 0 {
+		val, err := strconv.ParseInt(outboxMaxSizeStr, 10, 64)
+		if err != nil {
+			return fmt.Errorf("failed to interpret OUTBOX_MAX_SIZE (=%s) environment variable, error is [%s]",
+				outboxMaxSizeStr, err)
+		}
+		*ac.OutboxMaxSize = val
+	}
+	outboxMaxAgeStr := os.Getenv("OUTBOX_MAX_AGE")
+	if len(outboxMaxAgeStr) > 0 {
+		val, err := strconv.ParseInt(outboxMaxAgeStr, 10, 32)
+		if err != nil {
+			return fmt.Errorf("failed to interpret OUTBOX_MAX_AGE (=%s) environment variable, error is [%s]",
+				outboxMaxAgeStr, err)
+		}
+		*ac.OutboxMaxAge = int(val)
+	}
+	shutdownStr := os.Getenv("SHUTDOWN_TIMEOUT")
+	if len(shutdownStr) > 0 {
+		val, err := strconv.ParseInt(shutdownStr, 10, 32)
+		if err != nil {
+			return fmt.Errorf("failed to interpret SHUTDOWN_TIMEOUT (=%s) environment variable, error is [%s]",
+				shutdownStr, err)
+		}
+		*ac.ShutdownTimeout = int(val)
+	}
+	key, exist := os.LookupEnv("KEY")
+	if exist {
+		*ac.Key = key
+	}
+	cryptoKey, exist := os.LookupEnv("CRYPTO_KEY")
+	if exist {
+		*ac.CryptoKey = cryptoKey
+	}
+	host, exist := os.LookupEnv("METRICS_HOST")
+	if exist {
+		*ac.Host = host
+	}
+	instance, exist := os.LookupEnv("METRICS_INSTANCE")
+	if exist {
+		*ac.Instance = instance
+	}
+	procRoot, exist := os.LookupEnv("PROC_ROOT")
+	if exist {
+		*ac.ProcRoot = procRoot
+	}
+	collectors, exist := os.LookupEnv("COLLECTORS")
+	if exist {
+		*ac.Collectors = collectors
+	}
+	_, err := ac.CollectorIntervals()
+	if err != nil {
+		return fmt.Errorf("invalid collectors settings, error is [%s]", err)
+	}
+	transport, exist := os.LookupEnv("TRANSPORT")
+	if exist {
+		*ac.Transport = transport
+	}
+	if *ac.Transport != "http" && *ac.Transport != "grpc" {
+		return fmt.Errorf("unknown transport [%s], http or grpc is expected", *ac.Transport)
+	}
+	if *ac.Transport == "grpc" && len(*ac.CryptoKey) > 0 {
+		return fmt.Errorf("gRPC requests aren't encrypted, so grpc transport can't be used with crypto key")
+	}
+	grpcAddress, exist := os.LookupEnv("GRPC_ADDRESS")
+	if exist {
+		*ac.GRPCAddress = grpcAddress
+	}
+	err = models.ValidateLabels(ac.Labels())
+	if err != nil {
+		return fmt.Errorf("invalid metrics labels, error is [%s]", err)
+	}
 
 	// add default url scheme if required
 	if !strings.HasPrefix(*ac.Endpoint, "http://") && !strings.HasPrefix(*ac.Endpoint, "https://") {
@@ -51,3 +169,46 @@ func (ac *AgentConfig) Read() error {
 
 	return nil
 }
+
+// Labels returns labels to attach to every metrics, empty values are skipped
+func (ac *AgentConfig) Labels() map[string]string {
+	labels := make(map[string]string)
+	if len(*ac.Host) > 0 {
+		labels["host"] = *ac.Host
+	}
+	if len(*ac.Instance) > 0 {
+		labels["instance"] = *ac.Instance
+	}
+	return labels
+}
+
+// CollectorIntervals returns poll intervals in seconds set for collectors, 0 means the collector is disabled.
+// Collectors which aren't mentioned in settings should be polled with poll interval.
+func (ac *AgentConfig) CollectorIntervals() (map[string]int, error) {
+	res := make(map[string]int)
+	if len(strings.TrimSpace(*ac.Collectors)) == 0 {
+		return res, nil
+	}
+	for _, item := range strings.Split(*ac.Collectors, ",") {
+		name, setting, found := strings.Cut(strings.TrimSpace(item), ":")
+		if len(name) == 0 {
+			return nil, fmt.Errorf("empty collector name in [%s]", *ac.Collectors)
+		}
+		if _, exists := res[name]; exists {
+			return nil, fmt.Errorf("collector [%s] is set more than once", name)
+		}
+		switch {
+		case !found:
+			res[name] = *ac.PollInterval
+		case setting == "off":
+			res[name] = 0
+		default:
+			interval, err := strconv.Atoi(setting)
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("invalid interval [%s] of collector [%s]", setting, name)
+			}
+			res[name] = interval
+		}
+	}
+	return res, nil
+}
@@ -8,12 +8,28 @@ import (
 )
 
 type ServerConfig struct {
-	Endpoint      *string
-	LogLevel      *string
-	StoreInterval *int
-	FileStorage   *string
-	RestoreFlag   *bool
-	DatabaseDSN   *string
+	Endpoint         *string
+	LogLevel         *string
+	StoreInterval    *int
+	FileStorage      *string
+	RestoreFlag      *bool
+	DatabaseDSN      *string
+	HistoryRetention *int
+	StorageTimeout   *int
+	Key              *string
+	CryptoKey        *string
+	ShutdownTimeout  *int
+	GRPCAddress      *string
+	StatsDAddress    *string
+	InfluxCounters   *string
+	MetricsTTL       *int
+	StreamBuffer     *int
+	AlertRules       *string
+
+	GraphiteAddress        *string
+	GraphiteTemplates      *string
+	GraphiteMaxConnections *int
+	GraphiteIdleTimeout    *int
 }
 
 func (sc *ServerConfig) Read() (string, error) {
@@ -25,6 +41,24 @@ func (sc *ServerConfig) Read() (string, error) {
 	sc.FileStorage = flag.String("s", "/tmp/metrics-db.json", "file to store ans restore metrics")
 	sc.RestoreFlag = flag.Bool("r", true, "should server read initial metrics value from the file")
 	sc.DatabaseDSN = flag.String("d", "", "database connection string for PostgreSQL")
+	sc.StorageTimeout = flag.Int("storage-timeout", 10, "time in seconds to wait for storage per request, 0 means no limit")
+	sc.HistoryRetention = flag.Int("history-retention", 3600, "time in seconds to keep metrics history for, 0 disables history")
+	sc.Key = flag.String("k", "", "key to check requests and sign replies with HMAC-SHA256 (not checked by default)")
+	sc.CryptoKey = flag.String("crypto-key", "", "path to private key to decrypt requests (not encrypted by default)")
+	sc.ShutdownTimeout = flag.Int("shutdown-timeout", 10, "time in seconds to finish requests and then to save metrics on shutdown")
+	sc.GRPCAddress = flag.String("g", "", "endpoint to start gRPC server (disabled by default), gRPC isn't encrypted, "+
+		"so it can't be used with crypto key")
+	sc.StatsDAddress = flag.String("statsd-address", "", "UDP endpoint to receive StatsD metrics (disabled by default)")
+	sc.InfluxCounters = flag.String("influx-counters", "",
+		"regular expression of metrics ids whose /write fields are counter deltas (all fields are gauges by default)")
+	sc.MetricsTTL = flag.Int("metrics-ttl", 0, "time in minutes to remove series which aren't updated after, 0 disables expiration")
+	sc.StreamBuffer = flag.Int("stream-buffer", 256, "number of updates buffered per /api/v1/stream client, more are dropped")
+	sc.AlertRules = flag.String("alert-rules", "", "path to JSON file with alerting rules and webhooks (alerting is disabled by default)")
+	sc.GraphiteAddress = flag.String("graphite-address", "", "TCP endpoint to receive Graphite plaintext metrics (disabled by default)")
+	sc.GraphiteTemplates = flag.String("graphite-templates", "",
+		"';' separated templates mapping Graphite paths to metrics ids and labels, e.g. 'servers.* .host.id*'")
+	sc.GraphiteMaxConnections = flag.Int("graphite-max-connections", 100, "maximum number of Graphite connections, 0 means no limit")
+	sc.GraphiteIdleTimeout = flag.Int("graphite-idle-timeout", 60, "time in seconds to close idle Graphite connections after, 0 means no limit")
 	flag.Parse()
 
 	// check environment
@@ -63,6 +97,107 @@ func (sc *ServerConfig) Read() (string, error) {
 	if len(envDatabaseDSN) > 0 {
 		*sc.DatabaseDSN = envDatabaseDSN
 	}
+	envHistoryRetention := os.Getenv("HISTORY_RETENTION")
+	if len(envHistoryRetention) > 0 {
+		val, err := strconv.ParseInt(envHistoryRetention, 10, 32)
+		if err != nil {
+			return logLevel, fmt.Errorf("failed to interpret HISTORY_RETENTION (=%s) environment variable, error is [%s]",
+				envHistoryRetention, err)
+		}
+		*sc.HistoryRetention = int(val)
+	}
+	envStorageTimeout := os.Getenv("STORAGE_TIMEOUT")
+	if len(envStorageTimeout) > 0 {
+		val, err := strconv.ParseInt(envStorageTimeout, 10, 32)
+		if err != nil {
+			return logLevel, fmt.Errorf("failed to interpret STORAGE_TIMEOUT (=%s) environment variable, error is [%s]",
+				envStorageTimeout, err)
+		}
+		*sc.StorageTimeout = int(val)
+	}
+	envKey, exist := os.LookupEnv("KEY")
+	if exist {
+		*sc.Key = envKey
+	}
+	envCryptoKey, exist := os.LookupEnv("CRYPTO_KEY")
+	if exist {
+		*sc.CryptoKey = envCryptoKey
+	}
+	envShutdownTimeout := os.Getenv("SHUTDOWN_TIMEOUT")
+	if len(envShutdownTimeout) > 0 {
+		val, err := strconv.ParseInt(envShutdownTimeout, 10, 32)
+		if err != nil {
+			return logLevel, fmt.Errorf("failed to interpret SHUTDOWN_TIMEOUT (=%s) environment variable, error is [%s]",
+				envShutdownTimeout, err)
+		}
+		*sc.ShutdownTimeout = int(val)
+	}
+	envGRPCAddress, exist := os.LookupEnv("GRPC_ADDRESS")
+	if exist {
+		*sc.GRPCAddress = envGRPCAddress
+	}
+	envStatsDAddress, exist := os.LookupEnv("STATSD_ADDRESS")
+	if exist {
+		*sc.StatsDAddress = envStatsDAddress
+	}
+	envInfluxCounters, exist := os.LookupEnv("INFLUX_COUNTERS")
+	if exist {
+		*sc.InfluxCounters = envInfluxCounters
+	}
+	envMetricsTTL := os.Getenv("METRICS_TTL")
+	if len(envMetricsTTL) > 0 {
+		val, err := strconv.ParseInt(envMetricsTTL, 10, 32)
+		if err != nil {
+			return logLevel, fmt.Errorf("failed to interpret METRICS_TTL (=%s) environment variable, error is [%s]",
+				envMetricsTTL, err)
+		}
+		*sc.MetricsTTL = int(val)
+	}
+	envStreamBuffer := os.Getenv("STREAM_BUFFER")
+	if len(envStreamBuffer) > 0 {
+		val, err := strconv.ParseInt(envStreamBuffer, 10, 32)
+		if err != nil {
+			return logLevel, fmt.Errorf("failed to interpret STREAM_BUFFER (=%s) environment variable, error is [%s]",
+				envStreamBuffer, err)
+		}
+		*sc.StreamBuffer = int(val)
+	}
+	if *sc.StreamBuffer < 0 {
+		return logLevel, fmt.Errorf("stream buffer should not be negative, got %d", *sc.StreamBuffer)
+	}
+	envAlertRules, exist := os.LookupEnv("ALERT_RULES")
+	if exist {
+		*sc.AlertRules = envAlertRules
+	}
+	envGraphiteAddress, exist := os.LookupEnv("GRAPHITE_ADDRESS")
+	if exist {
+		*sc.GraphiteAddress = envGraphiteAddress
+	}
+	envGraphiteTemplates, exist := os.LookupEnv("GRAPHITE_TEMPLATES")
+	if exist {
+		*sc.GraphiteTemplates = envGraphiteTemplates
+	}
+	envGraphiteMaxConnections := os.Getenv("GRAPHITE_MAX_CONNECTIONS")
+	if len(envGraphiteMaxConnections) > 0 {
+		val, err := strconv.ParseInt(envGraphiteMaxConnections, 10, 32)
+		if err != nil {
+			return logLevel, fmt.Errorf("failed to interpret GRAPHITE_MAX_CONNECTIONS (=%s) environment variable, error is [%s]",
+				envGraphiteMaxConnections, err)
+		}
+		*sc.GraphiteMaxConnections = int(val)
+	}
+	envGraphiteIdleTimeout := os.Getenv("GRAPHITE_IDLE_TIMEOUT")
+	if len(envGraphiteIdleTimeout) > 0 {
+		val, err := strconv.ParseInt(envGraphiteIdleTimeout, 10, 32)
+		if err != nil {
+			return logLevel, fmt.Errorf("failed to interpret GRAPHITE_IDLE_TIMEOUT (=%s) environment variable, error is [%s]",
+				envGraphiteIdleTimeout, err)
+		}
+		*sc.GraphiteIdleTimeout = int(val)
+	}
+	if len(*sc.GRPCAddress) > 0 && len(*sc.CryptoKey) > 0 {
+		return logLevel, fmt.Errorf("gRPC requests aren't encrypted, so gRPC server can't be started with crypto key")
+	}
 
 	return logLevel, nil
 }
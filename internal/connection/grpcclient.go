@@ -0,0 +1,115 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/models"
+	pb "github.com/sgladkov/harvester/internal/proto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+const grpcCallTimeout = 30 * time.Second
+
+type GRPCClient struct {
+	conn   *grpc.ClientConn
+	client pb.MetricsClient
+	key    string
+}
+
+// gzipInterceptor compresses requests and asks the server to compress replies
+func gzipInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(ctx, method, req, reply, cc, append(opts, grpc.UseCompressor(gzip.Name))...)
+}
+
+// hashInterceptor signs requests with the key and checks signatures of replies if they are signed
+func (c *GRPCClient) hashInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	msg, ok := req.(proto.Message)
+	if len(c.key) == 0 || !ok {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	hash, err := pb.MessageHash(msg, c.key)
+	if err != nil {
+		logger.Log.Warn("Failed to sign request", zap.Error(err))
+		return err
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, pb.HashMetadata, hash)
+	var header metadata.MD
+	err = invoker(ctx, method, req, reply, cc, append(opts, grpc.Header(&header))...)
+	if err != nil {
+		return err
+	}
+	values := header.Get(pb.HashMetadata)
+	replyMsg, ok := reply.(proto.Message)
+	if len(values) == 0 || !ok {
+		return nil
+	}
+	valid, err := pb.CheckMessageHash(replyMsg, c.key, values[0])
+	if err != nil {
+		return err
+	}
+	if !valid {
+		logger.Log.Warn("Reply signature mismatch", zap.String("hash", values[0]))
+		return errors.New("reply signature mismatch")
+	}
+	return nil
+}
+
+// NewGRPCClient creates GRPCClient, requests are signed with HMAC-SHA256 if key isn't empty.
+// The connection is established lazily, so the server may be unavailable yet.
+func NewGRPCClient(address string, key string) (*GRPCClient, error) {
+	result := GRPCClient{key: key}
+	conn, err := grpc.Dial(address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithChainUnaryInterceptor(gzipInterceptor, result.hashInterceptor),
+	)
+	if err != nil {
+		return nil, err
+	}
+	result.conn = conn
+	result.client = pb.NewMetricsClient(conn)
+	return &result, nil
+}
+
+func (c *GRPCClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *GRPCClient) UpdateMetrics(m *models.Metrics) error {
+	metric, err := pb.FromModel(*m)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grpcCallTimeout)
+	defer cancel()
+	reply, err := c.client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metric: metric})
+	if err != nil {
+		return err
+	}
+	logger.Log.Info("Reply", zap.String("metric", reply.GetMetric().String()))
+	return nil
+}
+
+func (c *GRPCClient) BatchUpdateMetrics(metricsBatch []models.Metrics) error {
+	req := pb.BatchUpdateMetricsRequest{Metrics: make([]*pb.Metric, 0, len(metricsBatch))}
+	for _, m := range metricsBatch {
+		metric, err := pb.FromModel(m)
+		if err != nil {
+			return err
+		}
+		req.Metrics = append(req.Metrics, metric)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grpcCallTimeout)
+	defer cancel()
+	_, err := c.client.BatchUpdateMetrics(ctx, &req)
+	return err
+}
@@ -3,21 +3,28 @@ package connection
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/sgladkov/harvester/internal/encryption"
 	"github.com/sgladkov/harvester/internal/logger"
 	"github.com/sgladkov/harvester/internal/models"
+	"github.com/sgladkov/harvester/internal/utils"
 	"go.uber.org/zap"
 )
 
 type RestyClient struct {
-	client *resty.Client
-	server string
+	client    *resty.Client
+	server    string
+	key       string
+	publicKey *rsa.PublicKey
 }
 
-func gzipEncoder(_ *resty.Client, req *resty.Request) error {
+// gzipEncoder marshals Metrics to JSON, signs it with the key if any and compresses
+func (c *RestyClient) gzipEncoder(_ *resty.Client, req *resty.Request) error {
 	logger.Log.Info("gzipEncoder")
 	switch m := req.Body.(type) {
 	case *models.Metrics, []models.Metrics:
@@ -31,6 +38,9 @@ func gzipEncoder(_ *resty.Client, req *resty.Request) error {
 			return err
 		}
 		logger.Log.Info("Marshalled", zap.String("body", string(originalBody)))
+		if len(c.key) > 0 {
+			req.SetHeader(utils.HashHeader, utils.CalculateHash(originalBody, c.key))
+		}
 		var compressedBody bytes.Buffer
 		w, err := gzip.NewWriterLevel(&compressedBody, gzip.BestCompression)
 		if err != nil {
@@ -57,13 +67,52 @@ func gzipEncoder(_ *resty.Client, req *resty.Request) error {
 	return nil
 }
 
-func NewRestyClient(server string) *RestyClient {
+// encryptor encrypts the body prepared by gzipEncoder with the public key if any
+func (c *RestyClient) encryptor(_ *resty.Client, req *resty.Request) error {
+	if c.publicKey == nil {
+		return nil
+	}
+	body, ok := req.Body.(string)
+	if !ok {
+		// encrypt Metrics updates only
+		return nil
+	}
+	encrypted, err := encryption.Encrypt(c.publicKey, []byte(body))
+	if err != nil {
+		logger.Log.Warn("Failed to encrypt request body", zap.Error(err))
+		return err
+	}
+	req.SetHeader(encryption.Header, encryption.Scheme)
+	req.SetBody(encrypted)
+	return nil
+}
+
+// hashChecker checks signature of the reply if the key is set
+func (c *RestyClient) hashChecker(_ *resty.Client, resp *resty.Response) error {
+	hash := resp.Header().Get(utils.HashHeader)
+	if len(c.key) == 0 || len(hash) == 0 {
+		return nil
+	}
+	if !utils.CheckHash(resp.Body(), c.key, hash) {
+		logger.Log.Warn("Reply signature mismatch", zap.String("hash", hash))
+		return errors.New("reply signature mismatch")
+	}
+	return nil
+}
+
+// NewRestyClient creates RestyClient, requests are signed with HMAC-SHA256 if key isn't empty
+// and encrypted if publicKey isn't nil
+func NewRestyClient(server string, key string, publicKey *rsa.PublicKey) *RestyClient {
 	result := RestyClient{
-		server: server,
-		client: resty.New(),
+		server:    server,
+		client:    resty.New(),
+		key:       key,
+		publicKey: publicKey,
 	}
 	result.client.SetHeader("Content-Type", "application/json")
-	result.client.OnBeforeRequest(gzipEncoder)
+	result.client.OnBeforeRequest(result.gzipEncoder)
+	result.client.OnBeforeRequest(result.encryptor)
+	result.client.OnAfterResponse(result.hashChecker)
 	return &result
 }
 
@@ -0,0 +1,164 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Header is the HTTP header which marks the encrypted body, its value is the encryption scheme
+const Header = "Encryption"
+
+// Scheme is the hybrid encryption scheme: random AES-256 key is encrypted with RSA-OAEP (SHA-256)
+// and the data itself is encrypted with AES-GCM. Encrypted data layout is
+// [2 bytes big endian length of encrypted key][encrypted key][nonce][AES-GCM ciphertext]
+const Scheme = "RSA-OAEP-AES-GCM"
+
+const sessionKeySize = 32
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file [%s]: %w", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in key file [%s]", path)
+	}
+	return block, nil
+}
+
+// LoadPublicKey reads RSA public key from PEM file, both PKIX (PUBLIC KEY) and PKCS #1 (RSA PUBLIC KEY)
+// forms are supported
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key from [%s]: %w", path, err)
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key in [%s] isn't an RSA key", path)
+		}
+		return rsaKey, nil
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key from [%s]: %w", path, err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unexpected PEM block [%s] in [%s], public key expected", block.Type, path)
+	}
+}
+
+// LoadPrivateKey reads RSA private key from PEM file, both PKCS #8 (PRIVATE KEY) and PKCS #1 (RSA PRIVATE KEY)
+// forms are supported
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key from [%s]: %w", path, err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key in [%s] isn't an RSA key", path)
+		}
+		return rsaKey, nil
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key from [%s]: %w", path, err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unexpected PEM block [%s] in [%s], private key expected", block.Type, path)
+	}
+}
+
+// Encrypt encrypts data with Scheme
+func Encrypt(key *rsa.PublicKey, data []byte) ([]byte, error) {
+	sessionKey := make([]byte, sessionKeySize)
+	_, err := rand.Read(sessionKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session key: %w", err)
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, sessionKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt session key: %w", err)
+	}
+	gcm, err := newGCM(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	res := make([]byte, 2, 2+len(encryptedKey)+len(nonce)+len(data)+gcm.Overhead())
+	binary.BigEndian.PutUint16(res, uint16(len(encryptedKey)))
+	res = append(res, encryptedKey...)
+	res = append(res, nonce...)
+	return gcm.Seal(res, nonce, data, nil), nil
+}
+
+// Decrypt decrypts data encrypted with Scheme
+func Decrypt(key *rsa.PrivateKey, data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, errors.New("encrypted data is too short")
+	}
+	keyLen := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < keyLen {
+		return nil, errors.New("encrypted data is too short")
+	}
+	sessionKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, data[:keyLen], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt session key: %w", err)
+	}
+	data = data[keyLen:]
+	gcm, err := newGCM(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+	res, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data: %w", err)
+	}
+	return res, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return gcm, nil
+}
@@ -0,0 +1,67 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, path string, blockType string, data []byte) {
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600))
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	dir := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	publicPKIX, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	writePEM(t, filepath.Join(dir, "public.pem"), "PUBLIC KEY", publicPKIX)
+	writePEM(t, filepath.Join(dir, "public1.pem"), "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&key.PublicKey))
+	writePEM(t, filepath.Join(dir, "private.pem"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+
+	public, err := LoadPublicKey(filepath.Join(dir, "public.pem"))
+	require.NoError(t, err)
+	public1, err := LoadPublicKey(filepath.Join(dir, "public1.pem"))
+	require.NoError(t, err)
+	private, err := LoadPrivateKey(filepath.Join(dir, "private.pem"))
+	require.NoError(t, err)
+
+	data := []byte(`[{"id":"test","type":"gauge","value":1.5}]`)
+	for _, k := range []*rsa.PublicKey{public, public1} {
+		encrypted, err := Encrypt(k, data)
+		require.NoError(t, err)
+		require.NotContains(t, string(encrypted), "test")
+		decrypted, err := Decrypt(private, encrypted)
+		require.NoError(t, err)
+		require.Equal(t, data, decrypted)
+
+		encrypted[len(encrypted)-1] ^= 1
+		_, err = Decrypt(private, encrypted)
+		require.Error(t, err)
+		_, err = Decrypt(private, encrypted[:10])
+		require.Error(t, err)
+	}
+}
+
+func TestLoadKeyErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := LoadPublicKey(filepath.Join(dir, "missing.pem"))
+	require.ErrorContains(t, err, "failed to read key file")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "garbage.pem"), []byte("garbage"), 0600))
+	_, err = LoadPrivateKey(filepath.Join(dir, "garbage.pem"))
+	require.ErrorContains(t, err, "no PEM data found")
+
+	writePEM(t, filepath.Join(dir, "broken.pem"), "PUBLIC KEY", []byte("broken"))
+	_, err = LoadPublicKey(filepath.Join(dir, "broken.pem"))
+	require.ErrorContains(t, err, "failed to parse public key")
+	_, err = LoadPrivateKey(filepath.Join(dir, "broken.pem"))
+	require.ErrorContains(t, err, "private key expected")
+}
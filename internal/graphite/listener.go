@@ -0,0 +1,262 @@
+package graphite
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/interfaces"
+	"github.com/sgladkov/harvester/internal/logger"
+	"go.uber.org/zap"
+)
+
+const maxLineLength = 64 * 1024
+
+// Config is settings of Listener
+type Config struct {
+	Templates      []Template    // templates to map paths, DefaultTemplate is used if no one matches
+	MaxConnections int           // connections over the limit are closed at once, 0 means no limit
+	IdleTimeout    time.Duration // connections without lines for this time are closed, 0 means no timeout
+	StorageTimeout time.Duration // limit of storage operations time per line, 0 means no limit
+}
+
+// Stats is counters of the listener
+type Stats struct {
+	Connections uint64 // accepted connections
+	Rejected    uint64 // connections closed because of the limit
+	Lines       uint64
+	Malformed   uint64 // lines which can't be parsed
+	Dropped     uint64 // parsed lines which aren't stored, e.g. with invalid path or because of storage error
+}
+
+// Listener receives Graphite plaintext protocol lines over TCP and stores them as gauges
+type Listener struct {
+	listener net.Listener
+	storage  interfaces.Storage
+	config   Config
+	lock     sync.Mutex
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+
+	connections atomic.Uint64
+	rejected    atomic.Uint64
+	lines       atomic.Uint64
+	malformed   atomic.Uint64
+	dropped     atomic.Uint64
+}
+
+func NewListener(address string, s interfaces.Storage, config Config) (*Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{
+		listener: listener,
+		storage:  s,
+		config:   config,
+		conns:    make(map[net.Conn]struct{}),
+	}, nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+func (l *Listener) Stats() Stats {
+	return Stats{
+		Connections: l.connections.Load(),
+		Rejected:    l.rejected.Load(),
+		Lines:       l.lines.Load(),
+		Malformed:   l.malformed.Load(),
+		Dropped:     l.dropped.Load(),
+	}
+}
+
+// Serve accepts connections until Shutdown is called
+func (l *Listener) Serve() error {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		if !l.track(conn) {
+			l.rejected.Add(1)
+			logger.Log.Warn("Graphite connection is rejected", zap.String("remote", conn.RemoteAddr().String()))
+			closeConn(conn)
+			continue
+		}
+		l.connections.Add(1)
+		go l.handle(conn)
+	}
+}
+
+// Shutdown stops accepting connections and waits for the open ones to process lines received already.
+// Connections which aren't finished when ctx is done are closed.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.lock.Lock()
+	l.closed = true
+	err := l.listener.Close()
+	// wake up readers, they finish after processing buffered lines
+	for conn := range l.conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	l.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		l.lock.Lock()
+		for conn := range l.conns {
+			closeConn(conn)
+		}
+		l.lock.Unlock()
+		err = errors.Join(err, ctx.Err())
+	}
+	stats := l.Stats()
+	logger.Log.Info("Graphite listener is stopped",
+		zap.Uint64("connections", stats.Connections),
+		zap.Uint64("rejected", stats.Rejected),
+		zap.Uint64("lines", stats.Lines),
+		zap.Uint64("malformed", stats.Malformed),
+		zap.Uint64("dropped", stats.Dropped),
+	)
+	return err
+}
+
+// track registers connection if the limit allows
+func (l *Listener) track(conn net.Conn) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed || (l.config.MaxConnections > 0 && len(l.conns) >= l.config.MaxConnections) {
+		return false
+	}
+	l.conns[conn] = struct{}{}
+	l.wg.Add(1)
+	return true
+}
+
+func (l *Listener) untrack(conn net.Conn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.conns, conn)
+	l.wg.Done()
+}
+
+func (l *Listener) isClosed() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.closed
+}
+
+func closeConn(conn net.Conn) {
+	err := conn.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Log.Warn("failed to close Graphite connection", zap.Error(err))
+	}
+}
+
+// setDeadline extends idle timeout of the connection, it's done under the lock to not override Shutdown deadline
+func (l *Listener) setDeadline(conn net.Conn) {
+	if l.config.IdleTimeout <= 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.closed {
+		_ = conn.SetReadDeadline(time.Now().Add(l.config.IdleTimeout))
+	}
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	defer l.untrack(conn)
+	defer closeConn(conn)
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, maxLineLength)
+	l.setDeadline(conn)
+	for scanner.Scan() {
+		l.process(scanner.Text())
+		l.setDeadline(conn)
+	}
+	err := scanner.Err()
+	var netErr net.Error
+	switch {
+	case err == nil, l.isClosed(), errors.Is(err, net.ErrClosed):
+	case errors.As(err, &netErr) && netErr.Timeout():
+		logger.Log.Info("Idle Graphite connection is closed", zap.String("remote", conn.RemoteAddr().String()))
+	default:
+		logger.Log.Warn("Failed to read Graphite connection", zap.Error(err))
+	}
+}
+
+// parseLine parses "path value [timestamp]" line, timestamp is validated only
+func parseLine(line string) (string, float64, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return "", 0, fmt.Errorf("invalid line [%s], path value timestamp is expected", line)
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return "", 0, fmt.Errorf("invalid value [%s] in line [%s]", fields[1], line)
+	}
+	if len(fields) == 3 {
+		_, err = strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid timestamp [%s] in line [%s]", fields[2], line)
+		}
+	}
+	return fields[0], value, nil
+}
+
+func (l *Listener) process(line string) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+	l.lines.Add(1)
+	p, value, err := parseLine(line)
+	if err != nil {
+		l.malformed.Add(1)
+		logger.Log.Debug("Malformed Graphite line", zap.Error(err))
+		return
+	}
+	err = l.store(p, value)
+	if err != nil {
+		l.dropped.Add(1)
+		logger.Log.Warn("Graphite metrics is dropped", zap.String("line", line), zap.Error(err))
+	}
+}
+
+func (l *Listener) store(p string, value float64) error {
+	m, err := mapPath(l.config.Templates, p)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if l.config.StorageTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.config.StorageTimeout)
+		defer cancel()
+	}
+	return l.storage.SetGauge(ctx, m.SeriesKey(), value)
+}
@@ -0,0 +1,87 @@
+package graphite
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func startListener(t *testing.T, config Config) (*Listener, *storage.MemStorage, chan error) {
+	t.Helper()
+	require.NoError(t, logger.Initialize("error"))
+	s := storage.NewMemStorage("", false, 0)
+	l, err := NewListener("127.0.0.1:0", s, config)
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- l.Serve()
+	}()
+	return l, s, served
+}
+
+func TestListener(t *testing.T) {
+	ctx := context.Background()
+	templates, err := ParseTemplates("servers.* .host.id*")
+	require.NoError(t, err)
+	l, s, served := startListener(t, Config{Templates: templates, MaxConnections: 1, StorageTimeout: time.Second})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(conn, "servers.web1.cpu.load 0.5 1700000000\nsys.mem.free 1024 1700000000\n"+
+		"broken\nsys.mem.used abc 1\n.. 1 1\n")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return l.Stats().Lines == 5
+	}, time.Second, 10*time.Millisecond)
+
+	// connections over the limit are closed at once
+	extra, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, extra.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = extra.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	value, err := s.GetGauge(ctx, "cpuLoad{host=web1}")
+	require.NoError(t, err)
+	require.Equal(t, 0.5, value)
+	value, err = s.GetGauge(ctx, "sysMemFree")
+	require.NoError(t, err)
+	require.Equal(t, 1024.0, value)
+
+	// lines sent before shutdown are stored
+	_, err = fmt.Fprintf(conn, "sys.mem.used 10\n")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return l.Stats().Lines == 6
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, l.Shutdown(ctx))
+	require.NoError(t, <-served)
+	require.Equal(t, Stats{Connections: 1, Rejected: 1, Lines: 6, Malformed: 2, Dropped: 1}, l.Stats())
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	require.NoError(t, conn.Close())
+}
+
+func TestListener_IdleTimeout(t *testing.T) {
+	l, _, served := startListener(t, Config{IdleTimeout: 100 * time.Millisecond})
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, l.Shutdown(ctx))
+	require.NoError(t, <-served)
+}
@@ -0,0 +1,133 @@
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/sgladkov/harvester/internal/models"
+)
+
+// Template maps dotted Graphite path to metrics id and labels. Its spec is "[filter] template", e.g.
+// "servers.* .host.id*" maps servers.web1.cpu.load to cpuLoad{host=web1}. Filter is a dotted list of
+// glob patterns matched against the first path segments. Template elements are:
+//   - id: the segment is added to metrics id
+//   - id*: the rest of the segments are added to metrics id, it should be the last element
+//   - empty element: the segment is skipped
+//   - any other name: the segment is the value of label with that name
+//
+// Segments which aren't covered by template are skipped, segments of id are joined in camel case.
+type Template struct {
+	filter   []string
+	elements []string
+}
+
+// DefaultTemplate maps the whole path to metrics id
+var DefaultTemplate = Template{elements: []string{"id*"}}
+
+func ParseTemplate(spec string) (Template, error) {
+	var t Template
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 1:
+		t.elements = strings.Split(fields[0], ".")
+	case 2:
+		t.filter = strings.Split(fields[0], ".")
+		t.elements = strings.Split(fields[1], ".")
+		for _, pattern := range t.filter {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return t, fmt.Errorf("invalid filter [%s] in template [%s]: %w", fields[0], spec, err)
+			}
+		}
+	default:
+		return t, fmt.Errorf("invalid template [%s], [filter] template is expected", spec)
+	}
+	hasID := false
+	for i, element := range t.elements {
+		switch element {
+		case "":
+		case "id":
+			hasID = true
+		case "id*":
+			if i != len(t.elements)-1 {
+				return t, fmt.Errorf("id* should be the last element of template [%s]", spec)
+			}
+			hasID = true
+		default:
+			if err := models.ValidateLabelName(element); err != nil {
+				return t, fmt.Errorf("invalid template [%s]: %w", spec, err)
+			}
+		}
+	}
+	if !hasID {
+		return t, fmt.Errorf("template [%s] has no id element", spec)
+	}
+	return t, nil
+}
+
+// ParseTemplates parses templates separated by ';', DefaultTemplate is used for paths which don't match any
+func ParseTemplates(specs string) ([]Template, error) {
+	var res []Template
+	for _, spec := range strings.Split(specs, ";") {
+		if len(strings.TrimSpace(spec)) == 0 {
+			continue
+		}
+		t, err := ParseTemplate(spec)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, t)
+	}
+	return res, nil
+}
+
+func (t Template) match(segments []string) bool {
+	if len(t.filter) > len(segments) {
+		return false
+	}
+	for i, pattern := range t.filter {
+		if matched, _ := path.Match(pattern, segments[i]); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (t Template) apply(segments []string) (models.Metrics, error) {
+	var m models.Metrics
+	var id []string
+	labels := make(map[string]string)
+	for i := 0; i < len(t.elements) && i < len(segments); i++ {
+		switch element := t.elements[i]; element {
+		case "":
+		case "id":
+			id = append(id, segments[i])
+		case "id*":
+			id = append(id, segments[i:]...)
+		default:
+			labels[element] = segments[i]
+		}
+	}
+	if len(id) == 0 {
+		return m, errors.New("path has no segments for metrics id")
+	}
+	var err error
+	m.ID, err = models.SanitizeMetricsID(strings.Join(id, "."))
+	if err != nil {
+		return m, err
+	}
+	m.Labels = models.SanitizeLabels(labels)
+	return m, nil
+}
+
+// mapPath converts path with the first matching template
+func mapPath(templates []Template, p string) (models.Metrics, error) {
+	segments := strings.Split(p, ".")
+	for _, t := range templates {
+		if t.match(segments) {
+			return t.apply(segments)
+		}
+	}
+	return DefaultTemplate.apply(segments)
+}
@@ -0,0 +1,44 @@
+package graphite
+
+import (
+	"testing"
+
+	"github.com/sgladkov/harvester/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapPath(t *testing.T) {
+	templates, err := ParseTemplates("servers.* .host.id*; stats.*.timers .dc..id.id")
+	require.NoError(t, err)
+
+	tests := []struct {
+		path string
+		want models.Metrics
+	}{
+		{"servers.web-1.cpu.load", models.Metrics{ID: "cpuLoad", Labels: map[string]string{"host": "web-1"}}},
+		{"stats.eu.timers.api.p99.extra", models.Metrics{ID: "apiP99", Labels: map[string]string{"dc": "eu"}}},
+		{"Alloc", models.Metrics{ID: "Alloc"}},
+		{"host_1.disk.used_percent", models.Metrics{ID: "host1DiskUsedPercent"}},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			got, err := mapPath(templates, test.path)
+			require.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+
+	// the template leaves no segments for id
+	_, err = mapPath(templates, "servers.web1")
+	require.Error(t, err)
+	_, err = mapPath(templates, "..")
+	require.Error(t, err)
+}
+
+func TestParseTemplate(t *testing.T) {
+	for _, spec := range []string{"", "a b c", "host.id*.id", ".host", "[ id", "bad-label.id"} {
+		_, err := ParseTemplate(spec)
+		assert.Error(t, err, spec)
+	}
+}
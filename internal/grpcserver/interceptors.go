@@ -0,0 +1,155 @@
+package grpcserver
+
+import (
+	"context"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/logger"
+	pb "github.com/sgladkov/harvester/internal/proto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// LoggingInterceptor logs calls like RequestLogger does for HTTP requests
+func LoggingInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	logger.Log.Info("gRPC call",
+		zap.String("method", info.FullMethod),
+		zap.Duration("duration", time.Since(start)),
+		zap.String("code", status.Code(err).String()),
+	)
+	return resp, err
+}
+
+func StreamLoggingInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	logger.Log.Info("gRPC stream",
+		zap.String("method", info.FullMethod),
+		zap.Duration("duration", time.Since(start)),
+		zap.String("code", status.Code(err).String()),
+	)
+	return err
+}
+
+// checkHash checks HMAC-SHA256 signature of the request passed in metadata
+func checkHash(ctx context.Context, req interface{}, key string) error {
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return status.Error(codes.Internal, "request isn't a protobuf message")
+	}
+	var hash string
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(pb.HashMetadata); len(values) > 0 {
+		hash = values[0]
+	}
+	if len(hash) == 0 {
+		logger.Log.Warn("Request isn't signed")
+		return status.Error(codes.Unauthenticated, "request isn't signed")
+	}
+	valid, err := pb.CheckMessageHash(msg, key, hash)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to calculate signature [%s]", err)
+	}
+	if !valid {
+		logger.Log.Warn("Request signature mismatch", zap.String("hash", hash))
+		return status.Error(codes.Unauthenticated, "request signature mismatch")
+	}
+	return nil
+}
+
+// HashInterceptor checks signatures of requests and signs replies in the header metadata if key is set
+func HashInterceptor(key string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		if len(key) == 0 {
+			return handler(ctx, req)
+		}
+		err := checkHash(ctx, req, key)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return resp, err
+		}
+		msg, ok := resp.(proto.Message)
+		if !ok {
+			return resp, nil
+		}
+		hash, err := pb.MessageHash(msg, key)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to sign reply [%s]", err)
+		}
+		err = grpc.SetHeader(ctx, metadata.Pairs(pb.HashMetadata, hash))
+		if err != nil {
+			logger.Log.Warn("Failed to sign reply", zap.Error(err))
+		}
+		return resp, nil
+	}
+}
+
+type hashStream struct {
+	grpc.ServerStream
+	key string
+}
+
+func (s hashStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err != nil {
+		return err
+	}
+	return checkHash(s.Context(), m, s.key)
+}
+
+// StreamHashInterceptor checks signatures of requests of streaming calls, streamed replies aren't signed
+func StreamHashInterceptor(key string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		if len(key) == 0 {
+			return handler(srv, ss)
+		}
+		return handler(srv, hashStream{ServerStream: ss, key: key})
+	}
+}
+
+// StorageTimeoutInterceptor limits time of the call like StorageTimeout middleware does for HTTP requests
+func StorageTimeoutInterceptor(timeout time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		if timeout <= 0 {
+			return handler(ctx, req)
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return handler(ctx, req)
+	}
+}
+
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s contextStream) Context() context.Context {
+	return s.ctx
+}
+
+func StreamStorageTimeoutInterceptor(timeout time.Duration) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		if timeout <= 0 {
+			return handler(srv, ss)
+		}
+		ctx, cancel := context.WithTimeout(ss.Context(), timeout)
+		defer cancel()
+		return handler(srv, contextStream{ServerStream: ss, ctx: ctx})
+	}
+}
@@ -0,0 +1,169 @@
+package grpcserver
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/interfaces"
+	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/models"
+	pb "github.com/sgladkov/harvester/internal/proto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip" // register gzip compressor to decompress requests
+	"google.golang.org/grpc/status"
+)
+
+// Config is settings of gRPC server
+type Config struct {
+	// StorageTimeout limits time of storage operations per call, 0 means no limit
+	StorageTimeout time.Duration
+	// Key is used to check requests and sign replies with HMAC-SHA256 if it isn't empty
+	Key string
+}
+
+// MetricsServer implements Metrics gRPC service on top of interfaces.Storage
+type MetricsServer struct {
+	pb.UnimplementedMetricsServer
+	storage interfaces.Storage
+}
+
+func NewMetricsServer(s interfaces.Storage) *MetricsServer {
+	return &MetricsServer{storage: s}
+}
+
+// NewServer creates gRPC server with MetricsServer and interceptors matching the HTTP middleware
+func NewServer(s interfaces.Storage, config Config) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(
+			LoggingInterceptor,
+			HashInterceptor(config.Key),
+			StorageTimeoutInterceptor(config.StorageTimeout),
+		),
+		grpc.ChainStreamInterceptor(
+			StreamLoggingInterceptor,
+			StreamHashInterceptor(config.Key),
+			StreamStorageTimeoutInterceptor(config.StorageTimeout),
+		),
+	)
+	pb.RegisterMetricsServer(server, NewMetricsServer(s))
+	return server
+}
+
+// storageErrorCode returns the status code of a storage error, timeouts and unavailable storage are
+// distinguished from the errors caused by request
+func storageErrorCode(ctx context.Context, err error, defaultCode codes.Code) codes.Code {
+	ctxErr := ctx.Err()
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(ctxErr, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled), errors.Is(ctxErr, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, driver.ErrBadConn), errors.As(err, &netErr):
+		return codes.Unavailable
+	}
+	return defaultCode
+}
+
+func validate(m models.Metrics) error {
+	err := models.ValidateMetricsID(m.ID)
+	if err != nil {
+		return err
+	}
+	return models.ValidateLabels(m.Labels)
+}
+
+func (s *MetricsServer) UpdateMetrics(ctx context.Context, req *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	m, err := req.GetMetric().ToModel()
+	if err == nil {
+		err = validate(m)
+	}
+	if err != nil {
+		logger.Log.Warn("Failed to update metrics", zap.Error(err))
+		return nil, status.Errorf(codes.InvalidArgument, "failed to update metrics [%s]", err)
+	}
+	m, err = s.storage.SetMetrics(ctx, m)
+	if err != nil {
+		logger.Log.Warn("Failed to update metrics", zap.Error(err))
+		return nil, status.Errorf(storageErrorCode(ctx, err, codes.InvalidArgument),
+			"failed to update metrics [%s]", err)
+	}
+	metric, err := pb.FromModel(m)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to convert metrics [%s]", err)
+	}
+	return &pb.UpdateMetricsResponse{Metric: metric}, nil
+}
+
+func (s *MetricsServer) BatchUpdateMetrics(ctx context.Context,
+	req *pb.BatchUpdateMetricsRequest) (*pb.BatchUpdateMetricsResponse, error) {
+	batch := make([]models.Metrics, 0, len(req.GetMetrics()))
+	for _, metric := range req.GetMetrics() {
+		m, err := metric.ToModel()
+		if err == nil {
+			err = validate(m)
+		}
+		if err != nil {
+			logger.Log.Warn("Failed to update metrics", zap.Error(err))
+			return nil, status.Errorf(codes.InvalidArgument, "failed to update metrics [%s]", err)
+		}
+		batch = append(batch, m)
+	}
+	_, err := s.storage.SetMetricsBatch(ctx, batch)
+	if err != nil {
+		logger.Log.Warn("Failed to update metrics", zap.Error(err))
+		return nil, status.Errorf(storageErrorCode(ctx, err, codes.InvalidArgument),
+			"failed to update metrics [%s]", err)
+	}
+	return &pb.BatchUpdateMetricsResponse{}, nil
+}
+
+func (s *MetricsServer) GetMetric(ctx context.Context, req *pb.GetMetricRequest) (*pb.GetMetricResponse, error) {
+	mType, err := pb.TypeToModel(req.GetType())
+	m := models.Metrics{ID: req.GetId(), MType: mType}
+	if len(req.GetLabels()) > 0 {
+		m.Labels = req.GetLabels()
+	}
+	if err == nil {
+		err = validate(m)
+	}
+	if err != nil {
+		logger.Log.Warn("Failed to get metrics", zap.Error(err))
+		return nil, status.Errorf(codes.InvalidArgument, "failed to get metrics [%s]", err)
+	}
+	m, err = s.storage.GetMetrics(ctx, m)
+	if err != nil {
+		logger.Log.Warn("Failed to get metrics", zap.Error(err))
+		return nil, status.Errorf(storageErrorCode(ctx, err, codes.NotFound), "failed to get metrics [%s]", err)
+	}
+	metric, err := pb.FromModel(m)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to convert metrics [%s]", err)
+	}
+	return &pb.GetMetricResponse{Metric: metric}, nil
+}
+
+func (s *MetricsServer) ListMetrics(_ *pb.ListMetricsRequest, stream pb.Metrics_ListMetricsServer) error {
+	ctx := stream.Context()
+	metrics, err := s.storage.GetAllMetrics(ctx)
+	if err != nil {
+		logger.Log.Warn("Failed to get metrics", zap.Error(err))
+		return status.Errorf(storageErrorCode(ctx, err, codes.Internal), "failed to get metrics [%s]", err)
+	}
+	for _, m := range metrics {
+		metric, err := pb.FromModel(m)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to convert metrics [%s]", err)
+		}
+		err = stream.Send(metric)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
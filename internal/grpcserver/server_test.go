@@ -0,0 +1,142 @@
+package grpcserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/sgladkov/harvester/internal/connection"
+	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/models"
+	pb "github.com/sgladkov/harvester/internal/proto"
+	storage2 "github.com/sgladkov/harvester/internal/storage"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func startServer(t *testing.T, config Config) string {
+	t.Helper()
+	require.NoError(t, logger.Initialize("error"))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := NewServer(storage2.NewMemStorage("", false, 0), config)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func rawClient(t *testing.T, address string) pb.MetricsClient {
+	t.Helper()
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return pb.NewMetricsClient(conn)
+}
+
+func TestMetricsServer(t *testing.T) {
+	ctx := context.Background()
+	address := startServer(t, Config{})
+	client, err := connection.NewGRPCClient(address, "")
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
+
+	value := 1.5
+	delta := int64(2)
+	require.NoError(t, client.UpdateMetrics(&models.Metrics{ID: "g", MType: "gauge", Value: &value}))
+	require.NoError(t, client.BatchUpdateMetrics([]models.Metrics{
+		{ID: "c", MType: "counter", Delta: &delta},
+		{ID: "c", MType: "counter", Delta: &delta, Labels: map[string]string{"host": "a"}},
+	}))
+	require.NoError(t, client.UpdateMetrics(&models.Metrics{ID: "c", MType: "counter", Delta: &delta}))
+
+	raw := rawClient(t, address)
+	reply, err := raw.GetMetric(ctx, &pb.GetMetricRequest{Id: "c", Type: pb.Metric_COUNTER})
+	require.NoError(t, err)
+	require.Equal(t, int64(4), reply.GetMetric().GetDelta())
+	reply, err = raw.GetMetric(ctx, &pb.GetMetricRequest{Id: "c", Type: pb.Metric_COUNTER,
+		Labels: map[string]string{"host": "a"}})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), reply.GetMetric().GetDelta())
+	reply, err = raw.GetMetric(ctx, &pb.GetMetricRequest{Id: "g", Type: pb.Metric_GAUGE})
+	require.NoError(t, err)
+	require.Equal(t, 1.5, reply.GetMetric().GetValue())
+
+	_, err = raw.GetMetric(ctx, &pb.GetMetricRequest{Id: "unknown", Type: pb.Metric_GAUGE})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = raw.GetMetric(ctx, &pb.GetMetricRequest{Id: "g"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = raw.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metric: &pb.Metric{Id: "bad id", Type: pb.Metric_GAUGE}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = raw.BatchUpdateMetrics(ctx, &pb.BatchUpdateMetricsRequest{Metrics: []*pb.Metric{{Id: "c"}}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stream, err := raw.ListMetrics(ctx, &pb.ListMetricsRequest{})
+	require.NoError(t, err)
+	var list []models.Metrics
+	for {
+		metric, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		m, err := metric.ToModel()
+		require.NoError(t, err)
+		list = append(list, m)
+	}
+	require.Equal(t, 3, len(list))
+}
+
+func TestHashInterceptor(t *testing.T) {
+	ctx := context.Background()
+	address := startServer(t, Config{Key: "secret"})
+	value := 1.0
+	m := models.Metrics{ID: "g", MType: "gauge", Value: &value}
+
+	client, err := connection.NewGRPCClient(address, "secret")
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
+	require.NoError(t, client.UpdateMetrics(&m))
+	require.NoError(t, client.BatchUpdateMetrics([]models.Metrics{m}))
+
+	wrong, err := connection.NewGRPCClient(address, "wrong")
+	require.NoError(t, err)
+	defer func() {
+		_ = wrong.Close()
+	}()
+	err = wrong.UpdateMetrics(&m)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	raw := rawClient(t, address)
+	_, err = raw.GetMetric(ctx, &pb.GetMetricRequest{Id: "g", Type: pb.Metric_GAUGE})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = raw.GetMetric(metadata.AppendToOutgoingContext(ctx, pb.HashMetadata, "not a hex"),
+		&pb.GetMetricRequest{Id: "g", Type: pb.Metric_GAUGE})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// streaming calls check signatures of requests
+	req := &pb.ListMetricsRequest{}
+	stream, err := raw.ListMetrics(ctx, req)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	hash, err := pb.MessageHash(req, "secret")
+	require.NoError(t, err)
+	stream, err = raw.ListMetrics(metadata.AppendToOutgoingContext(ctx, pb.HashMetadata, hash), req)
+	require.NoError(t, err)
+	metric, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "g", metric.GetId())
+}
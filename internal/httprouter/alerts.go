@@ -0,0 +1,35 @@
+package httprouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/sgladkov/harvester/internal/alerting"
+	"github.com/sgladkov/harvester/internal/logger"
+	"go.uber.org/zap"
+)
+
+// alertEngine reports alerts for /api/v1/alerts, nil means alerting is disabled
+var alertEngine *alerting.Engine
+
+// getAlerts returns pending, firing and recently resolved alerts as JSON
+func getAlerts(w http.ResponseWriter, r *http.Request) {
+	if alertEngine == nil {
+		logger.Log.Warn("Alerting is disabled")
+		http.Error(w, "Alerting is disabled", http.StatusNotFound)
+		return
+	}
+	data, err := json.Marshal(alertEngine.Alerts())
+	if err != nil {
+		logger.Log.Warn("Failed to marshal alerts", zap.Error(err))
+		http.Error(w, fmt.Sprintf("Failed to marshal alerts [%s]", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(data)
+	if err != nil {
+		logger.Log.Warn("Failed to write reply", zap.Error(err))
+	}
+}
@@ -0,0 +1,197 @@
+package httprouter
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/models"
+	"go.uber.org/zap"
+)
+
+// defaultDashboardRefresh is the auto-refresh period of the dashboard in seconds
+const defaultDashboardRefresh = 10
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+{{- if .Refresh}}
+<meta http-equiv="refresh" content="{{.Refresh}}">
+{{- end}}
+<title>Harvester metrics</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.75em; text-align: left; }
+th { background: #eee; }
+td.value { text-align: right; font-family: monospace; }
+</style>
+</head>
+<body>
+<h1>Metrics</h1>
+<form method="get">
+<select name="type">
+<option value=""{{if eq .Type ""}} selected{{end}}>all types</option>
+<option value="gauge"{{if eq .Type "gauge"}} selected{{end}}>gauge</option>
+<option value="counter"{{if eq .Type "counter"}} selected{{end}}>counter</option>
+</select>
+<input name="prefix" value="{{.Prefix}}" placeholder="name prefix">
+<label>refresh <input name="refresh" type="number" min="0" value="{{.Refresh}}"> s</label>
+<button type="submit">Apply</button>
+<a href="?format=text">text</a>
+</form>
+{{- range .Tables}}
+<h2>{{.Title}} ({{len .Rows}})</h2>
+<table>
+<tr><th>Name</th><th>Labels</th><th>Value</th><th>Updated</th></tr>
+{{- range .Rows}}
+<tr><td>{{.ID}}</td><td>{{.Labels}}</td><td class="value">{{.Value}}</td><td>{{.Updated}}</td></tr>
+{{- else}}
+<tr><td colspan="4">no metrics</td></tr>
+{{- end}}
+</table>
+{{- end}}
+</body>
+</html>
+`))
+
+type dashboardRow struct {
+	ID      string
+	Labels  string
+	Value   string
+	Updated string
+}
+
+type dashboardTable struct {
+	Title string
+	Rows  []dashboardRow
+}
+
+type dashboardPage struct {
+	Type    string
+	Prefix  string
+	Refresh int
+	Tables  []dashboardTable
+}
+
+func dashboardLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// dashboardTables returns sorted tables of gauges and counters of the type (all if it's empty)
+// with ids starting with prefix
+func dashboardTables(metrics []models.Metrics, mType string, prefix string) []dashboardTable {
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].SeriesKey() < metrics[j].SeriesKey()
+	})
+	tables := []dashboardTable{{Title: "Gauges"}, {Title: "Counters"}}
+	for _, m := range metrics {
+		if !strings.HasPrefix(m.ID, prefix) {
+			continue
+		}
+		row := dashboardRow{ID: m.ID, Labels: dashboardLabels(m.Labels), Updated: "-"}
+		if m.Updated != nil {
+			row.Updated = m.Updated.Format(time.RFC3339)
+		}
+		switch {
+		case m.MType == "gauge" && m.Value != nil:
+			row.Value = strconv.FormatFloat(*m.Value, 'g', -1, 64)
+			tables[0].Rows = append(tables[0].Rows, row)
+		case m.MType == "counter" && m.Delta != nil:
+			row.Value = strconv.FormatInt(*m.Delta, 10)
+			tables[1].Rows = append(tables[1].Rows, row)
+		}
+	}
+	switch mType {
+	case "gauge":
+		return tables[:1]
+	case "counter":
+		return tables[1:]
+	}
+	return tables
+}
+
+func getAllMetricsText(w http.ResponseWriter, r *http.Request) {
+	all, err := storage.GetAll(r.Context())
+	if err != nil {
+		logger.Log.Warn("failed to get metrics", zap.Error(err))
+		http.Error(w, fmt.Sprintf("failed to get metrics [%s]", err),
+			storageErrorStatus(r, err, http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write([]byte(all))
+	if err != nil {
+		logger.Log.Warn("failed to write response body", zap.Error(err))
+	}
+}
+
+// getAllMetrics renders the dashboard. Query parameters: type (gauge or counter) and prefix filter metrics,
+// refresh sets the auto-refresh period in seconds (0 disables it), format=text returns plain name=value lines.
+func getAllMetrics(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch format := query.Get("format"); format {
+	case "", "html":
+	case "text":
+		getAllMetricsText(w, r)
+		return
+	default:
+		logger.Log.Warn("unknown dashboard format", zap.String("format", format))
+		http.Error(w, fmt.Sprintf("unknown format [%s]", format), http.StatusBadRequest)
+		return
+	}
+	page := dashboardPage{
+		Type:    query.Get("type"),
+		Prefix:  query.Get("prefix"),
+		Refresh: defaultDashboardRefresh,
+	}
+	if page.Type != "" && page.Type != "gauge" && page.Type != "counter" {
+		logger.Log.Warn("unknown metric type", zap.String("metric", page.Type))
+		http.Error(w, fmt.Sprintf("unknown metrics type [%s]", page.Type), http.StatusBadRequest)
+		return
+	}
+	if value := query.Get("refresh"); len(value) > 0 {
+		refresh, err := strconv.Atoi(value)
+		if err != nil || refresh < 0 {
+			logger.Log.Warn("invalid refresh period", zap.String("refresh", value))
+			http.Error(w, fmt.Sprintf("invalid refresh period [%s]", value), http.StatusBadRequest)
+			return
+		}
+		page.Refresh = refresh
+	}
+
+	metrics, err := storage.GetAllMetrics(r.Context())
+	if err != nil {
+		logger.Log.Warn("failed to get metrics", zap.Error(err))
+		http.Error(w, fmt.Sprintf("failed to get metrics [%s]", err),
+			storageErrorStatus(r, err, http.StatusInternalServerError))
+		return
+	}
+	page.Tables = dashboardTables(metrics, page.Type, page.Prefix)
+	var body bytes.Buffer
+	err = dashboardTemplate.Execute(&body, page)
+	if err != nil {
+		logger.Log.Warn("failed to render dashboard", zap.Error(err))
+		http.Error(w, fmt.Sprintf("failed to render dashboard [%s]", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(body.Bytes())
+	if err != nil {
+		logger.Log.Warn("failed to write response body", zap.Error(err))
+	}
+}
@@ -44,10 +44,11 @@ func updateGauge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	logger.Log.Debug("update gauge metric", zap.String("name", name), zap.Float64("value", value))
-	err = storage.SetGauge(name, value)
+	err = storage.SetGauge(r.Context(), name, value)
 	if err != nil {
 		logger.Log.Warn("failed to update gauge", zap.Error(err))
-		http.Error(w, fmt.Sprintf("failed to update gauge [%s]", err), http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("failed to update gauge [%s]", err),
+			storageErrorStatus(r, err, http.StatusBadRequest))
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -68,10 +69,11 @@ func updateCounter(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	logger.Log.Debug("update counter metric", zap.String("name", name), zap.Int64("value", value))
-	err = storage.SetCounter(name, value)
+	err = storage.SetCounter(r.Context(), name, value)
 	if err != nil {
 		logger.Log.Warn("failed to update counter", zap.Error(err))
-		http.Error(w, fmt.Sprintf("failed to update counter [%s]", err), http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("failed to update counter [%s]", err),
+			storageErrorStatus(r, err, http.StatusBadRequest))
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -97,11 +99,18 @@ func updateMetricJSON(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("failed to update metrics [%s]", err), http.StatusBadRequest)
 		return
 	}
+	err = models.ValidateLabels(m.Labels)
+	if err != nil {
+		logger.Log.Warn("failed to update metrics", zap.Error(err))
+		http.Error(w, fmt.Sprintf("failed to update metrics [%s]", err), http.StatusBadRequest)
+		return
+	}
 	logger.Log.Info("updateMetricJSON", zap.Any("metrics", m))
-	m, err = storage.SetMetrics(m)
+	m, err = storage.SetMetrics(r.Context(), m)
 	if err != nil {
 		logger.Log.Warn("Failed to save Metrics to storage", zap.Error(err))
-		http.Error(w, fmt.Sprintf("Failed to save Metrics to storage [%s]", err), http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Failed to save Metrics to storage [%s]", err),
+			storageErrorStatus(r, err, http.StatusBadRequest))
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -113,15 +122,6 @@ func updateMetricJSON(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getAllMetrics(w http.ResponseWriter, _ *http.Request) {
-	w.Header().Set("Content-Type", "text/html")
-	w.WriteHeader(http.StatusOK)
-	_, err := w.Write([]byte(storage.GetAll()))
-	if err != nil {
-		logger.Log.Warn("failed to write response body", zap.Error(err))
-	}
-}
-
 func getMetric(w http.ResponseWriter, r *http.Request) {
 	metricType := chi.URLParam(r, "type")
 	switch metricType {
@@ -143,10 +143,11 @@ func getGauge(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("failed to get gauge [%s]", err), http.StatusBadRequest)
 		return
 	}
-	value, err := storage.GetGauge(name)
+	value, err := storage.GetGauge(r.Context(), name)
 	if err != nil {
 		logger.Log.Warn("failed to get gauge", zap.Error(err))
-		http.Error(w, fmt.Sprintf("failed to get gauge [%s]", err), http.StatusNotFound)
+		http.Error(w, fmt.Sprintf("failed to get gauge [%s]", err),
+			storageErrorStatus(r, err, http.StatusNotFound))
 		return
 	}
 	logger.Log.Debug("requested gauge metric", zap.String("name", name), zap.Float64("value", value))
@@ -165,10 +166,11 @@ func getCounter(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("failed to get counter [%s]", err), http.StatusBadRequest)
 		return
 	}
-	value, err := storage.GetCounter(name)
+	value, err := storage.GetCounter(r.Context(), name)
 	if err != nil {
 		logger.Log.Warn("failed to get counter", zap.Error(err))
-		http.Error(w, fmt.Sprintf("failed to get counter [%s]", err), http.StatusNotFound)
+		http.Error(w, fmt.Sprintf("failed to get counter [%s]", err),
+			storageErrorStatus(r, err, http.StatusNotFound))
 		return
 	}
 	logger.Log.Debug("requested counter metric", zap.String("name", name), zap.Int64("value", value))
@@ -179,6 +181,31 @@ func getCounter(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// getRate returns per second growth of the counter over its last update,
+// the name is the metrics id with optional labels, e.g. PollCount{host=a}
+func getRate(w http.ResponseWriter, r *http.Request) {
+	m, err := parseSeriesParam(chi.URLParam(r, "name"))
+	if err != nil {
+		logger.Log.Warn("failed to get counter rate", zap.Error(err))
+		http.Error(w, fmt.Sprintf("failed to get counter rate [%s]", err), http.StatusBadRequest)
+		return
+	}
+	name := m.SeriesKey()
+	rate, err := storage.GetRate(r.Context(), name)
+	if err != nil {
+		logger.Log.Warn("failed to get counter rate", zap.Error(err))
+		http.Error(w, fmt.Sprintf("failed to get counter rate [%s]", err),
+			storageErrorStatus(r, err, http.StatusNotFound))
+		return
+	}
+	logger.Log.Debug("requested counter rate", zap.String("name", name), zap.Float64("rate", rate))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write([]byte(fmt.Sprintf("%g", rate)))
+	if err != nil {
+		logger.Log.Warn("failed to write response body", zap.Error(err))
+	}
+}
+
 func getMetricJSON(w http.ResponseWriter, r *http.Request) {
 	if !ContainsHeaderValue(r, "Content-Type", "application/json") {
 		contentType := r.Header.Get("Content-Type")
@@ -199,13 +226,30 @@ func getMetricJSON(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("failed to get metrics [%s]", err), http.StatusBadRequest)
 		return
 	}
+	err = models.ValidateLabels(m.Labels)
+	if err != nil {
+		logger.Log.Warn("failed to get metrics", zap.Error(err))
+		http.Error(w, fmt.Sprintf("failed to get metrics [%s]", err), http.StatusBadRequest)
+		return
+	}
 	logger.Log.Info("getMetricJSON", zap.Any("metrics", m))
-	m, err = storage.GetMetrics(m)
+	m, err = storage.GetMetrics(r.Context(), m)
 	if err != nil {
 		logger.Log.Warn("Failed to get Metrics from storage")
-		http.Error(w, fmt.Sprintf("Failed to get Metrics from storage [%s]", err), http.StatusNotFound)
+		http.Error(w, fmt.Sprintf("Failed to get Metrics from storage [%s]", err),
+			storageErrorStatus(r, err, http.StatusNotFound))
 		return
 	}
+	if m.MType == "counter" {
+		rate, err := storage.GetRate(r.Context(), m.SeriesKey())
+		if err != nil {
+			logger.Log.Warn("Failed to get counter rate from storage", zap.Error(err))
+			http.Error(w, fmt.Sprintf("Failed to get counter rate from storage [%s]", err),
+				storageErrorStatus(r, err, http.StatusNotFound))
+			return
+		}
+		m.Rate = &rate
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(&m)
@@ -215,6 +259,76 @@ func getMetricJSON(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// deleteMetric deletes the series, the name is the metrics id with optional labels, e.g. Alloc{host=a}
+func deleteMetric(w http.ResponseWriter, r *http.Request) {
+	m, err := parseSeriesParam(chi.URLParam(r, "name"))
+	m.MType = chi.URLParam(r, "type")
+	if err != nil {
+		logger.Log.Warn("failed to delete metrics", zap.Error(err))
+		http.Error(w, fmt.Sprintf("failed to delete metrics [%s]", err), http.StatusBadRequest)
+		return
+	}
+	if m.MType != "gauge" && m.MType != "counter" {
+		logger.Log.Warn("unknown metric type", zap.String("metric", m.MType))
+		http.Error(w, fmt.Sprintf("unknown metrics type [%s]", m.MType), http.StatusBadRequest)
+		return
+	}
+	deleted, err := storage.Delete(r.Context(), []models.Metrics{m})
+	if err != nil {
+		logger.Log.Warn("failed to delete metrics", zap.Error(err))
+		http.Error(w, fmt.Sprintf("failed to delete metrics [%s]", err),
+			storageErrorStatus(r, err, http.StatusInternalServerError))
+		return
+	}
+	otlpSums.forget(deleted)
+	if len(deleted) == 0 {
+		logger.Log.Warn("failed to delete metrics", zap.String("type", m.MType), zap.String("name", m.SeriesKey()))
+		http.Error(w, fmt.Sprintf("no %s [%s]", m.MType, m.SeriesKey()), http.StatusNotFound)
+		return
+	}
+	logger.Log.Info("metrics is deleted", zap.Any("metrics", deleted[0]))
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteMetricsJSON deletes series listed in the request (id, type and labels are used) in one transaction,
+// the reply lists deleted series with their last values, series which don't exist are skipped
+func deleteMetricsJSON(w http.ResponseWriter, r *http.Request) {
+	if !ContainsHeaderValue(r, "Content-Type", "application/json") {
+		contentType := r.Header.Get("Content-Type")
+		logger.Log.Warn("Wrong Content-Type header", zap.String("Content-Type", contentType))
+		http.Error(w, fmt.Sprintf("Wrong Content-Type header [%s]", contentType), http.StatusBadRequest)
+		return
+	}
+	var m []models.Metrics
+	err := json.NewDecoder(r.Body).Decode(&m)
+	if err != nil {
+		logger.Log.Warn("Failed to decode JSON to Metrics", zap.Error(err))
+		http.Error(w, fmt.Sprintf("Failed to decode JSON to Metrics [%s]", err), http.StatusBadRequest)
+		return
+	}
+	deleted, err := storage.Delete(r.Context(), m)
+	if err != nil {
+		logger.Log.Warn("Failed to delete Metrics from storage", zap.Error(err))
+		http.Error(w, fmt.Sprintf("Failed to delete Metrics from storage [%s]", err),
+			storageErrorStatus(r, err, http.StatusBadRequest))
+		return
+	}
+	otlpSums.forget(deleted)
+	logger.Log.Info("deleteMetricsJSON", zap.Any("metrics", deleted))
+	data, err := json.Marshal(deleted)
+	if err != nil {
+		logger.Log.Warn("Failed to marshal deleted metrics", zap.Error(err))
+		http.Error(w, fmt.Sprintf("Failed to marshal deleted metrics [%s]", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(data)
+	if err != nil {
+		logger.Log.Warn("Failed to write reply", zap.Error(err))
+	}
+}
+
 func ping(w http.ResponseWriter, _ *http.Request) {
 	logger.Log.Info("ping")
 	if database == nil {
@@ -226,6 +340,17 @@ func ping(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// batchItemResult is the result of a metrics update in the partial mode of /updates/,
+// it contains the resulting value or the metrics from the request with the error
+type batchItemResult struct {
+	models.Metrics
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// batchUpdate applies the batch atomically, if any metrics is invalid the batch is rejected without changes.
+// With partial=true metrics are applied one by one and the reply lists the result of each of them,
+// its status is 207 if some metrics are failed, so only they may be sent again.
 func batchUpdate(w http.ResponseWriter, r *http.Request) {
 	if !ContainsHeaderValue(r, "Content-Type", "application/json") {
 		contentType := r.Header.Get("Content-Type")
@@ -233,6 +358,16 @@ func batchUpdate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Wrong Content-Type header [%s]", contentType), http.StatusBadRequest)
 		return
 	}
+	partial := false
+	if value := r.URL.Query().Get("partial"); len(value) > 0 {
+		var err error
+		partial, err = strconv.ParseBool(value)
+		if err != nil {
+			logger.Log.Warn("Invalid partial parameter", zap.String("partial", value))
+			http.Error(w, fmt.Sprintf("Invalid partial parameter [%s]", value), http.StatusBadRequest)
+			return
+		}
+	}
 	var m []models.Metrics
 	err := json.NewDecoder(r.Body).Decode(&m)
 	if err != nil {
@@ -240,20 +375,53 @@ func batchUpdate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Wrong Content-Type header [%s]", err), http.StatusBadRequest)
 		return
 	}
-	logger.Log.Info("batchUpdate", zap.Any("metrics", m))
-	err = storage.SetMetricsBatch(m)
+	logger.Log.Info("batchUpdate", zap.Any("metrics", m), zap.Bool("partial", partial))
+
+	var reply interface{}
+	status := http.StatusOK
+	if partial {
+		results := make([]batchItemResult, 0, len(m))
+		for _, item := range m {
+			result := batchItemResult{Metrics: item, Status: http.StatusOK}
+			err := models.ValidateMetrics(item)
+			if err != nil {
+				result.Status = http.StatusBadRequest
+			} else {
+				result.Metrics, err = storage.SetMetrics(r.Context(), item)
+				if err != nil {
+					result.Metrics = item
+					result.Status = storageErrorStatus(r, err, http.StatusInternalServerError)
+				}
+			}
+			if err != nil {
+				logger.Log.Warn("Failed to update metrics", zap.String("id", item.ID), zap.Error(err))
+				result.Error = err.Error()
+				status = http.StatusMultiStatus
+			}
+			results = append(results, result)
+		}
+		reply = results
+	} else {
+		results, err := storage.SetMetricsBatch(r.Context(), m)
+		if err != nil {
+			logger.Log.Warn("Failed to save Metrics to storage", zap.Error(err))
+			http.Error(w, fmt.Sprintf("Failed to save Metrics to storage [%s]", err),
+				storageErrorStatus(r, err, http.StatusBadRequest))
+			return
+		}
+		reply = results
+	}
+
+	data, err := json.Marshal(reply)
 	if err != nil {
-		logger.Log.Warn("Failed to save Metrics to storage", zap.Error(err))
-		http.Error(w, fmt.Sprintf("Failed to save Metrics to storage [%s]", err), http.StatusBadRequest)
+		logger.Log.Warn("Failed to marshal batch results", zap.Error(err))
+		http.Error(w, fmt.Sprintf("Failed to marshal batch results [%s]", err), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	data, err := json.Marshal(storage)
+	w.WriteHeader(status)
+	_, err = w.Write(data)
 	if err != nil {
-		logger.Log.Warn("failed to get metrics", zap.Error(err))
-		http.Error(w, fmt.Sprintf("Failed to get Metrics [%s]", err), http.StatusBadRequest)
-		return
+		logger.Log.Warn("Failed to write reply", zap.Error(err))
 	}
-	w.Write(data)
 }
@@ -0,0 +1,155 @@
+package httprouter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/models"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultQueryRange = time.Hour
+	maxQueryPoints    = 11000
+)
+
+// parseQueryTime accepts unix time in seconds (fractional part is allowed) or RFC3339 time
+func parseQueryTime(value string, defaultValue time.Time) (time.Time, error) {
+	if len(value) == 0 {
+		return defaultValue, nil
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err == nil {
+		return time.UnixMilli(int64(seconds * 1000)), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time [%s], unix seconds or RFC3339 expected", value)
+	}
+	return t, nil
+}
+
+// parseQueryStep accepts duration (e.g. 15s) or number of seconds
+func parseQueryStep(value string) (time.Duration, error) {
+	if len(value) == 0 {
+		return 0, nil
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	step, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid step [%s], duration or seconds expected", value)
+	}
+	return step, nil
+}
+
+// parseQueryLabels parses labels in name1=value1,name2=value2 form
+func parseQueryLabels(value string) (map[string]string, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		name, labelValue, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid label [%s], name=value expected", pair)
+		}
+		labels[name] = labelValue
+	}
+	return labels, models.ValidateLabels(labels)
+}
+
+// downsample returns a point for every step from the beginning of the range,
+// the value of such point is the last value within the preceding step
+func downsample(points []models.Point, from time.Time, to time.Time, step time.Duration) []models.Point {
+	result := make([]models.Point, 0)
+	i := 0
+	for t := from; !t.After(to); t = t.Add(step) {
+		ts := t.UnixMilli()
+		var last *models.Point
+		for ; i < len(points) && points[i].Timestamp <= ts; i++ {
+			last = &points[i]
+		}
+		if last != nil && last.Timestamp > t.Add(-step).UnixMilli() {
+			result = append(result, models.Point{Timestamp: ts, Value: last.Value})
+		}
+	}
+	return result
+}
+
+type rangeQuery struct {
+	metrics models.Metrics
+	from    time.Time
+	to      time.Time
+	step    time.Duration
+}
+
+func parseRangeQuery(r *http.Request) (rangeQuery, error) {
+	query := r.URL.Query()
+	q := rangeQuery{metrics: models.Metrics{ID: query.Get("id"), MType: query.Get("type")}}
+	err := models.ValidateMetricsID(q.metrics.ID)
+	if err != nil {
+		return q, err
+	}
+	q.metrics.Labels, err = parseQueryLabels(query.Get("labels"))
+	if err != nil {
+		return q, err
+	}
+	q.to, err = parseQueryTime(query.Get("to"), time.Now())
+	if err != nil {
+		return q, err
+	}
+	q.from, err = parseQueryTime(query.Get("from"), q.to.Add(-defaultQueryRange))
+	if err != nil {
+		return q, err
+	}
+	q.step, err = parseQueryStep(query.Get("step"))
+	if err != nil {
+		return q, err
+	}
+	if q.step < 0 || q.from.After(q.to) {
+		return q, errors.New("invalid range")
+	}
+	if q.step > 0 && q.to.Sub(q.from)/q.step >= maxQueryPoints {
+		return q, fmt.Errorf("too many points requested, max is %d", maxQueryPoints)
+	}
+	return q, nil
+}
+
+func queryRange(w http.ResponseWriter, r *http.Request) {
+	q, err := parseRangeQuery(r)
+	if err != nil {
+		logger.Log.Warn("invalid range query", zap.Error(err))
+		http.Error(w, fmt.Sprintf("invalid range query [%s]", err), http.StatusBadRequest)
+		return
+	}
+	points, err := storage.GetHistory(r.Context(), q.metrics, q.from, q.to)
+	if err != nil {
+		logger.Log.Warn("failed to get history", zap.Error(err))
+		http.Error(w, fmt.Sprintf("failed to get history [%s]", err),
+			storageErrorStatus(r, err, http.StatusBadRequest))
+		return
+	}
+	if q.step > 0 {
+		points = downsample(points, q.from, q.to, q.step)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(models.History{
+		ID:     q.metrics.ID,
+		MType:  q.metrics.MType,
+		Labels: q.metrics.Labels,
+		Points: points,
+	})
+	if err != nil {
+		logger.Log.Warn("Failed to write history JSON to body", zap.Error(err))
+	}
+}
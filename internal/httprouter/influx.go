@@ -0,0 +1,293 @@
+package httprouter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/models"
+	"go.uber.org/zap"
+)
+
+const maxInfluxLineLength = 1024 * 1024
+
+// influxMaxTimestampSkew limits the distance of line timestamps from the current time. Points are stored
+// at the time of request, so lines which would be misplaced by more than that (e.g. backfill) are rejected.
+const influxMaxTimestampSkew = 5 * time.Minute
+
+// influxPrecisions are units of timestamps by the precision query parameter
+var influxPrecisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"ns": time.Nanosecond,
+	"n":  time.Nanosecond,
+	"us": time.Microsecond,
+	"u":  time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// influxCounterPattern selects fields stored as counters by metrics id, if it's nil all fields are gauges
+var influxCounterPattern *regexp.Regexp
+
+type influxField struct {
+	key   string
+	value string
+}
+
+type influxPoint struct {
+	measurement string
+	tags        map[string]string
+	fields      []influxField
+	timestamp   *int64 // in units of the request precision
+}
+
+// influxLineError is a rejected line in the reply of /write
+type influxLineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type influxWriteError struct {
+	Error string            `json:"error"`
+	Lines []influxLineError `json:"lines"`
+}
+
+// splitUnescaped splits s by sep which isn't escaped with backslash or, if quotes is set, inside double quotes
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	var res []string
+	start := 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			res = append(res, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(res, s[start:])
+}
+
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`, ="\`, s[i+1]) != -1 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// parseInfluxLine parses measurement[,tag=value...] field=value[,field=value...] [timestamp].
+// Timestamp is returned as is, its unit depends on the request precision.
+func parseInfluxLine(line string) (influxPoint, error) {
+	var res influxPoint
+	var sections []string
+	for _, section := range splitUnescaped(line, ' ', true) {
+		if len(section) > 0 {
+			sections = append(sections, section)
+		}
+	}
+	if len(sections) < 2 || len(sections) > 3 {
+		return res, errors.New("measurement, fields and optional timestamp are expected")
+	}
+	if len(sections) == 3 {
+		timestamp, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return res, fmt.Errorf("invalid timestamp [%s]", sections[2])
+		}
+		res.timestamp = &timestamp
+	}
+
+	series := splitUnescaped(sections[0], ',', false)
+	res.measurement = unescapeInflux(series[0])
+	if len(res.measurement) == 0 {
+		return res, errors.New("empty measurement")
+	}
+	for _, tag := range series[1:] {
+		kv := splitUnescaped(tag, '=', false)
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			return res, fmt.Errorf("invalid tag [%s]", tag)
+		}
+		if res.tags == nil {
+			res.tags = make(map[string]string)
+		}
+		res.tags[unescapeInflux(kv[0])] = unescapeInflux(kv[1])
+	}
+
+	for _, field := range splitUnescaped(sections[1], ',', true) {
+		kv := splitUnescaped(field, '=', true)
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			return res, fmt.Errorf("invalid field [%s]", field)
+		}
+		res.fields = append(res.fields, influxField{key: unescapeInflux(kv[0]), value: kv[1]})
+	}
+	return res, nil
+}
+
+// checkInfluxTimestamp rejects the point if its timestamp is farther than influxMaxTimestampSkew from now
+func checkInfluxTimestamp(p influxPoint, unit time.Duration, now time.Time) error {
+	if p.timestamp == nil {
+		return nil
+	}
+	// timestamps which overflow nanoseconds are far from now anyway
+	if *p.timestamp > math.MaxInt64/int64(unit) || *p.timestamp < math.MinInt64/int64(unit) {
+		return fmt.Errorf("timestamp [%d] is out of range", *p.timestamp)
+	}
+	skew := now.Sub(time.Unix(0, *p.timestamp*int64(unit)))
+	if skew > influxMaxTimestampSkew || skew < -influxMaxTimestampSkew {
+		return fmt.Errorf("timestamp [%d] is more than %s away from the current time, "+
+			"points are stored at the time of request", *p.timestamp, influxMaxTimestampSkew)
+	}
+	return nil
+}
+
+// influxMetrics converts a field to metrics. Fields are gauges, since Telegraf reports absolute or cumulative
+// values even in integer fields, except ones selected by influxCounterPattern which are counter deltas.
+// Booleans are 0 and 1, string fields are skipped.
+func influxMetrics(p influxPoint, f influxField) (*models.Metrics, error) {
+	if strings.HasPrefix(f.value, `"`) {
+		return nil, nil
+	}
+	id, err := models.SanitizeMetricsID(p.measurement + "_" + f.key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid field [%s]: %w", f.key, err)
+	}
+	m := models.Metrics{ID: id, Labels: models.SanitizeLabels(p.tags)}
+
+	var value float64
+	switch raw := f.value; {
+	case strings.HasSuffix(raw, "i"):
+		val, err := strconv.ParseInt(strings.TrimSuffix(raw, "i"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer value [%s] of field [%s]", raw, f.key)
+		}
+		value = float64(val)
+	case strings.HasSuffix(raw, "u"):
+		val, err := strconv.ParseUint(strings.TrimSuffix(raw, "u"), 10, 64)
+		if err != nil || val > math.MaxInt64 {
+			return nil, fmt.Errorf("invalid unsigned value [%s] of field [%s]", raw, f.key)
+		}
+		value = float64(val)
+	default:
+		switch raw {
+		case "t", "T", "true", "True", "TRUE":
+			value = 1
+		case "f", "F", "false", "False", "FALSE":
+			value = 0
+		default:
+			val, err := strconv.ParseFloat(raw, 64)
+			if err != nil || math.IsNaN(val) || math.IsInf(val, 0) {
+				return nil, fmt.Errorf("invalid value [%s] of field [%s]", raw, f.key)
+			}
+			value = val
+		}
+	}
+
+	if influxCounterPattern == nil || !influxCounterPattern.MatchString(id) {
+		m.MType = "gauge"
+		m.Value = &value
+		return &m, nil
+	}
+	if value != math.Trunc(value) || math.Abs(value) >= math.MaxInt64 {
+		return nil, fmt.Errorf("counter value [%s] of field [%s] isn't integer", f.value, f.key)
+	}
+	delta := int64(value)
+	m.MType = "counter"
+	m.Delta = &delta
+	return &m, nil
+}
+
+// influxWrite accepts InfluxDB line protocol. Counter values are added to the stored ones like in /update.
+// Valid lines are stored in one batch, rejected lines are listed in the reply with status 400 (partial write).
+// Points are stored at the time of request, the precision query parameter sets the unit of line timestamps.
+func influxWrite(w http.ResponseWriter, r *http.Request) {
+	precision := r.URL.Query().Get("precision")
+	unit, ok := influxPrecisions[precision]
+	if !ok {
+		logger.Log.Warn("Invalid precision", zap.String("precision", precision))
+		http.Error(w, fmt.Sprintf("invalid precision [%s]", precision), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	var batch []models.Metrics
+	var rejected []influxLineError
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(nil, maxInfluxLineLength)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		point, err := parseInfluxLine(line)
+		if err == nil {
+			err = checkInfluxTimestamp(point, unit, now)
+		}
+		var metrics []models.Metrics
+		for i := 0; err == nil && i < len(point.fields); i++ {
+			var m *models.Metrics
+			m, err = influxMetrics(point, point.fields[i])
+			if m != nil {
+				metrics = append(metrics, *m)
+			}
+		}
+		if err != nil {
+			rejected = append(rejected, influxLineError{Line: n, Error: err.Error()})
+			continue
+		}
+		batch = append(batch, metrics...)
+	}
+	err := scanner.Err()
+	if err != nil {
+		logger.Log.Warn("Failed to read line protocol", zap.Error(err))
+		http.Error(w, fmt.Sprintf("failed to read line protocol [%s]", err), http.StatusBadRequest)
+		return
+	}
+
+	if len(batch) > 0 {
+		_, err = storage.SetMetricsBatch(r.Context(), batch)
+		if err != nil {
+			logger.Log.Warn("Failed to save Metrics to storage", zap.Error(err))
+			http.Error(w, fmt.Sprintf("Failed to save Metrics to storage [%s]", err),
+				storageErrorStatus(r, err, http.StatusInternalServerError))
+			return
+		}
+	}
+	if len(rejected) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	logger.Log.Warn("Line protocol lines are rejected", zap.Int("rejected", len(rejected)), zap.Int("lines", n))
+	data, err := json.Marshal(influxWriteError{
+		Error: fmt.Sprintf("partial write: %d of %d lines are rejected", len(rejected), n),
+		Lines: rejected,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to marshal reply [%s]", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_, err = w.Write(data)
+	if err != nil {
+		logger.Log.Warn("Failed to write reply", zap.Error(err))
+	}
+}
@@ -0,0 +1,115 @@
+package httprouter
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/models"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 10000
+)
+
+// metricsPage is the reply of /api/v1/metrics, Next is the cursor of the next page (empty on the last page)
+type metricsPage struct {
+	Metrics []models.Metrics `json:"metrics"`
+	Next    string           `json:"next,omitempty"`
+}
+
+// parseMetricsFilter reads type, prefix and regex query parameters
+func parseMetricsFilter(r *http.Request) (models.MetricsFilter, error) {
+	query := r.URL.Query()
+	filter := models.MetricsFilter{
+		MType:  query.Get("type"),
+		Prefix: query.Get("prefix"),
+	}
+	if filter.MType != "" && filter.MType != "gauge" && filter.MType != "counter" {
+		return filter, fmt.Errorf("unknown metrics type [%s]", filter.MType)
+	}
+	if value := query.Get("regex"); len(value) > 0 {
+		pattern, err := regexp.Compile(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid regex [%s]: %w", value, err)
+		}
+		filter.Pattern = pattern
+	}
+	return filter, nil
+}
+
+// parseListFilter reads limit and cursor query parameters in addition to ones of parseMetricsFilter
+func parseListFilter(r *http.Request) (models.MetricsFilter, error) {
+	filter, err := parseMetricsFilter(r)
+	if err != nil {
+		return filter, err
+	}
+	filter.Limit = defaultListLimit
+	query := r.URL.Query()
+	if value := query.Get("limit"); len(value) > 0 {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return filter, fmt.Errorf("limit should be from 1 to %d, got [%s]", maxListLimit, value)
+		}
+		filter.Limit = limit
+	}
+	if value := query.Get("cursor"); len(value) > 0 {
+		after, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid cursor [%s]", value)
+		}
+		filter.After = string(after)
+	}
+	return filter, nil
+}
+
+// listMetrics returns series selected by query parameters as JSON: type (gauge or counter), prefix
+// and regex of metrics id, limit (1000 by default) and cursor returned as next by the previous page.
+func listMetrics(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseListFilter(r)
+	if err != nil {
+		logger.Log.Warn("Invalid metrics list query", zap.Error(err))
+		http.Error(w, fmt.Sprintf("Invalid metrics list query [%s]", err), http.StatusBadRequest)
+		return
+	}
+	limit := filter.Limit
+	// one more series tells there is the next page
+	filter.Limit++
+	page := metricsPage{Metrics: make([]models.Metrics, 0)}
+	more := false
+	err = storage.ListMetrics(r.Context(), filter, func(m models.Metrics) error {
+		if len(page.Metrics) == limit {
+			more = true
+			return nil
+		}
+		page.Metrics = append(page.Metrics, m)
+		return nil
+	})
+	if err != nil {
+		logger.Log.Warn("failed to list metrics", zap.Error(err))
+		http.Error(w, fmt.Sprintf("failed to list metrics [%s]", err),
+			storageErrorStatus(r, err, http.StatusInternalServerError))
+		return
+	}
+	if more {
+		page.Next = base64.RawURLEncoding.EncodeToString([]byte(page.Metrics[limit-1].Cursor()))
+	}
+	data, err := json.Marshal(page)
+	if err != nil {
+		logger.Log.Warn("Failed to marshal metrics", zap.Error(err))
+		http.Error(w, fmt.Sprintf("Failed to marshal metrics [%s]", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(data)
+	if err != nil {
+		logger.Log.Warn("Failed to write reply", zap.Error(err))
+	}
+}
@@ -1,12 +1,18 @@
 package httprouter
 
 import (
+	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/rsa"
+	"fmt"
 	"io"
 	"net/http"
 	"time"
 
+	"github.com/sgladkov/harvester/internal/encryption"
 	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/utils"
 	"go.uber.org/zap"
 )
 
@@ -19,6 +25,19 @@ func (w gzipWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+// Flush sends compressed data written so far, it's used by streaming handlers
+func (w gzipWriter) Flush() {
+	if f, ok := w.Writer.(interface{ Flush() error }); ok {
+		err := f.Flush()
+		if err != nil {
+			logger.Log.Warn("Failed to flush gzip writer", zap.Error(err))
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func GzipHandle(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		writerToUse := w
@@ -61,11 +80,58 @@ func GzipHandle(h http.Handler) http.Handler {
 	})
 }
 
+// DecryptHandle decrypts the request body encrypted with the public pair of key.
+// Requests with not encrypted body are rejected if key is set. It should be used before GzipHandle.
+func DecryptHandle(key *rsa.PrivateKey) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scheme := r.Header.Get(encryption.Header)
+			if len(scheme) == 0 {
+				if key != nil && r.ContentLength != 0 {
+					logger.Log.Warn("Request body isn't encrypted")
+					http.Error(w, "Request body isn't encrypted", http.StatusBadRequest)
+					return
+				}
+				h.ServeHTTP(w, r)
+				return
+			}
+			if scheme != encryption.Scheme {
+				logger.Log.Warn("Unsupported encryption scheme", zap.String("scheme", scheme))
+				http.Error(w, fmt.Sprintf("Unsupported encryption scheme [%s]", scheme), http.StatusBadRequest)
+				return
+			}
+			if key == nil {
+				logger.Log.Warn("Failed to decrypt request body, private key isn't set")
+				http.Error(w, "Encrypted requests aren't supported", http.StatusBadRequest)
+				return
+			}
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				logger.Log.Warn("Failed to read request body", zap.Error(err))
+				http.Error(w, fmt.Sprintf("Failed to read request body [%s]", err), http.StatusBadRequest)
+				return
+			}
+			decrypted, err := encryption.Decrypt(key, body)
+			if err != nil {
+				logger.Log.Warn("Failed to decrypt request body", zap.Error(err))
+				http.Error(w, fmt.Sprintf("Failed to decrypt request body [%s]", err), http.StatusBadRequest)
+				return
+			}
+			r.Header.Del(encryption.Header)
+			r.Body = io.NopCloser(bytes.NewReader(decrypted))
+			r.ContentLength = int64(len(decrypted))
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
 type (
 	responseData struct {
 		status int
 		size   int
 		body   []byte
+		// streamed responses are flushed while they are written, their body isn't kept since streams are endless
+		streamed bool
 	}
 
 	loggingResponseWriter struct {
@@ -77,7 +143,9 @@ type (
 func (r *loggingResponseWriter) Write(b []byte) (int, error) {
 	size, err := r.ResponseWriter.Write(b)
 	r.responseData.size += size
-	r.responseData.body = append(r.responseData.body, b...)
+	if !r.responseData.streamed {
+		r.responseData.body = append(r.responseData.body, b...)
+	}
 	return size, err
 }
 
@@ -86,6 +154,14 @@ func (r *loggingResponseWriter) WriteHeader(statusCode int) {
 	r.responseData.status = statusCode
 }
 
+func (r *loggingResponseWriter) Flush() {
+	r.responseData.streamed = true
+	r.responseData.body = nil
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func RequestLogger(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -107,3 +183,71 @@ func RequestLogger(h http.Handler) http.Handler {
 		)
 	})
 }
+
+// StorageTimeout limits the time of storage operations of the request, 0 means no limit
+func StorageTimeout(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		if timeout <= 0 {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+type hashWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *hashWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *hashWriter) WriteHeader(statusCode int) {
+	w.status = statusCode
+}
+
+// HashHandle checks HMAC-SHA256 signature of the request body and signs the reply body with key.
+// Requests without signature are rejected unless they are GET or HEAD, which don't change metrics. It should be used after GzipHandle,
+// so both signatures are calculated for the uncompressed data.
+func HashHandle(key string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		if len(key) == 0 {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				logger.Log.Warn("Failed to read request body", zap.Error(err))
+				http.Error(w, fmt.Sprintf("Failed to read request body [%s]", err), http.StatusBadRequest)
+				return
+			}
+			hash := r.Header.Get(utils.HashHeader)
+			if len(hash) == 0 && r.Method != http.MethodGet && r.Method != http.MethodHead {
+				logger.Log.Warn("Request signature is missing")
+				http.Error(w, "Request signature is missing", http.StatusBadRequest)
+				return
+			}
+			if len(hash) > 0 && !utils.CheckHash(body, key, hash) {
+				logger.Log.Warn("Request signature mismatch", zap.String("hash", hash))
+				http.Error(w, "Request signature mismatch", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			hw := &hashWriter{ResponseWriter: w, status: http.StatusOK}
+			h.ServeHTTP(hw, r)
+			w.Header().Set(utils.HashHeader, utils.CalculateHash(hw.body.Bytes(), key))
+			w.WriteHeader(hw.status)
+			_, err = w.Write(hw.body.Bytes())
+			if err != nil {
+				logger.Log.Warn("failed to write response body", zap.Error(err))
+			}
+		})
+	}
+}
@@ -0,0 +1,474 @@
+package httprouter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/models"
+	"go.uber.org/zap"
+)
+
+// aggregation temporality of OTLP sums
+const (
+	otlpTemporalityUnspecified = 0
+	otlpTemporalityDelta       = 1
+	otlpTemporalityCumulative  = 2
+)
+
+// otlpNoRecordedValue is the data point flag of points without value
+const otlpNoRecordedValue = 1
+
+// otlpStaleAfter is the period cumulative sums which aren't reported are forgotten after
+const otlpStaleAfter = time.Hour
+
+// otlpCumulative keeps the last values of cumulative sums by series key to convert them to counter deltas.
+// The lock is held only to calculate deltas and to update the state, not while metrics are stored.
+type otlpCumulative struct {
+	series    map[string]otlpCumulativePoint
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+type otlpCumulativePoint struct {
+	start uint64 // start time of the series in nanoseconds, 0 if unknown
+	value float64
+	seen  time.Time
+}
+
+// otlpPrevious is the state of the series before the request, to restore it if the request fails
+type otlpPrevious struct {
+	point  otlpCumulativePoint
+	exists bool
+}
+
+var otlpSums = newOTLPCumulative()
+
+func newOTLPCumulative() *otlpCumulative {
+	return &otlpCumulative{series: make(map[string]otlpCumulativePoint)}
+}
+
+// commit stores the new points and returns the previous ones, it should be called under lock.
+// Series which aren't reported for otlpStaleAfter are dropped.
+func (c *otlpCumulative) commit(updates map[string]otlpCumulativePoint, now time.Time) map[string]otlpPrevious {
+	previous := make(map[string]otlpPrevious, len(updates))
+	for key, point := range updates {
+		prev, exists := c.series[key]
+		previous[key] = otlpPrevious{point: prev, exists: exists}
+		point.seen = now
+		updates[key] = point
+		c.series[key] = point
+	}
+	if now.Sub(c.lastSweep) >= otlpStaleAfter {
+		for key, point := range c.series {
+			if now.Sub(point.seen) >= otlpStaleAfter {
+				delete(c.series, key)
+			}
+		}
+		c.lastSweep = now
+	}
+	return previous
+}
+
+// rollback restores series updated by commit if they aren't updated by another request since then
+func (c *otlpCumulative) rollback(updates map[string]otlpCumulativePoint, previous map[string]otlpPrevious) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, point := range updates {
+		if cur, exists := c.series[key]; !exists || cur != point {
+			continue
+		}
+		if prev := previous[key]; prev.exists {
+			c.series[key] = prev.point
+		} else {
+			delete(c.series, key)
+		}
+	}
+}
+
+// ForgetSeries drops the state of series removed apart from the router (e.g. expired ones),
+// so their next values start new series
+func ForgetSeries(deleted []models.Metrics) {
+	otlpSums.forget(deleted)
+}
+
+// forget drops the state of deleted counters, so their next values start new series
+func (c *otlpCumulative) forget(deleted []models.Metrics) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, m := range deleted {
+		if m.MType == "counter" {
+			delete(c.series, m.SeriesKey())
+		}
+	}
+}
+
+// otlpInt64 is int64 encoded as a string or a number by the protobuf JSON mapping
+type otlpInt64 int64
+
+func (v *otlpInt64) UnmarshalJSON(data []byte) error {
+	val, err := strconv.ParseInt(string(bytes.Trim(data, `"`)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer [%s]", data)
+	}
+	*v = otlpInt64(val)
+	return nil
+}
+
+// otlpUint64 is uint64 encoded as a string or a number by the protobuf JSON mapping
+type otlpUint64 uint64
+
+func (v *otlpUint64) UnmarshalJSON(data []byte) error {
+	val, err := strconv.ParseUint(string(bytes.Trim(data, `"`)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid unsigned integer [%s]", data)
+	}
+	*v = otlpUint64(val)
+	return nil
+}
+
+// otlpDouble is a number or one of "NaN", "Infinity" and "-Infinity" strings
+type otlpDouble float64
+
+func (v *otlpDouble) UnmarshalJSON(data []byte) error {
+	val, err := strconv.ParseFloat(string(bytes.Trim(data, `"`)), 64)
+	if err != nil {
+		return fmt.Errorf("invalid double [%s]", data)
+	}
+	*v = otlpDouble(val)
+	return nil
+}
+
+// otlpTemporality is the enum encoded as a number or its name
+type otlpTemporality int
+
+func (v *otlpTemporality) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case `"AGGREGATION_TEMPORALITY_UNSPECIFIED"`:
+		*v = otlpTemporalityUnspecified
+	case `"AGGREGATION_TEMPORALITY_DELTA"`:
+		*v = otlpTemporalityDelta
+	case `"AGGREGATION_TEMPORALITY_CUMULATIVE"`:
+		*v = otlpTemporalityCumulative
+	default:
+		val, err := strconv.Atoi(string(data))
+		if err != nil {
+			return fmt.Errorf("invalid aggregation temporality [%s]", data)
+		}
+		*v = otlpTemporality(val)
+	}
+	return nil
+}
+
+type otlpAnyValue struct {
+	StringValue *string     `json:"stringValue"`
+	BoolValue   *bool       `json:"boolValue"`
+	IntValue    *otlpInt64  `json:"intValue"`
+	DoubleValue *otlpDouble `json:"doubleValue"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano otlpUint64     `json:"startTimeUnixNano"`
+	AsDouble          *otlpDouble    `json:"asDouble"`
+	AsInt             *otlpInt64     `json:"asInt"`
+	Flags             uint32         `json:"flags"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality otlpTemporality       `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+// otlpUnsupported is a histogram or a summary, its data points are only counted to report them rejected
+type otlpUnsupported struct {
+	DataPoints []json.RawMessage `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name                 string           `json:"name"`
+	Gauge                *otlpGauge       `json:"gauge"`
+	Sum                  *otlpSum         `json:"sum"`
+	Histogram            *otlpUnsupported `json:"histogram"`
+	ExponentialHistogram *otlpUnsupported `json:"exponentialHistogram"`
+	Summary              *otlpUnsupported `json:"summary"`
+}
+
+type otlpScopeMetrics struct {
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpExportRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpPartialSuccess struct {
+	RejectedDataPoints int64  `json:"rejectedDataPoints,omitempty"`
+	ErrorMessage       string `json:"errorMessage,omitempty"`
+}
+
+type otlpExportResponse struct {
+	PartialSuccess *otlpPartialSuccess `json:"partialSuccess,omitempty"`
+}
+
+// otlpAttributes adds attributes with scalar values to labels, arrays, key-value lists and bytes are skipped
+func otlpAttributes(labels map[string]string, attributes []otlpKeyValue) {
+	for _, a := range attributes {
+		v := a.Value
+		switch {
+		case v.StringValue != nil:
+			labels[a.Key] = *v.StringValue
+		case v.BoolValue != nil:
+			labels[a.Key] = strconv.FormatBool(*v.BoolValue)
+		case v.IntValue != nil:
+			labels[a.Key] = strconv.FormatInt(int64(*v.IntValue), 10)
+		case v.DoubleValue != nil:
+			labels[a.Key] = strconv.FormatFloat(float64(*v.DoubleValue), 'g', -1, 64)
+		}
+	}
+}
+
+func (p otlpNumberDataPoint) value() (float64, error) {
+	switch {
+	case p.AsInt != nil:
+		return float64(*p.AsInt), nil
+	case p.AsDouble != nil:
+		value := float64(*p.AsDouble)
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return 0, fmt.Errorf("invalid value [%g]", value)
+		}
+		return value, nil
+	default:
+		return 0, errors.New("data point has no value")
+	}
+}
+
+// otlpBatch collects metrics of the request and the new state of cumulative sums,
+// the state is rolled back if the metrics aren't stored
+type otlpBatch struct {
+	sums       *otlpCumulative
+	metrics    []models.Metrics
+	increments []models.Metrics // gauges changed by values of up-down delta sums
+	updates    map[string]otlpCumulativePoint
+	rejected   int64
+	errors     []string
+}
+
+func (b *otlpBatch) reject(count int, err error) {
+	b.rejected += int64(count)
+	b.errors = append(b.errors, err.Error())
+}
+
+// cumulativeDelta returns the counter delta of the cumulative sum. The first value of the series isn't
+// counted since the part reported before is unknown (e.g. after server restart). The value less than
+// the previous one or the new start time mean the series was restarted, so the whole value is the delta.
+func (b *otlpBatch) cumulativeDelta(key string, point otlpCumulativePoint) (int64, bool) {
+	prev, exists := b.updates[key]
+	if !exists {
+		prev, exists = b.sums.series[key]
+	}
+	b.updates[key] = point
+	if !exists {
+		return 0, true
+	}
+	if point.value < prev.value || (point.start != 0 && point.start != prev.start) {
+		return int64(math.Floor(point.value)), false
+	}
+	return int64(math.Floor(point.value) - math.Floor(prev.value)), false
+}
+
+func (b *otlpBatch) add(id string, resource map[string]string, sum *otlpSum, point otlpNumberDataPoint) error {
+	value, err := point.value()
+	if err != nil {
+		return err
+	}
+	labels := make(map[string]string, len(resource)+len(point.Attributes))
+	for name, val := range resource {
+		labels[name] = val
+	}
+	otlpAttributes(labels, point.Attributes)
+	m := models.Metrics{ID: id, Labels: models.SanitizeLabels(labels)}
+
+	switch {
+	case sum == nil || (!sum.IsMonotonic && sum.AggregationTemporality == otlpTemporalityCumulative):
+		// gauges and up-down sums keep the current value
+		m.MType = "gauge"
+		m.Value = &value
+	case !sum.IsMonotonic && sum.AggregationTemporality == otlpTemporalityDelta:
+		// up-down sums keep the current value, so the change is added to it
+		m.MType = "gauge"
+		m.Value = &value
+		b.increments = append(b.increments, m)
+		return nil
+	case sum.AggregationTemporality == otlpTemporalityCumulative:
+		if value < 0 {
+			return fmt.Errorf("monotonic sum value [%g] is negative", value)
+		}
+		delta, first := b.cumulativeDelta(m.SeriesKey(), otlpCumulativePoint{
+			start: uint64(point.StartTimeUnixNano),
+			value: value,
+		})
+		if first {
+			logger.Log.Info("New cumulative series", zap.String("series", m.SeriesKey()))
+		}
+		m.MType = "counter"
+		m.Delta = &delta
+	case sum.AggregationTemporality == otlpTemporalityDelta:
+		if value != math.Trunc(value) || math.Abs(value) >= math.MaxInt64 {
+			return fmt.Errorf("delta sum value [%g] isn't integer", value)
+		}
+		delta := int64(value)
+		m.MType = "counter"
+		m.Delta = &delta
+	default:
+		return errors.New("sum aggregation temporality is unspecified")
+	}
+	b.metrics = append(b.metrics, m)
+	return nil
+}
+
+func (b *otlpBatch) addMetric(resource map[string]string, metric otlpMetric) {
+	var unsupported *otlpUnsupported
+	switch {
+	case metric.Histogram != nil:
+		unsupported = metric.Histogram
+	case metric.ExponentialHistogram != nil:
+		unsupported = metric.ExponentialHistogram
+	case metric.Summary != nil:
+		unsupported = metric.Summary
+	}
+	if unsupported != nil {
+		b.reject(len(unsupported.DataPoints), fmt.Errorf("metric [%s]: histograms and summaries aren't supported",
+			metric.Name))
+		return
+	}
+
+	var sum *otlpSum
+	var points []otlpNumberDataPoint
+	switch {
+	case metric.Gauge != nil:
+		points = metric.Gauge.DataPoints
+	case metric.Sum != nil:
+		sum = metric.Sum
+		points = metric.Sum.DataPoints
+	default:
+		return
+	}
+	id, err := models.SanitizeMetricsID(metric.Name)
+	if err != nil {
+		b.reject(len(points), fmt.Errorf("metric [%s]: %w", metric.Name, err))
+		return
+	}
+	for _, point := range points {
+		if point.Flags&otlpNoRecordedValue != 0 {
+			continue
+		}
+		err = b.add(id, resource, sum, point)
+		if err != nil {
+			b.reject(1, fmt.Errorf("metric [%s]: %w", metric.Name, err))
+		}
+	}
+}
+
+// otlpMetrics accepts OpenTelemetry metrics exported with OTLP/HTTP in JSON encoding. Gauges and up-down sums
+// are stored as gauges (values of delta up-down sums are added to them), monotonic sums are stored as counters,
+// cumulative ones are converted to deltas per series. Resource and data point attributes become labels.
+// Unsupported data points are reported as partial success.
+func otlpMetrics(w http.ResponseWriter, r *http.Request) {
+	if !ContainsHeaderValue(r, "Content-Type", "application/json") {
+		contentType := r.Header.Get("Content-Type")
+		logger.Log.Warn("Unsupported OTLP encoding", zap.String("Content-Type", contentType))
+		http.Error(w, fmt.Sprintf("Unsupported OTLP encoding [%s], only JSON is accepted", contentType),
+			http.StatusUnsupportedMediaType)
+		return
+	}
+	var request otlpExportRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		logger.Log.Warn("Failed to decode OTLP request", zap.Error(err))
+		http.Error(w, fmt.Sprintf("Failed to decode OTLP request [%s]", err), http.StatusBadRequest)
+		return
+	}
+
+	// deltas of cumulative sums are calculated in order of requests, but requests are stored concurrently
+	otlpSums.lock.Lock()
+	batch := otlpBatch{sums: otlpSums, updates: make(map[string]otlpCumulativePoint)}
+	for _, rm := range request.ResourceMetrics {
+		resource := make(map[string]string)
+		otlpAttributes(resource, rm.Resource.Attributes)
+		for _, sm := range rm.ScopeMetrics {
+			for _, metric := range sm.Metrics {
+				batch.addMetric(resource, metric)
+			}
+		}
+	}
+	previous := otlpSums.commit(batch.updates, time.Now())
+	otlpSums.lock.Unlock()
+
+	if len(batch.metrics) > 0 {
+		_, err = storage.SetMetricsBatch(r.Context(), batch.metrics)
+		if err != nil {
+			otlpSums.rollback(batch.updates, previous)
+			logger.Log.Warn("Failed to save Metrics to storage", zap.Error(err))
+			http.Error(w, fmt.Sprintf("Failed to save Metrics to storage [%s]", err),
+				storageErrorStatus(r, err, http.StatusInternalServerError))
+			return
+		}
+	}
+	// increments aren't idempotent, so the failed ones are rejected rather than retried by the exporter
+	for _, m := range batch.increments {
+		_, err = storage.AddGauge(r.Context(), m.SeriesKey(), *m.Value)
+		if err != nil {
+			logger.Log.Warn("Failed to save Metrics to storage", zap.Error(err))
+			batch.reject(1, fmt.Errorf("metric [%s]: %w", m.ID, err))
+		}
+	}
+
+	var response otlpExportResponse
+	if batch.rejected > 0 {
+		logger.Log.Warn("OTLP data points are rejected", zap.Int64("rejected", batch.rejected),
+			zap.Strings("errors", batch.errors))
+		response.PartialSuccess = &otlpPartialSuccess{
+			RejectedDataPoints: batch.rejected,
+			ErrorMessage:       strings.Join(batch.errors, "; "),
+		}
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to marshal reply [%s]", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(data)
+	if err != nil {
+		logger.Log.Warn("Failed to write reply", zap.Error(err))
+	}
+}
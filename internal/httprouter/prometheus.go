@@ -0,0 +1,188 @@
+package httprouter
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/models"
+	"go.uber.org/zap"
+)
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// prometheusName converts metrics id to the valid Prometheus metric name [a-zA-Z_:][a-zA-Z0-9_:]*
+func prometheusName(id string) string {
+	return sanitizePrometheusName(id, true)
+}
+
+// prometheusLabelName converts label name to the valid Prometheus label name [a-zA-Z_][a-zA-Z0-9_]*
+func prometheusLabelName(name string) string {
+	return sanitizePrometheusName(name, false)
+}
+
+func sanitizePrometheusName(name string, allowColon bool) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':' && allowColon:
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+var prometheusLabelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// prometheusLabels renders labels as {name1="value1",name2="value2"} sorted by name
+func prometheusLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	sanitized := make(map[string]string, len(labels))
+	names := make([]string, 0, len(labels))
+	for name, value := range labels {
+		name = prometheusLabelName(name)
+		if _, exists := sanitized[name]; !exists {
+			names = append(names, name)
+		}
+		sanitized[name] = value
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(prometheusLabelValueReplacer.Replace(sanitized[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func prometheusValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writePrometheus renders metrics in Prometheus text exposition format 0.0.4.
+// Families are sorted by name and samples inside a family are sorted by labels.
+// When different series are sanitized to the same family and labels,
+// the first one in the series key order wins and the rest are skipped.
+func writePrometheus(w io.Writer, metrics []models.Metrics) error {
+	sorted := make([]models.Metrics, len(metrics))
+	copy(sorted, metrics)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].ID != sorted[j].ID {
+			return sorted[i].ID < sorted[j].ID
+		}
+		if sorted[i].MType != sorted[j].MType {
+			return sorted[i].MType < sorted[j].MType
+		}
+		return sorted[i].SeriesKey() < sorted[j].SeriesKey()
+	})
+
+	type family struct {
+		mType   string
+		samples map[string]string
+	}
+	families := make(map[string]*family)
+	for _, m := range sorted {
+		var value string
+		switch m.MType {
+		case "gauge":
+			if m.Value == nil {
+				continue
+			}
+			value = prometheusValue(*m.Value)
+		case "counter":
+			if m.Delta == nil {
+				continue
+			}
+			value = strconv.FormatInt(*m.Delta, 10)
+		default:
+			continue
+		}
+		name := prometheusName(m.ID)
+		labels := prometheusLabels(m.Labels)
+		f, exists := families[name]
+		if !exists {
+			f = &family{mType: m.MType, samples: make(map[string]string)}
+			families[name] = f
+		}
+		if _, duplicated := f.samples[labels]; duplicated || f.mType != m.MType {
+			logger.Log.Warn("duplicated Prometheus series, skipped",
+				zap.String("series", m.SeriesKey()), zap.String("name", name))
+			continue
+		}
+		f.samples[labels] = value
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := families[name]
+		_, err := fmt.Fprintf(w, "# TYPE %s %s\n", name, f.mType)
+		if err != nil {
+			return err
+		}
+		labels := make([]string, 0, len(f.samples))
+		for l := range f.samples {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			_, err = fmt.Fprintf(w, "%s%s %s\n", name, l, f.samples[l])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getPrometheusMetrics returns all metrics in Prometheus text exposition format
+func getPrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics, err := storage.GetAllMetrics(r.Context())
+	if err != nil {
+		logger.Log.Warn("failed to get metrics", zap.Error(err))
+		http.Error(w, fmt.Sprintf("failed to get metrics [%s]", err),
+			storageErrorStatus(r, err, http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Content-Type", prometheusContentType)
+	w.WriteHeader(http.StatusOK)
+	err = writePrometheus(w, metrics)
+	if err != nil {
+		logger.Log.Warn("failed to write response body", zap.Error(err))
+	}
+}
@@ -1,32 +1,69 @@
 package httprouter
 
 import (
+	"crypto/rsa"
 	"database/sql"
+	"regexp"
+	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/sgladkov/harvester/internal/alerting"
+	"github.com/sgladkov/harvester/internal/hub"
 	"github.com/sgladkov/harvester/internal/interfaces"
 )
 
 var storage interfaces.Storage
 var database *sql.DB
 
-func MetricsRouter(s interfaces.Storage, db *sql.DB) chi.Router {
+// RouterConfig keeps optional settings of MetricsRouter
+type RouterConfig struct {
+	StorageTimeout time.Duration   // limit of storage operations time per request, 0 means no limit
+	Key            string          // key to check requests and sign replies with HMAC-SHA256, empty disables signing
+	PrivateKey     *rsa.PrivateKey // key to decrypt requests, nil disables encryption
+	// InfluxCounterPattern selects line protocol fields stored as counter deltas by metrics id,
+	// nil means all fields are gauges
+	InfluxCounterPattern *regexp.Regexp
+	Hub                  *hub.Hub         // hub of updates streamed by /api/v1/stream, nil disables streaming
+	Alerts               *alerting.Engine // engine of alerts reported by /api/v1/alerts, nil disables alerting
+}
+
+func MetricsRouter(s interfaces.Storage, db *sql.DB, config RouterConfig) chi.Router {
 	database = db
 	storage = s
+	influxCounterPattern = config.InfluxCounterPattern
+	otlpSums = newOTLPCumulative()
+	eventHub = config.Hub
+	alertEngine = config.Alerts
 	r := chi.NewRouter()
 	r.Middlewares()
 	r.Use(RequestLogger)
+	r.Use(DecryptHandle(config.PrivateKey))
 	r.Use(GzipHandle)
-	r.Get("/", getAllMetrics)
-	r.Get("/ping", ping)
-	r.Post("/updates/", batchUpdate)
-	r.Route("/update/", func(r chi.Router) {
-		r.Post("/", updateMetricJSON)
-		r.Post("/{type}/{name}/{value}", updateMetric)
-	})
-	r.Route("/value/", func(r chi.Router) {
-		r.Post("/", getMetricJSON)
-		r.Get("/{type}/{name}", getMetric)
+	// the stream is endless, so its reply can't be signed and it isn't limited by the storage timeout
+	r.Get("/api/v1/stream", streamMetrics)
+	r.Group(func(r chi.Router) {
+		r.Use(HashHandle(config.Key))
+		r.Use(StorageTimeout(config.StorageTimeout))
+		r.Get("/", getAllMetrics)
+		r.Get("/ping", ping)
+		r.Get("/metrics", getPrometheusMetrics)
+		r.Get("/api/v1/query_range", queryRange)
+		r.Get("/api/v1/metrics", listMetrics)
+		r.Get("/api/v1/alerts", getAlerts)
+		r.Post("/updates/", batchUpdate)
+		r.Post("/delete/", deleteMetricsJSON)
+		r.Post("/write", influxWrite)
+		r.Post("/v1/metrics", otlpMetrics)
+		r.Route("/update/", func(r chi.Router) {
+			r.Post("/", updateMetricJSON)
+			r.Post("/{type}/{name}/{value}", updateMetric)
+		})
+		r.Route("/value/", func(r chi.Router) {
+			r.Post("/", getMetricJSON)
+			r.Get("/rate/{name}", getRate)
+			r.Get("/{type}/{name}", getMetric)
+			r.Delete("/{type}/{name}", deleteMetric)
+		})
 	})
 	return r
 }
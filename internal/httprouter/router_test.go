@@ -1,16 +1,29 @@
 package httprouter
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/sgladkov/harvester/internal/alerting"
+	"github.com/sgladkov/harvester/internal/encryption"
+	"github.com/sgladkov/harvester/internal/hub"
 	"github.com/sgladkov/harvester/internal/models"
 	storage2 "github.com/sgladkov/harvester/internal/storage"
+	"github.com/sgladkov/harvester/internal/utils"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -66,7 +79,7 @@ func TestMetricsRouter(t *testing.T) {
 			},
 		},
 	}
-	ts := httptest.NewServer(MetricsRouter(storage2.NewMemStorage("", false), nil))
+	ts := httptest.NewServer(MetricsRouter(storage2.NewMemStorage("", false, 0), nil, RouterConfig{}))
 	defer ts.Close()
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -122,7 +135,7 @@ func TestCounter(t *testing.T) {
 			},
 		},
 	}
-	ts := httptest.NewServer(MetricsRouter(storage2.NewMemStorage("", false), nil))
+	ts := httptest.NewServer(MetricsRouter(storage2.NewMemStorage("", false, 0), nil, RouterConfig{}))
 	defer ts.Close()
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -182,7 +195,7 @@ func TestGauge(t *testing.T) {
 			},
 		},
 	}
-	ts := httptest.NewServer(MetricsRouter(storage2.NewMemStorage("", false), nil))
+	ts := httptest.NewServer(MetricsRouter(storage2.NewMemStorage("", false, 0), nil, RouterConfig{}))
 	defer ts.Close()
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -261,7 +274,7 @@ func TestCounterJSON(t *testing.T) {
 			},
 		},
 	}
-	ts := httptest.NewServer(MetricsRouter(storage2.NewMemStorage("", false), nil))
+	ts := httptest.NewServer(MetricsRouter(storage2.NewMemStorage("", false, 0), nil, RouterConfig{}))
 	defer ts.Close()
 	m := models.Metrics{}
 	m.MType = "counter"
@@ -349,7 +362,7 @@ func TestGougeJSON(t *testing.T) {
 			},
 		},
 	}
-	ts := httptest.NewServer(MetricsRouter(storage2.NewMemStorage("", false), nil))
+	ts := httptest.NewServer(MetricsRouter(storage2.NewMemStorage("", false, 0), nil, RouterConfig{}))
 	defer ts.Close()
 	m := models.Metrics{}
 	m.MType = "gauge"
@@ -382,3 +395,957 @@ func TestGougeJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestPrometheusMetrics(t *testing.T) {
+	s := storage2.NewMemStorage("", false, 0)
+	require.NoError(t, s.SetGauge(context.Background(), "Alloc", 1.5))
+	require.NoError(t, s.SetGauge(context.Background(), "HeapInuse", 1e21))
+	require.NoError(t, s.SetCounter(context.Background(), "PollCount", 3))
+	require.NoError(t, s.SetCounter(context.Background(), "PollCount", 2))
+	require.NoError(t, s.SetGauge(context.Background(), "9lives", 9))
+	require.NoError(t, s.SetGauge(context.Background(), "Привет", 1))
+	value := 2.5
+	_, err := s.SetMetrics(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge", Value: &value,
+		Labels: map[string]string{"instance": "1", "host": "a"}})
+	require.NoError(t, err)
+	ts := httptest.NewServer(MetricsRouter(s, nil, RouterConfig{}))
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	defer func() {
+		err := res.Body.Close()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", res.Header.Get("Content-Type"))
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "# TYPE Alloc gauge\nAlloc 1.5\nAlloc{host=\"a\",instance=\"1\"} 2.5\n"+
+		"# TYPE HeapInuse gauge\nHeapInuse 1e+21\n"+
+		"# TYPE PollCount counter\nPollCount 5\n"+
+		"# TYPE _9lives gauge\n_9lives 9\n"+
+		"# TYPE ______ gauge\n______ 1\n", string(body))
+}
+
+func TestLabelsJSON(t *testing.T) {
+	ts := httptest.NewServer(MetricsRouter(storage2.NewMemStorage("", false, 0), nil, RouterConfig{}))
+	defer ts.Close()
+	post := func(path string, body string) (int, models.Metrics) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, bytes.NewReader([]byte(body)))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		defer func() {
+			err := res.Body.Close()
+			if err != nil {
+				fmt.Println(err)
+			}
+		}()
+		var m models.Metrics
+		reply, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		if res.StatusCode == http.StatusOK && path != "/updates/" {
+			require.NoError(t, json.Unmarshal(reply, &m))
+		}
+		return res.StatusCode, m
+	}
+
+	status, _ := post("/update/", `{"id":"Alloc","type":"gauge","value":1,"labels":{"host":"a"}}`)
+	require.Equal(t, http.StatusOK, status)
+	status, _ = post("/update/", `{"id":"Alloc","type":"gauge","value":2,"labels":{"host":"b"}}`)
+	require.Equal(t, http.StatusOK, status)
+	status, _ = post("/updates/", `[{"id":"Alloc","type":"gauge","value":3,"labels":{"host":"c"}}]`)
+	require.Equal(t, http.StatusOK, status)
+	status, _ = post("/update/", `{"id":"Alloc","type":"gauge","value":2,"labels":{"host":"a,b"}}`)
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = post("/update/", `{"id":"Alloc","type":"gauge","value":2,"labels":{"":"a"}}`)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	status, m := post("/value/", `{"id":"Alloc","type":"gauge","labels":{"host":"a"}}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, 1.0, *m.Value)
+	require.Equal(t, map[string]string{"host": "a"}, m.Labels)
+	status, m = post("/value/", `{"id":"Alloc","type":"gauge","labels":{"host":"b"}}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, 2.0, *m.Value)
+	status, m = post("/value/", `{"id":"Alloc","type":"gauge","labels":{"host":"c"}}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, 3.0, *m.Value)
+	status, _ = post("/value/", `{"id":"Alloc","type":"gauge"}`)
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestQueryRange(t *testing.T) {
+	s := storage2.NewMemStorage("", false, time.Hour)
+	ts := httptest.NewServer(MetricsRouter(s, nil, RouterConfig{}))
+	defer ts.Close()
+	value := 1.5
+	_, err := s.SetMetrics(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge", Value: &value,
+		Labels: map[string]string{"host": "a"}})
+	require.NoError(t, err)
+	from := time.Now().Add(-30 * time.Second).Unix()
+	to := time.Now().Add(time.Minute).Unix()
+
+	get := func(query string) (int, models.History) {
+		res, err := ts.Client().Get(ts.URL + "/api/v1/query_range?" + query)
+		require.NoError(t, err)
+		defer func() {
+			err := res.Body.Close()
+			if err != nil {
+				fmt.Println(err)
+			}
+		}()
+		var h models.History
+		reply, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		if res.StatusCode == http.StatusOK {
+			require.NoError(t, json.Unmarshal(reply, &h))
+		}
+		return res.StatusCode, h
+	}
+
+	status, h := get("id=Alloc&type=gauge&labels=host=a")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, 1, len(h.Points))
+	require.Equal(t, 1.5, h.Points[0].Value)
+	status, h = get(fmt.Sprintf("id=Alloc&type=gauge&labels=host=a&from=%d&to=%d&step=1m", from, to))
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, 1, len(h.Points))
+	require.Equal(t, (from+60)*1000, h.Points[0].Timestamp)
+	status, h = get("id=Alloc&type=gauge")
+	require.Equal(t, http.StatusOK, status)
+	require.Empty(t, h.Points)
+	status, _ = get(fmt.Sprintf("id=Alloc&type=gauge&from=%d&to=%d", to, from))
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = get(fmt.Sprintf("id=Alloc&type=gauge&from=%d&to=%d&step=1ms", from, to))
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = get("id=Alloc&type=unknown")
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+type slowStorage struct {
+	*storage2.MemStorage
+}
+
+func (s slowStorage) GetGauge(ctx context.Context, name string) (float64, error) {
+	<-ctx.Done()
+	return 0.0, ctx.Err()
+}
+
+func TestStorageTimeout(t *testing.T) {
+	ts := httptest.NewServer(MetricsRouter(slowStorage{storage2.NewMemStorage("", false, 0)}, nil,
+		RouterConfig{StorageTimeout: 10 * time.Millisecond}))
+	defer ts.Close()
+	res, err := ts.Client().Get(ts.URL + "/value/gauge/test")
+	require.NoError(t, err)
+	defer func() {
+		err := res.Body.Close()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+	assert.Equal(t, http.StatusGatewayTimeout, res.StatusCode)
+}
+
+func TestHashHandle(t *testing.T) {
+	const key = "secret"
+	ts := httptest.NewServer(MetricsRouter(storage2.NewMemStorage("", false, 0), nil, RouterConfig{Key: key}))
+	defer ts.Close()
+	body := []byte(`[{"id":"test","type":"gauge","value":1.5}]`)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write(body)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	tests := []struct {
+		name   string
+		hash   string
+		gzip   bool
+		status int
+	}{
+		{name: "signed", hash: utils.CalculateHash(body, key), status: http.StatusOK},
+		{name: "signed compressed", hash: utils.CalculateHash(body, key), gzip: true, status: http.StatusOK},
+		{name: "wrong key", hash: utils.CalculateHash(body, "wrong"), status: http.StatusBadRequest},
+		{name: "signed compressed body", hash: utils.CalculateHash(compressed.Bytes(), key), gzip: true,
+			status: http.StatusBadRequest},
+		{name: "not signed", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reqBody := body
+			if test.gzip {
+				reqBody = compressed.Bytes()
+			}
+			req, err := http.NewRequest(http.MethodPost, ts.URL+"/updates/", bytes.NewReader(reqBody))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			if test.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			if len(test.hash) > 0 {
+				req.Header.Set(utils.HashHeader, test.hash)
+			}
+			res, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer func() {
+				err := res.Body.Close()
+				if err != nil {
+					fmt.Println(err)
+				}
+			}()
+			assert.Equal(t, test.status, res.StatusCode)
+			reply, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			if test.status == http.StatusOK {
+				assert.True(t, utils.CheckHash(reply, key, res.Header.Get(utils.HashHeader)))
+			}
+		})
+	}
+
+	res, err := ts.Client().Get(ts.URL + "/value/gauge/test")
+	require.NoError(t, err)
+	defer func() {
+		err := res.Body.Close()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	reply, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "1.5", string(reply))
+	assert.Equal(t, utils.CalculateHash(reply, key), res.Header.Get(utils.HashHeader))
+
+	// deletion changes metrics, so it should be signed too
+	remove := func(hash string) int {
+		req, err := http.NewRequest(http.MethodDelete, ts.URL+"/value/gauge/test", nil)
+		require.NoError(t, err)
+		if len(hash) > 0 {
+			req.Header.Set(utils.HashHeader, hash)
+		}
+		res, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusBadRequest, remove(""))
+	assert.Equal(t, http.StatusOK, remove(utils.CalculateHash(nil, key)))
+}
+
+func TestDecryptHandle(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ts := httptest.NewServer(MetricsRouter(storage2.NewMemStorage("", false, 0), nil, RouterConfig{PrivateKey: key}))
+	defer ts.Close()
+	body := []byte(`[{"id":"test","type":"gauge","value":1.5}]`)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err = gz.Write(body)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	encrypted, err := encryption.Encrypt(&key.PublicKey, body)
+	require.NoError(t, err)
+	encryptedCompressed, err := encryption.Encrypt(&key.PublicKey, compressed.Bytes())
+	require.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	encryptedOther, err := encryption.Encrypt(&other.PublicKey, body)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		body    []byte
+		encrypt bool
+		gzip    bool
+		status  int
+	}{
+		{name: "encrypted", body: encrypted, encrypt: true, status: http.StatusOK},
+		{name: "encrypted compressed", body: encryptedCompressed, encrypt: true, gzip: true, status: http.StatusOK},
+		{name: "other key", body: encryptedOther, encrypt: true, status: http.StatusBadRequest},
+		{name: "not encrypted", body: body, status: http.StatusBadRequest},
+		{name: "garbage", body: body, encrypt: true, status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, ts.URL+"/updates/", bytes.NewReader(test.body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			if test.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			if test.encrypt {
+				req.Header.Set(encryption.Header, encryption.Scheme)
+			}
+			res, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer func() {
+				err := res.Body.Close()
+				if err != nil {
+					fmt.Println(err)
+				}
+			}()
+			assert.Equal(t, test.status, res.StatusCode)
+			_, err = io.ReadAll(res.Body)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestInfluxWrite(t *testing.T) {
+	ctx := context.Background()
+	s := storage2.NewMemStorage("", false, 0)
+	ts := httptest.NewServer(MetricsRouter(s, nil, RouterConfig{}))
+	defer ts.Close()
+	write := func(body string, compress bool) (int, string) {
+		reqBody := []byte(body)
+		if compress {
+			var compressed bytes.Buffer
+			gz := gzip.NewWriter(&compressed)
+			_, err := gz.Write(reqBody)
+			require.NoError(t, err)
+			require.NoError(t, gz.Close())
+			reqBody = compressed.Bytes()
+		}
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/write?db=telegraf", bytes.NewReader(reqBody))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if compress {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		res, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		defer func() {
+			err := res.Body.Close()
+			if err != nil {
+				fmt.Println(err)
+			}
+		}()
+		reply, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(reply)
+	}
+
+	now := time.Now()
+	status, _ := write("# comment\n"+
+		"cpu,host=web\\ 1,cpu=cpu-total usage_idle=97.5,usage_user=1e0 "+strconv.FormatInt(now.UnixNano(), 10)+"\n"+
+		"net,host=web bytes_recv=100i,up=true,name=\"eth0\"\n"+
+		"net,host=web bytes_recv=50u\n", true)
+	require.Equal(t, http.StatusNoContent, status)
+	value, err := s.GetGauge(ctx, "cpuUsageIdle{cpu=cpu-total,host=web_1}")
+	require.NoError(t, err)
+	assert.Equal(t, 97.5, value)
+	value, err = s.GetGauge(ctx, "netUp{host=web}")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, value)
+	// integer fields are absolute values, so the last one is kept
+	value, err = s.GetGauge(ctx, "netBytesRecv{host=web}")
+	require.NoError(t, err)
+	assert.Equal(t, 50.0, value)
+	_, err = s.GetCounter(ctx, "netBytesRecv{host=web}")
+	require.Error(t, err)
+	_, err = s.GetGauge(ctx, "netName{host=web}")
+	require.Error(t, err)
+
+	// valid lines are stored, rejected ones are listed in the reply
+	status, reply := write("mem free=1i\n"+
+		"mem\n"+
+		"mem free=abc\n"+
+		"mem,host free=1\n"+
+		"mem free=1 now\n"+
+		"mem free=2 1700000000000000000\n"+
+		"mem used=2.5\n", false)
+	require.Equal(t, http.StatusBadRequest, status)
+	var writeErr influxWriteError
+	require.NoError(t, json.Unmarshal([]byte(reply), &writeErr))
+	lines := make([]int, 0, len(writeErr.Lines))
+	for _, l := range writeErr.Lines {
+		lines = append(lines, l.Line)
+	}
+	assert.Equal(t, []int{2, 3, 4, 5, 6}, lines)
+	value, err = s.GetGauge(ctx, "memFree")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, value)
+	value, err = s.GetGauge(ctx, "memUsed")
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, value)
+
+	// timestamps are in units of precision
+	res, err := ts.Client().Post(ts.URL+"/write?precision=s", "text/plain",
+		bytes.NewBufferString("mem free=3 "+strconv.FormatInt(now.Unix(), 10)+"\n"))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	value, err = s.GetGauge(ctx, "memFree")
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, value)
+	res, err = ts.Client().Post(ts.URL+"/write?precision=h", "text/plain", bytes.NewBufferString("mem free=4\n"))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestInfluxCounterPattern(t *testing.T) {
+	ctx := context.Background()
+	s := storage2.NewMemStorage("", false, 0)
+	ts := httptest.NewServer(MetricsRouter(s, nil, RouterConfig{
+		InfluxCounterPattern: regexp.MustCompile(`Total$`),
+	}))
+	defer ts.Close()
+	res, err := ts.Client().Post(ts.URL+"/write", "text/plain",
+		bytes.NewBufferString("http requests_total=5,inflight=3i\nhttp requests_total=1.5\n"))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	delta, err := s.GetCounter(ctx, "httpRequestsTotal")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), delta)
+	value, err := s.GetGauge(ctx, "httpInflight")
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, value)
+}
+
+func TestOTLPMetrics(t *testing.T) {
+	ctx := context.Background()
+	s := storage2.NewMemStorage("", false, 0)
+	ts := httptest.NewServer(MetricsRouter(s, nil, RouterConfig{}))
+	defer ts.Close()
+	export := func(body string, contentType string) (int, string) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/metrics", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", contentType)
+		res, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		defer func() {
+			err := res.Body.Close()
+			if err != nil {
+				fmt.Println(err)
+			}
+		}()
+		reply, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(reply)
+	}
+	request := func(requests int64, start string, extra string) string {
+		return fmt.Sprintf(`{"resourceMetrics":[{
+			"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]},
+			"scopeMetrics":[{"scope":{"name":"app"},"metrics":[
+				{"name":"http.server.requests","sum":{"aggregationTemporality":2,"isMonotonic":true,"dataPoints":[
+					{"attributes":[{"key":"code","value":{"intValue":"200"}}],"startTimeUnixNano":"%s","asInt":"%d"}]}},
+				{"name":"queue.size","gauge":{"dataPoints":[{"asDouble":7.5}]}}%s
+			]}]}]}`, start, requests, extra)
+	}
+	series := "httpServerRequests{code=200,service_name=checkout}"
+
+	// the first cumulative value only starts the series
+	status, reply := export(request(10, "1000", ""), "application/json")
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{}`, reply)
+	delta, err := s.GetCounter(ctx, series)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), delta)
+	value, err := s.GetGauge(ctx, "queueSize{service_name=checkout}")
+	require.NoError(t, err)
+	assert.Equal(t, 7.5, value)
+
+	status, _ = export(request(25, "1000", ""), "application/json")
+	require.Equal(t, http.StatusOK, status)
+	delta, err = s.GetCounter(ctx, series)
+	require.NoError(t, err)
+	assert.Equal(t, int64(15), delta)
+
+	// the restarted series counts from zero
+	status, _ = export(request(4, "2000", ""), "application/json")
+	require.Equal(t, http.StatusOK, status)
+	delta, err = s.GetCounter(ctx, series)
+	require.NoError(t, err)
+	assert.Equal(t, int64(19), delta)
+
+	// delta sums are added as they are, unsupported points are rejected partially
+	status, reply = export(request(6, "2000", `,
+		{"name":"jobs","sum":{"aggregationTemporality":"AGGREGATION_TEMPORALITY_DELTA","isMonotonic":true,
+			"dataPoints":[{"asInt":3},{"asDouble":"NaN"}]}},
+		{"name":"latency","histogram":{"dataPoints":[{"count":"1"},{"count":"2"}]}},
+		{"name":"up.down","sum":{"aggregationTemporality":2,"dataPoints":[{"asInt":"-2"}]}},
+		{"name":"in.flight","sum":{"aggregationTemporality":1,"dataPoints":[{"asInt":"3"},{"asDouble":-1.5}]}}`),
+		"application/json")
+	require.Equal(t, http.StatusOK, status)
+	var response otlpExportResponse
+	require.NoError(t, json.Unmarshal([]byte(reply), &response))
+	require.NotNil(t, response.PartialSuccess)
+	assert.Equal(t, int64(3), response.PartialSuccess.RejectedDataPoints)
+	delta, err = s.GetCounter(ctx, series)
+	require.NoError(t, err)
+	assert.Equal(t, int64(21), delta)
+	delta, err = s.GetCounter(ctx, "jobs{service_name=checkout}")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), delta)
+	value, err = s.GetGauge(ctx, "upDown{service_name=checkout}")
+	require.NoError(t, err)
+	assert.Equal(t, -2.0, value)
+	// changes of up-down delta sums are added to gauges
+	value, err = s.GetGauge(ctx, "inFlight{service_name=checkout}")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, value)
+
+	// the deleted series starts again
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/delete/", strings.NewReader(
+		`[{"id":"httpServerRequests","type":"counter","labels":{"code":"200","service_name":"checkout"}}]`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	status, _ = export(request(30, "2000", ""), "application/json")
+	require.Equal(t, http.StatusOK, status)
+	delta, err = s.GetCounter(ctx, series)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), delta)
+
+	// so does the expired one
+	expired, err := s.Expire(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	ForgetSeries(expired)
+	status, _ = export(request(45, "2000", ""), "application/json")
+	require.Equal(t, http.StatusOK, status)
+	delta, err = s.GetCounter(ctx, series)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), delta)
+
+	status, _ = export(`{"resourceMetrics":`, "application/json")
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = export(request(1, "1", ""), "application/x-protobuf")
+	assert.Equal(t, http.StatusUnsupportedMediaType, status)
+}
+
+func TestOTLPCumulative(t *testing.T) {
+	c := newOTLPCumulative()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.commit(map[string]otlpCumulativePoint{"a": {value: 1}, "b": {value: 1}}, now)
+
+	// the failed request restores the previous state unless another request updated the series
+	first := map[string]otlpCumulativePoint{"a": {value: 2}, "b": {value: 2}, "c": {value: 2}}
+	previous := c.commit(first, now)
+	c.commit(map[string]otlpCumulativePoint{"b": {value: 3}}, now)
+	c.rollback(first, previous)
+	assert.Equal(t, 1.0, c.series["a"].value)
+	assert.Equal(t, 3.0, c.series["b"].value)
+	assert.NotContains(t, c.series, "c")
+
+	c.forget([]models.Metrics{{ID: "a", MType: "counter"}, {ID: "b", MType: "gauge"}})
+	assert.NotContains(t, c.series, "a")
+	assert.Contains(t, c.series, "b")
+
+	// series which aren't reported are dropped
+	c.commit(map[string]otlpCumulativePoint{"d": {value: 1}}, now.Add(otlpStaleAfter/2))
+	c.commit(map[string]otlpCumulativePoint{}, now.Add(otlpStaleAfter))
+	assert.NotContains(t, c.series, "b")
+	assert.Contains(t, c.series, "d")
+}
+
+func TestBatchUpdate(t *testing.T) {
+	ctx := context.Background()
+	s := storage2.NewMemStorage("", false, 0)
+	ts := httptest.NewServer(MetricsRouter(s, nil, RouterConfig{}))
+	defer ts.Close()
+	post := func(path string, body string) (int, []byte) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		defer func() {
+			err := res.Body.Close()
+			if err != nil {
+				fmt.Println(err)
+			}
+		}()
+		reply, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, reply
+	}
+
+	// the reply contains the resulting values only
+	status, reply := post("/updates/", `[{"id":"PollCount","type":"counter","delta":2},`+
+		`{"id":"PollCount","type":"counter","delta":3},{"id":"Alloc","type":"gauge","value":1.5}]`)
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `[{"id":"PollCount","type":"counter","delta":2},`+
+		`{"id":"PollCount","type":"counter","delta":5},{"id":"Alloc","type":"gauge","value":1.5}]`, string(reply))
+
+	// invalid metrics reject the whole batch
+	status, _ = post("/updates/", `[{"id":"PollCount","type":"counter","delta":1},`+
+		`{"id":"Alloc","type":"gauge"}]`)
+	require.Equal(t, http.StatusBadRequest, status)
+	delta, err := s.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), delta)
+
+	status, reply = post("/updates/?partial=true", `[{"id":"PollCount","type":"counter","delta":1},`+
+		`{"id":"Alloc","type":"gauge"},{"id":"bad-id","type":"gauge","value":1},{"id":"Free","type":"gauge","value":7}]`)
+	require.Equal(t, http.StatusMultiStatus, status)
+	var results []batchItemResult
+	require.NoError(t, json.Unmarshal(reply, &results))
+	require.Len(t, results, 4)
+	statuses := make([]int, 0, len(results))
+	for _, r := range results {
+		statuses = append(statuses, r.Status)
+	}
+	assert.Equal(t, []int{http.StatusOK, http.StatusBadRequest, http.StatusBadRequest, http.StatusOK}, statuses)
+	assert.Equal(t, int64(6), *results[0].Delta)
+	assert.Equal(t, "bad-id", results[2].ID)
+	assert.NotEmpty(t, results[2].Error)
+	assert.Empty(t, results[3].Error)
+	value, err := s.GetGauge(ctx, "Free")
+	require.NoError(t, err)
+	assert.Equal(t, 7.0, value)
+
+	status, reply = post("/updates/?partial=1", `[{"id":"Free","type":"gauge","value":8}]`)
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `[{"id":"Free","type":"gauge","value":8,"status":200}]`, string(reply))
+	status, _ = post("/updates/?partial=maybe", `[]`)
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestDeleteMetrics(t *testing.T) {
+	ctx := context.Background()
+	s := storage2.NewMemStorage("", false, 0)
+	require.NoError(t, s.SetGauge(ctx, "Alloc", 1.5))
+	require.NoError(t, s.SetGauge(ctx, "Alloc{host=a}", 2.5))
+	require.NoError(t, s.SetCounter(ctx, "PollCount{host=a}", 3))
+	require.NoError(t, s.SetGauge(ctx, "Free{host=a}", 4))
+	ts := httptest.NewServer(MetricsRouter(s, nil, RouterConfig{}))
+	defer ts.Close()
+	do := func(method string, path string, body string) (int, string) {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		defer func() {
+			err := res.Body.Close()
+			if err != nil {
+				fmt.Println(err)
+			}
+		}()
+		reply, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(reply)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/value/gauge/Alloc", http.StatusOK},
+		{"/value/gauge/Alloc", http.StatusNotFound},
+		{"/value/counter/Alloc", http.StatusNotFound},
+		{"/value/histogram/Alloc", http.StatusBadRequest},
+		{"/value/gauge/bad-id", http.StatusBadRequest},
+		{"/value/gauge/Free%7Bhost=a%7D", http.StatusOK},
+		{"/value/gauge/Free%7Bhost=a%7D", http.StatusNotFound},
+		{"/value/gauge/Free%7Bhost%7D", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		status, _ := do(http.MethodDelete, test.path, "")
+		assert.Equal(t, test.status, status, test.path)
+	}
+
+	status, reply := do(http.MethodPost, "/delete/", `[{"id":"Alloc","type":"gauge","labels":{"host":"a"}},`+
+		`{"id":"PollCount","type":"counter","labels":{"host":"a"}},{"id":"Missing","type":"gauge"}]`)
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `[{"id":"Alloc","type":"gauge","value":2.5,"labels":{"host":"a"}},`+
+		`{"id":"PollCount","type":"counter","delta":3,"labels":{"host":"a"}}]`, reply)
+	all, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, all)
+
+	status, _ = do(http.MethodPost, "/delete/", `[{"id":"Alloc","type":"gauge","labels":{"host":"a b"}}]`)
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestDashboard(t *testing.T) {
+	ctx := context.Background()
+	s := storage2.NewMemStorage("", false, 0)
+	require.NoError(t, s.SetGauge(ctx, "Zeta", 2))
+	require.NoError(t, s.SetGauge(ctx, "Alloc{host=a}", 1.5))
+	require.NoError(t, s.SetGauge(ctx, "<script>", 1))
+	require.NoError(t, s.SetCounter(ctx, "PollCount", 5))
+	ts := httptest.NewServer(MetricsRouter(s, nil, RouterConfig{}))
+	defer ts.Close()
+	get := func(path string) (int, string, string) {
+		res, err := ts.Client().Get(ts.URL + path)
+		require.NoError(t, err)
+		defer func() {
+			err := res.Body.Close()
+			if err != nil {
+				fmt.Println(err)
+			}
+		}()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, res.Header.Get("Content-Type"), string(body)
+	}
+
+	status, contentType, body := get("/")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "text/html; charset=utf-8", contentType)
+	assert.Contains(t, body, `<meta http-equiv="refresh" content="10">`)
+	assert.Contains(t, body, "<td>&lt;script&gt;</td>")
+	assert.NotContains(t, body, "<script>")
+	assert.Contains(t, body, `<td>Alloc</td><td>host=a</td><td class="value">1.5</td>`)
+	assert.Contains(t, body, `<td>PollCount</td><td></td><td class="value">5</td>`)
+	assert.Less(t, strings.Index(body, "<td>Alloc</td>"), strings.Index(body, "<td>Zeta</td>"))
+
+	status, _, body = get("/?type=gauge&prefix=Z&refresh=0")
+	require.Equal(t, http.StatusOK, status)
+	assert.NotContains(t, body, "http-equiv")
+	assert.Contains(t, body, "<td>Zeta</td>")
+	assert.NotContains(t, body, "<td>Alloc</td>")
+	assert.NotContains(t, body, "Counters")
+
+	status, contentType, body = get("/?format=text")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "text/plain; charset=utf-8", contentType)
+	assert.Contains(t, body, "PollCount=5\n")
+
+	for _, path := range []string{"/?type=histogram", "/?refresh=-1", "/?format=xml"} {
+		status, _, _ = get(path)
+		assert.Equal(t, http.StatusBadRequest, status, path)
+	}
+}
+
+func TestListMetrics(t *testing.T) {
+	ctx := context.Background()
+	s := storage2.NewMemStorage("", false, 0)
+	for _, key := range []string{"Alloc{host=b}", "Alloc{host=a}", "HeapAlloc", "Frees"} {
+		require.NoError(t, s.SetGauge(ctx, key, 1))
+	}
+	require.NoError(t, s.SetCounter(ctx, "PollCount", 2))
+	ts := httptest.NewServer(MetricsRouter(s, nil, RouterConfig{}))
+	defer ts.Close()
+	list := func(query string) (int, metricsPage) {
+		res, err := ts.Client().Get(ts.URL + "/api/v1/metrics" + query)
+		require.NoError(t, err)
+		defer func() {
+			err := res.Body.Close()
+			if err != nil {
+				fmt.Println(err)
+			}
+		}()
+		var page metricsPage
+		if res.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&page))
+		}
+		return res.StatusCode, page
+	}
+	keys := func(page metricsPage) []string {
+		res := make([]string, 0, len(page.Metrics))
+		for _, m := range page.Metrics {
+			res = append(res, m.Cursor())
+		}
+		return res
+	}
+
+	status, page := list("")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"counter/PollCount", "gauge/Alloc{host=a}", "gauge/Alloc{host=b}", "gauge/Frees",
+		"gauge/HeapAlloc"}, keys(page))
+	assert.Empty(t, page.Next)
+	assert.NotNil(t, page.Metrics[0].Updated)
+
+	// pages follow each other without gaps
+	var all []string
+	query := "?type=gauge&limit=2"
+	for i := 0; i < 5; i++ {
+		status, page = list(query)
+		require.Equal(t, http.StatusOK, status)
+		all = append(all, keys(page)...)
+		if len(page.Next) == 0 {
+			break
+		}
+		query = "?type=gauge&limit=2&cursor=" + page.Next
+	}
+	assert.Equal(t, []string{"gauge/Alloc{host=a}", "gauge/Alloc{host=b}", "gauge/Frees", "gauge/HeapAlloc"}, all)
+
+	status, page = list("?prefix=Al")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"gauge/Alloc{host=a}", "gauge/Alloc{host=b}"}, keys(page))
+	status, page = list("?regex=Alloc%24&limit=1")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"gauge/Alloc{host=a}"}, keys(page))
+	assert.NotEmpty(t, page.Next)
+
+	for _, query := range []string{"?type=histogram", "?regex=(", "?limit=0", "?limit=100000", "?cursor=%25"} {
+		status, _ = list(query)
+		assert.Equal(t, http.StatusBadRequest, status, query)
+	}
+}
+
+func TestStreamMetrics(t *testing.T) {
+	ctx := context.Background()
+	h := hub.New(10)
+	s := hub.NewNotifyingStorage(storage2.NewMemStorage("", false, 0), h)
+	ts := httptest.NewServer(MetricsRouter(s, nil, RouterConfig{Hub: h, Key: "key", StorageTimeout: time.Second}))
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL + "/api/v1/stream?type=gauge&prefix=Heap")
+	require.NoError(t, err)
+	defer func() {
+		err := res.Body.Close()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	events := bufio.NewReader(res.Body)
+	readEvent := func() (string, string) {
+		var event, data string
+		for {
+			line, err := events.ReadString('\n')
+			require.NoError(t, err)
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case len(line) == 0:
+				return event, data
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}
+
+	require.NoError(t, s.SetGauge(ctx, "Alloc", 1))
+	require.NoError(t, s.SetGauge(ctx, "HeapAlloc", 2))
+	event, data := readEvent()
+	assert.Equal(t, "gauge", event)
+	assert.JSONEq(t, `{"id":"HeapAlloc","type":"gauge","value":2}`, data)
+
+	require.NoError(t, s.SetGauge(ctx, "HeapSys", 3))
+	event, data = readEvent()
+	assert.Equal(t, "gauge", event)
+	assert.JSONEq(t, `{"id":"HeapSys","type":"gauge","value":3}`, data)
+
+	// removed series are sent with their last values
+	_, err = s.Delete(ctx, []models.Metrics{{ID: "HeapSys", MType: "gauge"}})
+	require.NoError(t, err)
+	event, data = readEvent()
+	assert.Equal(t, "deleted", event)
+	assert.JSONEq(t, `{"id":"HeapSys","type":"gauge","value":3}`, data)
+
+	// closing the hub finishes the stream
+	h.Close()
+	_, err = io.ReadAll(events)
+	require.NoError(t, err)
+
+	res, err = ts.Client().Get(ts.URL + "/api/v1/stream?type=histogram")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestAlerts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := storage2.NewMemStorage("", false, 0)
+	require.NoError(t, s.SetGauge(ctx, "HeapInuse", 150))
+	require.NoError(t, s.SetGauge(ctx, "HeapSys", 150))
+	engine, err := alerting.NewEngine(s, alerting.Config{
+		EvaluationInterval: alerting.Duration(10 * time.Millisecond),
+		Rules:              []alerting.Rule{{Name: "heap", Metric: "HeapInuse", Comparator: ">", Threshold: 100}},
+	}, 0)
+	require.NoError(t, err)
+	go engine.Run(ctx)
+
+	disabled := httptest.NewServer(MetricsRouter(s, nil, RouterConfig{}))
+	defer disabled.Close()
+	res, err := disabled.Client().Get(disabled.URL + "/api/v1/alerts")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	ts := httptest.NewServer(MetricsRouter(s, nil, RouterConfig{Alerts: engine}))
+	defer ts.Close()
+	require.Eventually(t, func() bool {
+		return len(engine.Alerts()) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	res, err = ts.Client().Get(ts.URL + "/api/v1/alerts")
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	var alerts []alerting.Alert
+	require.NoError(t, json.Unmarshal(body, &alerts))
+	require.Len(t, alerts, 1)
+	require.Equal(t, "heap/HeapInuse", alerts[0].Fingerprint)
+	require.Equal(t, alerting.StateFiring, alerts[0].State)
+	require.Equal(t, 150.0, alerts[0].Value)
+	require.NotNil(t, alerts[0].FiredAt)
+}
+
+func TestCounterRate(t *testing.T) {
+	ctx := context.Background()
+	s := storage2.NewMemStorage("", false, 0)
+	require.NoError(t, s.SetCounter(ctx, "PollCount", 3))
+	require.NoError(t, s.SetCounter(ctx, "PollCount{host=a}", 3))
+	require.NoError(t, s.SetGauge(ctx, "Alloc", 1.5))
+	ts := httptest.NewServer(MetricsRouter(s, nil, RouterConfig{}))
+	defer ts.Close()
+	do := func(method string, path string, body string) (int, string) {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		defer func() {
+			err := res.Body.Close()
+			if err != nil {
+				fmt.Println(err)
+			}
+		}()
+		reply, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(reply)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+		reply  string
+	}{
+		{"/value/rate/PollCount", http.StatusOK, "0"},
+		{"/value/rate/Alloc", http.StatusNotFound, ""},
+		{"/value/rate/bad-id", http.StatusBadRequest, ""},
+		{"/value/rate/PollCount%7Bhost=a%7D", http.StatusOK, "0"},
+		{"/value/rate/PollCount%7Bhost=b%7D", http.StatusNotFound, ""},
+		{"/value/rate/PollCount%7Bhost%7D", http.StatusBadRequest, ""},
+		{"/value/counter/PollCount", http.StatusOK, "3"},
+	}
+	for _, test := range tests {
+		status, reply := do(http.MethodGet, test.path, "")
+		assert.Equal(t, test.status, status, test.path)
+		if test.status == http.StatusOK {
+			assert.Equal(t, test.reply, reply, test.path)
+		}
+	}
+
+	status, reply := do(http.MethodPost, "/value/", `{"id":"PollCount","type":"counter","labels":{"host":"a"}}`)
+	require.Equal(t, http.StatusOK, status)
+	var m models.Metrics
+	require.NoError(t, json.Unmarshal([]byte(reply), &m))
+	require.Equal(t, int64(3), *m.Delta)
+	require.NotNil(t, m.Rate)
+	require.Equal(t, 0.0, *m.Rate)
+
+	status, reply = do(http.MethodPost, "/value/", `{"id":"Alloc","type":"gauge"}`)
+	require.Equal(t, http.StatusOK, status)
+	require.NotContains(t, reply, "rate")
+}
@@ -0,0 +1,104 @@
+package httprouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/hub"
+	"github.com/sgladkov/harvester/internal/logger"
+	"go.uber.org/zap"
+)
+
+// streamKeepAlive is the period of comments sent to idle streams, so proxies don't close them
+const streamKeepAlive = 15 * time.Second
+
+// eventHub delivers updates to /api/v1/stream, nil disables streaming
+var eventHub *hub.Hub
+
+type streamDropped struct {
+	Dropped uint64 `json:"dropped"`
+}
+
+// streamMetrics sends accepted updates as Server-Sent Events with the metrics type as the event name,
+// removed series are sent as "deleted" events with their last values.
+// Updates are filtered by type, prefix and regex query parameters. If the client doesn't keep up,
+// updates are dropped and "dropped" event with the total number of dropped updates is sent right away.
+func streamMetrics(w http.ResponseWriter, r *http.Request) {
+	if eventHub == nil {
+		logger.Log.Warn("Streaming is disabled")
+		http.Error(w, "Streaming is disabled", http.StatusNotFound)
+		return
+	}
+	filter, err := parseMetricsFilter(r)
+	if err != nil {
+		logger.Log.Warn("Invalid metrics stream query", zap.Error(err))
+		http.Error(w, fmt.Sprintf("Invalid metrics stream query [%s]", err), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logger.Log.Warn("Streaming isn't supported by response writer")
+		http.Error(w, "Streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+
+	subscription := eventHub.Subscribe(filter)
+	defer eventHub.Unsubscribe(subscription)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	logger.Log.Info("Stream is started", zap.String("remote", r.RemoteAddr))
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	var reported uint64
+	for {
+		select {
+		case <-r.Context().Done():
+			logger.Log.Info("Stream is closed by client", zap.String("remote", r.RemoteAddr),
+				zap.Uint64("dropped", subscription.Dropped()))
+			return
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case <-subscription.Overflow():
+			if dropped := subscription.Dropped(); dropped != reported {
+				reported = dropped
+				err = writeEvent(w, "dropped", streamDropped{Dropped: dropped})
+			}
+		case e, ok := <-subscription.Events():
+			if !ok {
+				logger.Log.Info("Stream is closed by server", zap.String("remote", r.RemoteAddr))
+				return
+			}
+			if dropped := subscription.Dropped(); dropped != reported {
+				reported = dropped
+				err = writeEvent(w, "dropped", streamDropped{Dropped: dropped})
+			}
+			if err == nil {
+				event := e.MType
+				if e.Deleted {
+					event = "deleted"
+				}
+				err = writeEvent(w, event, e.Metrics)
+			}
+		}
+		if err != nil {
+			logger.Log.Warn("Failed to write event", zap.String("remote", r.RemoteAddr), zap.Error(err))
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	return err
+}
@@ -1,8 +1,14 @@
 package httprouter
 
 import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net"
 	"net/http"
 	"strings"
+
+	"github.com/sgladkov/harvester/internal/models"
 )
 
 func ContainsHeaderValue(r *http.Request, header string, value string) bool {
@@ -17,3 +23,36 @@ func ContainsHeaderValue(r *http.Request, header string, value string) bool {
 	}
 	return false
 }
+
+// storageErrorStatus returns HTTP status for the error of storage operation:
+// 504 if the storage timeout is exceeded, 503 if the storage is unavailable or the request is canceled,
+// defaultStatus otherwise
+func storageErrorStatus(r *http.Request, err error, defaultStatus int) int {
+	ctxErr := r.Context().Err()
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(ctxErr, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled), errors.Is(ctxErr, context.Canceled),
+		errors.Is(err, driver.ErrBadConn), errors.As(err, &netErr):
+		return http.StatusServiceUnavailable
+	}
+	return defaultStatus
+}
+
+// parseSeriesParam parses the series key passed in URL path, e.g. Alloc or Alloc{host=a}
+func parseSeriesParam(key string) (models.Metrics, error) {
+	id, labels, err := models.ParseSeriesKey(key)
+	if err != nil {
+		return models.Metrics{}, err
+	}
+	err = models.ValidateMetricsID(id)
+	if err != nil {
+		return models.Metrics{}, err
+	}
+	err = models.ValidateLabels(labels)
+	if err != nil {
+		return models.Metrics{}, err
+	}
+	return models.Metrics{ID: id, Labels: labels}, nil
+}
@@ -0,0 +1,131 @@
+package hub
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/sgladkov/harvester/internal/models"
+)
+
+// Event is the update of the series with its resulting value or its deletion with the last value
+type Event struct {
+	models.Metrics
+	Deleted bool
+}
+
+// Subscription receives metrics updates matching its filter. Its buffer is bounded, updates which don't fit
+// into it are dropped and counted, so a slow subscriber never blocks publishers.
+type Subscription struct {
+	filter   models.MetricsFilter
+	events   chan Event
+	dropped  atomic.Uint64
+	overflow chan struct{}
+}
+
+// Events returns the channel of updates, it's closed when the subscription is canceled or the hub is closed
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns the number of updates dropped because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Overflow returns the channel signaled when updates are dropped, signals are coalesced until it's read
+func (s *Subscription) Overflow() <-chan struct{} {
+	return s.overflow
+}
+
+// Hub delivers published metrics updates to subscribers
+type Hub struct {
+	bufferSize    int
+	subscriptions map[*Subscription]struct{}
+	closed        bool
+	dropped       atomic.Uint64
+	lock          sync.RWMutex
+}
+
+// New creates Hub with bufferSize updates buffered per subscriber
+func New(bufferSize int) *Hub {
+	return &Hub{
+		bufferSize:    bufferSize,
+		subscriptions: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe creates a subscription to updates matching filter, its position and limit are ignored.
+// The subscription to the closed hub has the closed channel.
+func (h *Hub) Subscribe(filter models.MetricsFilter) *Subscription {
+	s := &Subscription{
+		filter:   filter,
+		events:   make(chan Event, h.bufferSize),
+		overflow: make(chan struct{}, 1),
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		close(s.events)
+		return s
+	}
+	h.subscriptions[s] = struct{}{}
+	return s
+}
+
+// Unsubscribe cancels the subscription and closes its channel
+func (h *Hub) Unsubscribe(s *Subscription) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, exists := h.subscriptions[s]; exists {
+		delete(h.subscriptions, s)
+		close(s.events)
+	}
+}
+
+// Publish sends updates to matching subscribers without waiting for them
+func (h *Hub) Publish(metrics ...models.Metrics) {
+	h.publish(false, metrics)
+}
+
+// PublishDeleted sends deletions of series to matching subscribers without waiting for them
+func (h *Hub) PublishDeleted(metrics ...models.Metrics) {
+	h.publish(true, metrics)
+}
+
+func (h *Hub) publish(deleted bool, metrics []models.Metrics) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for s := range h.subscriptions {
+		for _, m := range metrics {
+			if !s.filter.Match(m) {
+				continue
+			}
+			select {
+			case s.events <- Event{Metrics: m, Deleted: deleted}:
+			default:
+				s.dropped.Add(1)
+				h.dropped.Add(1)
+				select {
+				case s.overflow <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// Dropped returns the number of updates dropped for all subscribers
+func (h *Hub) Dropped() uint64 {
+	return h.dropped.Load()
+}
+
+// Close cancels all subscriptions, e.g. to finish streaming requests on shutdown
+func (h *Hub) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.closed = true
+	for s := range h.subscriptions {
+		delete(h.subscriptions, s)
+		close(s.events)
+	}
+}
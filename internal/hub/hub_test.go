@@ -0,0 +1,93 @@
+package hub
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/models"
+	"github.com/sgladkov/harvester/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func gauge(id string, value float64) models.Metrics {
+	return models.Metrics{ID: id, MType: "gauge", Value: &value}
+}
+
+func TestHub(t *testing.T) {
+	h := New(2)
+	all := h.Subscribe(models.MetricsFilter{})
+	heap := h.Subscribe(models.MetricsFilter{MType: "gauge", Pattern: regexp.MustCompile("^Heap")})
+
+	h.Publish(gauge("HeapAlloc", 1), gauge("Alloc", 2), gauge("HeapSys", 3))
+	require.Equal(t, "HeapAlloc", (<-heap.Events()).ID)
+	require.Equal(t, "HeapSys", (<-heap.Events()).ID)
+	require.Equal(t, uint64(0), heap.Dropped())
+	// the buffer of all is full, so the third update is dropped
+	require.Equal(t, "HeapAlloc", (<-all.Events()).ID)
+	require.Equal(t, "Alloc", (<-all.Events()).ID)
+	require.Equal(t, uint64(1), all.Dropped())
+	require.Equal(t, uint64(1), h.Dropped())
+	// drops are signaled without waiting for the next update
+	require.Len(t, all.Overflow(), 1)
+	<-all.Overflow()
+	require.Len(t, heap.Overflow(), 0)
+
+	h.Unsubscribe(all)
+	_, ok := <-all.Events()
+	require.False(t, ok)
+	h.Unsubscribe(all)
+
+	h.Close()
+	_, ok = <-heap.Events()
+	require.False(t, ok)
+	_, ok = <-h.Subscribe(models.MetricsFilter{}).Events()
+	require.False(t, ok)
+	h.Publish(gauge("HeapAlloc", 1))
+}
+
+func TestNotifyingStorage(t *testing.T) {
+	ctx := context.Background()
+	h := New(10)
+	sub := h.Subscribe(models.MetricsFilter{})
+	s := NewNotifyingStorage(storage.NewMemStorage("", false, 0), h)
+	delta := int64(2)
+
+	require.NoError(t, s.SetGauge(ctx, "Alloc{host=a}", 1.5))
+	require.NoError(t, s.SetCounter(ctx, "PollCount", 1))
+	_, err := s.SetMetrics(ctx, models.Metrics{ID: "PollCount", MType: "counter", Delta: &delta})
+	require.NoError(t, err)
+	_, err = s.SetMetricsBatch(ctx, []models.Metrics{gauge("Free", 3), {ID: "PollCount", MType: "counter", Delta: &delta}})
+	require.NoError(t, err)
+	// rejected updates aren't published
+	_, err = s.SetMetricsBatch(ctx, []models.Metrics{gauge("bad-id", 1)})
+	require.Error(t, err)
+
+	m := <-sub.Events()
+	require.Equal(t, "Alloc", m.ID)
+	require.Equal(t, map[string]string{"host": "a"}, m.Labels)
+	require.Equal(t, 1.5, *m.Value)
+	for _, want := range []int64{1, 3} {
+		m = <-sub.Events()
+		require.Equal(t, "PollCount", m.ID)
+		require.Equal(t, want, *m.Delta)
+	}
+	require.Equal(t, "Free", (<-sub.Events()).ID)
+	require.Equal(t, int64(5), *(<-sub.Events()).Delta)
+	require.Len(t, sub.Events(), 0)
+
+	// removed series are published as deletions
+	_, err = s.Delete(ctx, []models.Metrics{{ID: "Free", MType: "gauge"}, {ID: "Missing", MType: "gauge"}})
+	require.NoError(t, err)
+	e := <-sub.Events()
+	require.True(t, e.Deleted)
+	require.Equal(t, "Free", e.ID)
+	require.Equal(t, 3.0, *e.Value)
+	_, err = s.Expire(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		require.True(t, (<-sub.Events()).Deleted)
+	}
+	require.Len(t, sub.Events(), 0)
+}
@@ -0,0 +1,111 @@
+package hub
+
+import (
+	"context"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/interfaces"
+	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/models"
+	"go.uber.org/zap"
+)
+
+// NotifyingStorage publishes accepted updates of the wrapped storage to the hub with their resulting values
+// and removed series with their last values
+type NotifyingStorage struct {
+	interfaces.Storage
+	hub *Hub
+}
+
+func NewNotifyingStorage(s interfaces.Storage, h *Hub) *NotifyingStorage {
+	return &NotifyingStorage{Storage: s, hub: h}
+}
+
+func seriesMetrics(mType string, key string) (models.Metrics, bool) {
+	id, labels, err := models.ParseSeriesKey(key)
+	if err != nil {
+		logger.Log.Warn("Update isn't published", zap.String("series", key), zap.Error(err))
+		return models.Metrics{}, false
+	}
+	return models.Metrics{ID: id, MType: mType, Labels: labels}, true
+}
+
+func (s *NotifyingStorage) SetGauge(ctx context.Context, name string, value float64) error {
+	err := s.Storage.SetGauge(ctx, name, value)
+	if err != nil {
+		return err
+	}
+	if m, ok := seriesMetrics("gauge", name); ok {
+		m.Value = &value
+		s.hub.Publish(m)
+	}
+	return nil
+}
+
+func (s *NotifyingStorage) AddGauge(ctx context.Context, name string, delta float64) (float64, error) {
+	value, err := s.Storage.AddGauge(ctx, name, delta)
+	if err != nil {
+		return value, err
+	}
+	if m, ok := seriesMetrics("gauge", name); ok {
+		m.Value = &value
+		s.hub.Publish(m)
+	}
+	return value, nil
+}
+
+// SetCounter publishes the counter value read after the update, it may include concurrent updates
+func (s *NotifyingStorage) SetCounter(ctx context.Context, name string, value int64) error {
+	err := s.Storage.SetCounter(ctx, name, value)
+	if err != nil {
+		return err
+	}
+	m, ok := seriesMetrics("counter", name)
+	if !ok {
+		return nil
+	}
+	total, err := s.Storage.GetCounter(ctx, name)
+	if err != nil {
+		logger.Log.Warn("Update isn't published", zap.String("series", name), zap.Error(err))
+		return nil
+	}
+	m.Delta = &total
+	s.hub.Publish(m)
+	return nil
+}
+
+func (s *NotifyingStorage) SetMetrics(ctx context.Context, m models.Metrics) (models.Metrics, error) {
+	res, err := s.Storage.SetMetrics(ctx, m)
+	if err != nil {
+		return res, err
+	}
+	s.hub.Publish(res)
+	return res, nil
+}
+
+func (s *NotifyingStorage) SetMetricsBatch(ctx context.Context, metricsBatch []models.Metrics) ([]models.Metrics, error) {
+	res, err := s.Storage.SetMetricsBatch(ctx, metricsBatch)
+	if err != nil {
+		return res, err
+	}
+	s.hub.Publish(res...)
+	return res, nil
+}
+
+func (s *NotifyingStorage) Delete(ctx context.Context, metricsBatch []models.Metrics) ([]models.Metrics, error) {
+	res, err := s.Storage.Delete(ctx, metricsBatch)
+	if err != nil {
+		return res, err
+	}
+	s.hub.PublishDeleted(res...)
+	return res, nil
+}
+
+func (s *NotifyingStorage) Expire(ctx context.Context, before time.Time) ([]models.Metrics, error) {
+	res, err := s.Storage.Expire(ctx, before)
+	if err != nil {
+		return res, err
+	}
+	s.hub.PublishDeleted(res...)
+	return res, nil
+}
@@ -1,16 +1,35 @@
 package interfaces
 
-import "github.com/sgladkov/harvester/internal/models"
+import (
+	"context"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/models"
+)
 
 type Storage interface {
-	GetGauge(name string) (float64, error)
-	SetGauge(name string, value float64) error
-	GetCounter(name string) (int64, error)
-	SetCounter(name string, value int64) error
-	GetAll() string
-	SetMetrics(m models.Metrics) (models.Metrics, error)
-	GetMetrics(m models.Metrics) (models.Metrics, error)
-	Save() error
-	Read() error
-	SetMetricsBatch(metricsBatch []models.Metrics) error
+	GetGauge(ctx context.Context, name string) (float64, error)
+	SetGauge(ctx context.Context, name string, value float64) error
+	// AddGauge adds delta to the gauge atomically and returns its new value, unknown gauge starts from 0
+	AddGauge(ctx context.Context, name string, delta float64) (float64, error)
+	GetCounter(ctx context.Context, name string) (int64, error)
+	SetCounter(ctx context.Context, name string, value int64) error
+	// GetRate returns per second growth of the counter since the update before the last one up to now,
+	// it's never negative and becomes 0 if the counter isn't updated for a while
+	GetRate(ctx context.Context, name string) (float64, error)
+	GetAll(ctx context.Context) (string, error)
+	GetAllMetrics(ctx context.Context) ([]models.Metrics, error)
+	// ListMetrics calls f for series selected by filter in the order of their cursors, it stops if f returns error
+	ListMetrics(ctx context.Context, filter models.MetricsFilter, f func(m models.Metrics) error) error
+	SetMetrics(ctx context.Context, m models.Metrics) (models.Metrics, error)
+	GetMetrics(ctx context.Context, m models.Metrics) (models.Metrics, error)
+	Save(ctx context.Context) error
+	Read(ctx context.Context) error
+	// SetMetricsBatch applies all metrics or none of them and returns metrics with the resulting values
+	SetMetricsBatch(ctx context.Context, metricsBatch []models.Metrics) ([]models.Metrics, error)
+	// Delete removes series of metrics and returns the removed ones with their last values
+	Delete(ctx context.Context, metricsBatch []models.Metrics) ([]models.Metrics, error)
+	// Expire removes series which aren't updated since before and returns them with their last values
+	Expire(ctx context.Context, before time.Time) ([]models.Metrics, error)
+	GetHistory(ctx context.Context, m models.Metrics, from time.Time, to time.Time) ([]models.Point, error)
 }
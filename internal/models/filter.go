@@ -0,0 +1,49 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+)
+
+// MetricsFilter selects series listed by storage. Series are listed ordered by type and series key.
+type MetricsFilter struct {
+	MType   string         // gauge or counter, empty means both
+	Prefix  string         // prefix of metrics id
+	Pattern *regexp.Regexp // regular expression metrics id should match, nil means any
+	After   string         // only series after the cursor returned by Cursor are listed
+	Limit   int            // maximum number of series, 0 means no limit
+}
+
+// Cursor returns the position of the series in the list of series ordered by type and series key
+func (m Metrics) Cursor() string {
+	return m.MType + "/" + m.SeriesKey()
+}
+
+// ParseCursor splits the cursor returned by Cursor to metrics type and series key
+func ParseCursor(cursor string) (string, string) {
+	mType, key, _ := strings.Cut(cursor, "/")
+	return mType, key
+}
+
+// Match checks metrics type and id, position and limit aren't checked
+func (f MetricsFilter) Match(m Metrics) bool {
+	if len(f.MType) > 0 && m.MType != f.MType {
+		return false
+	}
+	if !strings.HasPrefix(m.ID, f.Prefix) {
+		return false
+	}
+	return f.Pattern == nil || f.Pattern.MatchString(m.ID)
+}
+
+// IsAfter checks the series of m is after the cursor of the filter
+func (f MetricsFilter) IsAfter(m Metrics) bool {
+	if len(f.After) == 0 {
+		return true
+	}
+	mType, key := ParseCursor(f.After)
+	if m.MType != mType {
+		return m.MType > mType
+	}
+	return m.SeriesKey() > key
+}
@@ -0,0 +1,15 @@
+package models
+
+// Point is a single timestamped sample of the series
+type Point struct {
+	Timestamp int64   `json:"timestamp"` // время в миллисекундах с начала эпохи Unix
+	Value     float64 `json:"value"`     // значение метрики
+}
+
+// History is a set of points of the series returned by the range query
+type History struct {
+	ID     string            `json:"id"`
+	MType  string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Points []Point           `json:"points"`
+}
@@ -2,15 +2,23 @@ package models
 
 import (
 	"errors"
+	"fmt"
+	"sort"
 	"strings"
+	"time"
 	"unicode"
 )
 
 type Metrics struct {
-	ID    string   `json:"id"`              // имя метрики
-	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
-	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
+	ID     string            `json:"id"`               // имя метрики
+	MType  string            `json:"type"`             // параметр, принимающий значение gauge или counter
+	Delta  *int64            `json:"delta,omitempty"`  // значение метрики в случае передачи counter
+	Value  *float64          `json:"value,omitempty"`  // значение метрики в случае передачи gauge
+	Labels map[string]string `json:"labels,omitempty"` // необязательный набор меток серии
+	// время последнего обновления серии, заполняется хранилищем при чтении всех метрик
+	Updated *time.Time `json:"updated,omitempty"`
+	// рост counter в секунду за последнее обновление, заполняется сервером при запросе значения
+	Rate *float64 `json:"rate,omitempty"`
 }
 
 func notLetterOrDigit(r rune) bool {
@@ -32,3 +40,169 @@ func ValidateMetricsID(id string) error {
 	}
 	return nil
 }
+
+func invalidLabelName(r rune) bool {
+	return r != '_' && notLetterOrDigit(r)
+}
+
+func invalidLabelValue(r rune) bool {
+	return !strings.ContainsRune("_-.:/", r) && notLetterOrDigit(r)
+}
+
+var ErrEmptyMetricsID = errors.New("metrics id is empty after sanitizing")
+
+// SanitizeMetricsID converts name from other systems to camel case metrics id,
+// e.g. api.request-count becomes apiRequestCount
+func SanitizeMetricsID(name string) (string, error) {
+	if ValidateMetricsID(name) == nil {
+		return name, nil
+	}
+	var b strings.Builder
+	upper := false
+	for _, r := range name {
+		if notLetterOrDigit(r) {
+			upper = b.Len() > 0
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	if b.Len() == 0 {
+		return "", ErrEmptyMetricsID
+	}
+	return b.String(), nil
+}
+
+// SanitizeLabels replaces characters which aren't allowed in label names and values with '_',
+// labels with empty name or value are skipped
+func SanitizeLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(labels))
+	for name, value := range labels {
+		if len(name) == 0 || len(value) == 0 {
+			continue
+		}
+		res[replaceFunc(name, invalidLabelName)] = replaceFunc(value, invalidLabelValue)
+	}
+	return res
+}
+
+func replaceFunc(s string, invalid func(rune) bool) string {
+	return strings.Map(func(r rune) rune {
+		if invalid(r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func ValidateLabelName(name string) error {
+	if len(name) == 0 {
+		return errors.New("empty label name")
+	}
+	if strings.IndexFunc(name, invalidLabelName) != -1 {
+		return fmt.Errorf("label name [%s] should contain letters, digits or '_' only", name)
+	}
+	return nil
+}
+
+func ValidateLabelValue(value string) error {
+	if len(value) == 0 {
+		return errors.New("empty label value")
+	}
+	if strings.IndexFunc(value, invalidLabelValue) != -1 {
+		return fmt.Errorf("label value [%s] should contain letters, digits or '_', '-', '.', ':', '/' only", value)
+	}
+	return nil
+}
+
+func ValidateLabels(labels map[string]string) error {
+	for name, value := range labels {
+		err := ValidateLabelName(name)
+		if err != nil {
+			return err
+		}
+		err = ValidateLabelValue(value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateMetrics checks metrics id, labels and that the value matches the metrics type
+func ValidateMetrics(m Metrics) error {
+	err := ValidateMetricsID(m.ID)
+	if err != nil {
+		return err
+	}
+	err = ValidateLabels(m.Labels)
+	if err != nil {
+		return err
+	}
+	switch m.MType {
+	case "gauge":
+		if m.Value == nil {
+			return errors.New("invalid gauge value")
+		}
+	case "counter":
+		if m.Delta == nil {
+			return errors.New("invalid counter value")
+		}
+	default:
+		return fmt.Errorf("unknown metrics type [%s]", m.MType)
+	}
+	return nil
+}
+
+// SeriesKey returns the series identity: metrics id for series without labels and
+// id{name1=value1,name2=value2} with labels sorted by name otherwise.
+// Validated ids and labels never contain the separators, so the key can be parsed back.
+func (m Metrics) SeriesKey() string {
+	if len(m.Labels) == 0 {
+		return m.ID
+	}
+	names := make([]string, 0, len(m.Labels))
+	for name := range m.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(m.ID)
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(m.Labels[name])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// ParseSeriesKey splits the series key created by SeriesKey to metrics id and labels
+func ParseSeriesKey(key string) (string, map[string]string, error) {
+	start := strings.IndexByte(key, '{')
+	if start == -1 {
+		return key, nil, nil
+	}
+	if !strings.HasSuffix(key, "}") {
+		return "", nil, fmt.Errorf("invalid series key [%s]", key)
+	}
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(key[start+1:len(key)-1], ",") {
+		name, value, found := strings.Cut(pair, "=")
+		if !found {
+			return "", nil, fmt.Errorf("invalid series key [%s]", key)
+		}
+		labels[name] = value
+	}
+	return key[:start], labels, nil
+}
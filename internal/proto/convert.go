@@ -0,0 +1,100 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sgladkov/harvester/internal/models"
+	"github.com/sgladkov/harvester/internal/utils"
+	"google.golang.org/protobuf/proto"
+)
+
+// HashMetadata is gRPC metadata key of HMAC-SHA256 signature of the message
+const HashMetadata = "hashsha256"
+
+// TypeFromModel converts models.Metrics type to Metric_Type
+func TypeFromModel(mType string) (Metric_Type, error) {
+	switch mType {
+	case "gauge":
+		return Metric_GAUGE, nil
+	case "counter":
+		return Metric_COUNTER, nil
+	}
+	return Metric_TYPE_UNSPECIFIED, fmt.Errorf("unknown metrics type [%s]", mType)
+}
+
+// TypeToModel converts Metric_Type to models.Metrics type
+func TypeToModel(t Metric_Type) (string, error) {
+	switch t {
+	case Metric_GAUGE:
+		return "gauge", nil
+	case Metric_COUNTER:
+		return "counter", nil
+	}
+	return "", fmt.Errorf("unknown metrics type [%s]", t)
+}
+
+// FromModel converts models.Metrics to Metric
+func FromModel(m models.Metrics) (*Metric, error) {
+	t, err := TypeFromModel(m.MType)
+	if err != nil {
+		return nil, err
+	}
+	res := &Metric{Id: m.ID, Type: t, Labels: m.Labels}
+	switch t {
+	case Metric_GAUGE:
+		if m.Value == nil {
+			return nil, errors.New("invalid gauge value")
+		}
+		res.Value = *m.Value
+	case Metric_COUNTER:
+		if m.Delta == nil {
+			return nil, errors.New("invalid counter value")
+		}
+		res.Delta = *m.Delta
+	}
+	return res, nil
+}
+
+// ToModel converts Metric to models.Metrics
+func (x *Metric) ToModel() (models.Metrics, error) {
+	if x == nil {
+		return models.Metrics{}, errors.New("metric is missing")
+	}
+	mType, err := TypeToModel(x.GetType())
+	if err != nil {
+		return models.Metrics{}, err
+	}
+	res := models.Metrics{ID: x.GetId(), MType: mType}
+	if len(x.GetLabels()) > 0 {
+		res.Labels = x.GetLabels()
+	}
+	switch x.GetType() {
+	case Metric_GAUGE:
+		value := x.GetValue()
+		res.Value = &value
+	case Metric_COUNTER:
+		delta := x.GetDelta()
+		res.Delta = &delta
+	}
+	return res, nil
+}
+
+// MessageHash calculates HMAC-SHA256 signature of the message, the message is marshalled deterministically
+// to get the same signature on both sides
+func MessageHash(m proto.Message, key string) (string, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return utils.CalculateHash(data, key), nil
+}
+
+// CheckMessageHash checks hash is the valid signature of the message, hashes are compared in constant time
+func CheckMessageHash(m proto.Message, key string, hash string) (bool, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return false, err
+	}
+	return utils.CheckHash(data, key, hash), nil
+}
@@ -0,0 +1,4 @@
+// Package proto contains gRPC service for metrics generated from metrics.proto and conversions to models
+package proto
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative metrics.proto
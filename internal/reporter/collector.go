@@ -0,0 +1,158 @@
+package reporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/sgladkov/harvester/internal/models"
+)
+
+// Collector gathers metrics for the agent. Gauges replace the previous values,
+// counter deltas are added to the values to report.
+type Collector interface {
+	Name() string
+	Collect(ctx context.Context) ([]models.Metrics, error)
+}
+
+// Registry keeps collectors available to the agent by their names
+type Registry struct {
+	collectors map[string]Collector
+	lock       sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make(map[string]Collector),
+	}
+}
+
+// NewDefaultRegistry creates Registry with built-in collectors, host collector is added if procRoot isn't empty
+func NewDefaultRegistry(procRoot string) *Registry {
+	r := NewRegistry()
+	// names of built-in collectors are unique, so errors are impossible here
+	_ = r.Register(RuntimeCollector{})
+	_ = r.Register(RandomCollector{})
+	_ = r.Register(PollCountCollector{})
+	if len(procRoot) > 0 {
+		_ = r.Register(NewHostCollector(procRoot))
+	}
+	return r
+}
+
+func (r *Registry) Register(c Collector) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	name := c.Name()
+	if len(name) == 0 {
+		return errors.New("collector name is empty")
+	}
+	if _, exists := r.collectors[name]; exists {
+		return fmt.Errorf("collector [%s] is already registered", name)
+	}
+	r.collectors[name] = c
+	return nil
+}
+
+func (r *Registry) Get(name string) (Collector, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	c, exists := r.collectors[name]
+	return c, exists
+}
+
+// Names returns sorted names of registered collectors
+func (r *Registry) Names() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func gauge(name string, value float64) models.Metrics {
+	return models.Metrics{ID: name, MType: "gauge", Value: &value}
+}
+
+func counter(name string, delta int64) models.Metrics {
+	return models.Metrics{ID: name, MType: "counter", Delta: &delta}
+}
+
+// RuntimeCollector reads Go runtime memory statistics of the agent
+type RuntimeCollector struct{}
+
+func (RuntimeCollector) Name() string {
+	return "runtime"
+}
+
+func (RuntimeCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	data := runtime.MemStats{}
+	runtime.ReadMemStats(&data)
+	return []models.Metrics{
+		gauge("Alloc", float64(data.Alloc)),
+		gauge("BuckHashSys", float64(data.BuckHashSys)),
+		gauge("Frees", float64(data.Frees)),
+		gauge("GCCPUFraction", data.GCCPUFraction),
+		gauge("GCSys", float64(data.GCSys)),
+		gauge("HeapAlloc", float64(data.HeapAlloc)),
+		gauge("HeapIdle", float64(data.HeapIdle)),
+		gauge("HeapInuse", float64(data.HeapInuse)),
+		gauge("HeapObjects", float64(data.HeapObjects)),
+		gauge("HeapReleased", float64(data.HeapReleased)),
+		gauge("HeapSys", float64(data.HeapSys)),
+		gauge("LastGC", float64(data.LastGC)),
+		gauge("Lookups", float64(data.Lookups)),
+		gauge("MCacheInuse", float64(data.MCacheInuse)),
+		gauge("MCacheSys", float64(data.MCacheSys)),
+		gauge("MSpanInuse", float64(data.MSpanInuse)),
+		gauge("MSpanSys", float64(data.MSpanSys)),
+		gauge("Mallocs", float64(data.Mallocs)),
+		gauge("NextGC", float64(data.NextGC)),
+		gauge("NumForcedGC", float64(data.NumForcedGC)),
+		gauge("NumGC", float64(data.NumGC)),
+		gauge("OtherSys", float64(data.OtherSys)),
+		gauge("PauseTotalNs", float64(data.PauseTotalNs)),
+		gauge("StackInuse", float64(data.StackInuse)),
+		gauge("StackSys", float64(data.StackSys)),
+		gauge("Sys", float64(data.Sys)),
+		gauge("TotalAlloc", float64(data.TotalAlloc)),
+	}, nil
+}
+
+// RandomCollector provides RandomValue gauge
+type RandomCollector struct{}
+
+func (RandomCollector) Name() string {
+	return "random"
+}
+
+func (RandomCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return []models.Metrics{gauge("RandomValue", rand.Float64())}, nil
+}
+
+// PollCountCollector counts its polls in PollCount counter
+type PollCountCollector struct{}
+
+func (PollCountCollector) Name() string {
+	return "pollcount"
+}
+
+func (PollCountCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return []models.Metrics{counter("PollCount", 1)}, nil
+}
@@ -0,0 +1,318 @@
+package reporter
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/models"
+	"go.uber.org/zap"
+)
+
+const diskSectorSize = 512
+
+type cpuTimes struct {
+	busy  uint64
+	total uint64
+}
+
+type ioCounters struct {
+	read    uint64
+	written uint64
+}
+
+// HostCollector reads host system metrics from Linux /proc. Utilisation and throughput are calculated
+// between two subsequent calls of Collect, so the first call doesn't return them.
+type HostCollector struct {
+	procRoot string
+	now      func() time.Time
+	prevTime time.Time
+	prevCPU  map[int]cpuTimes
+	prevNet  *ioCounters
+	prevDisk *ioCounters
+}
+
+// NewHostCollector creates HostCollector which reads files under procRoot (normally /proc)
+func NewHostCollector(procRoot string) *HostCollector {
+	return &HostCollector{
+		procRoot: procRoot,
+		now:      time.Now,
+	}
+}
+
+func (c *HostCollector) Name() string {
+	return "host"
+}
+
+// Collect returns gauges read from /proc. Files which can't be read are skipped and their errors are returned
+// together with the gauges read from the rest of files.
+func (c *HostCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	res := make(map[string]float64)
+	now := c.now()
+	elapsed := now.Sub(c.prevTime).Seconds()
+	if c.prevTime.IsZero() {
+		elapsed = 0
+	}
+	c.prevTime = now
+
+	var errs []error
+	cpu, err := c.readCPU()
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		for n, times := range cpu {
+			prev, exists := c.prevCPU[n]
+			if exists && times.total > prev.total && times.busy >= prev.busy {
+				res[fmt.Sprintf("CPUutilization%d", n+1)] =
+					100 * float64(times.busy-prev.busy) / float64(times.total-prev.total)
+			}
+		}
+		c.prevCPU = cpu
+	}
+
+	err = c.readMemory(res)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	err = c.readLoadAverage(res)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	network, err := c.readNetwork()
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		rate(res, "NetworkReceiveBytesPerSecond", "NetworkTransmitBytesPerSecond", c.prevNet, network, elapsed)
+		c.prevNet = &network
+	}
+
+	disk, err := c.readDisk()
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		rate(res, "DiskReadBytesPerSecond", "DiskWriteBytesPerSecond", c.prevDisk, disk, elapsed)
+		c.prevDisk = &disk
+	}
+
+	metrics := make([]models.Metrics, 0, len(res))
+	for name, value := range res {
+		metrics = append(metrics, gauge(name, value))
+	}
+	return metrics, errors.Join(errs...)
+}
+
+// rate adds per second rates of counters if the previous values are known and counters aren't reset
+func rate(res map[string]float64, readName string, writeName string, prev *ioCounters, cur ioCounters,
+	elapsed float64) {
+	if prev == nil || elapsed <= 0 || cur.read < prev.read || cur.written < prev.written {
+		return
+	}
+	res[readName] = float64(cur.read-prev.read) / elapsed
+	res[writeName] = float64(cur.written-prev.written) / elapsed
+}
+
+func (c *HostCollector) readLines(name string) ([]string, error) {
+	f, err := os.Open(filepath.Join(c.procRoot, name))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := f.Close()
+		if err != nil {
+			logger.Log.Warn("failed to close file", zap.String("file", f.Name()), zap.Error(err))
+		}
+	}()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+func parseUints(fields []string) ([]uint64, error) {
+	res := make([]uint64, len(fields))
+	for i, f := range fields {
+		val, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = val
+	}
+	return res, nil
+}
+
+// readCPU reads per CPU times from stat, busy time is everything except idle and iowait
+func (c *HostCollector) readCPU() (map[int]cpuTimes, error) {
+	lines, err := c.readLines("stat")
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[int]cpuTimes)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || !strings.HasPrefix(fields[0], "cpu") || fields[0] == "cpu" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(fields[0], "cpu"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu line [%s] in stat: %w", line, err)
+		}
+		// guest times are already included into user and nice
+		if len(fields) > 9 {
+			fields = fields[:9]
+		}
+		values, err := parseUints(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu line [%s] in stat: %w", line, err)
+		}
+		var times cpuTimes
+		for _, v := range values {
+			times.total += v
+		}
+		times.busy = times.total - values[3] - values[4]
+		res[n] = times
+	}
+	if len(res) == 0 {
+		return nil, errors.New("no cpu lines in stat")
+	}
+	return res, nil
+}
+
+func (c *HostCollector) readMemory(res map[string]float64) error {
+	lines, err := c.readLines("meminfo")
+	if err != nil {
+		return err
+	}
+	names := map[string]string{
+		"MemTotal": "TotalMemory",
+		"MemFree":  "FreeMemory",
+	}
+	for _, line := range lines {
+		name, value, found := strings.Cut(line, ":")
+		gauge, known := names[name]
+		if !found || !known {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			return fmt.Errorf("invalid line [%s] in meminfo", line)
+		}
+		val, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid line [%s] in meminfo: %w", line, err)
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			val *= 1024
+		}
+		res[gauge] = float64(val)
+	}
+	return nil
+}
+
+func (c *HostCollector) readLoadAverage(res map[string]float64) error {
+	lines, err := c.readLines("loadavg")
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return errors.New("empty loadavg")
+	}
+	fields := strings.Fields(lines[0])
+	if len(fields) < 3 {
+		return fmt.Errorf("invalid loadavg [%s]", lines[0])
+	}
+	for i, name := range []string{"LoadAverage1", "LoadAverage5", "LoadAverage15"} {
+		val, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return fmt.Errorf("invalid loadavg [%s]: %w", lines[0], err)
+		}
+		res[name] = val
+	}
+	return nil
+}
+
+// readNetwork returns bytes received and transmitted by all interfaces except loopback
+func (c *HostCollector) readNetwork() (ioCounters, error) {
+	var res ioCounters
+	lines, err := c.readLines("net/dev")
+	if err != nil {
+		return res, err
+	}
+	for _, line := range lines {
+		name, data, found := strings.Cut(line, ":")
+		if !found || strings.TrimSpace(name) == "lo" {
+			continue
+		}
+		fields := strings.Fields(data)
+		if len(fields) < 9 {
+			return res, fmt.Errorf("invalid line [%s] in net/dev", line)
+		}
+		values, err := parseUints([]string{fields[0], fields[8]})
+		if err != nil {
+			return res, fmt.Errorf("invalid line [%s] in net/dev: %w", line, err)
+		}
+		res.read += values[0]
+		res.written += values[1]
+	}
+	return res, nil
+}
+
+// readDisk returns bytes read and written by all disks, partitions and loop and ram devices are skipped
+func (c *HostCollector) readDisk() (ioCounters, error) {
+	var res ioCounters
+	lines, err := c.readLines("diskstats")
+	if err != nil {
+		return res, err
+	}
+	devices := make(map[string]ioCounters)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+		name := fields[2]
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") {
+			continue
+		}
+		values, err := parseUints([]string{fields[5], fields[9]})
+		if err != nil {
+			return res, fmt.Errorf("invalid line [%s] in diskstats: %w", line, err)
+		}
+		devices[name] = ioCounters{read: values[0] * diskSectorSize, written: values[1] * diskSectorSize}
+	}
+	for name, counters := range devices {
+		if isPartition(name, devices) {
+			continue
+		}
+		res.read += counters.read
+		res.written += counters.written
+	}
+	return res, nil
+}
+
+// isPartition checks if name is a partition of another device, e.g. sda1 of sda or nvme0n1p1 of nvme0n1
+func isPartition(name string, devices map[string]ioCounters) bool {
+	for device := range devices {
+		if device == name || !strings.HasPrefix(name, device) {
+			continue
+		}
+		suffix := strings.TrimPrefix(strings.TrimPrefix(name, device), "p")
+		if _, err := strconv.Atoi(suffix); err == nil {
+			return true
+		}
+	}
+	return false
+}
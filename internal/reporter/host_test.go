@@ -0,0 +1,73 @@
+package reporter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gaugeValues(metrics []models.Metrics, err error) (map[string]float64, error) {
+	res := make(map[string]float64)
+	for _, m := range metrics {
+		res[m.ID] = *m.Value
+	}
+	return res, err
+}
+
+func TestHostCollector(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	ctx := context.Background()
+	c := NewHostCollector("testdata/proc1")
+	c.now = func() time.Time { return now }
+
+	// the first poll has no previous values to calculate utilisation and rates
+	res, err := gaugeValues(c.Collect(ctx))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{
+		"TotalMemory":   6158152 * 1024,
+		"FreeMemory":    4745032 * 1024,
+		"LoadAverage1":  0.33,
+		"LoadAverage5":  0.24,
+		"LoadAverage15": 0.15,
+	}, res)
+
+	c.procRoot = "testdata/proc2"
+	now = start.Add(10 * time.Second)
+	res, err = gaugeValues(c.Collect(ctx))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{
+		"CPUutilization1":               100 * 600.0 / 700,
+		"CPUutilization2":               100 * 200.0 / 300,
+		"TotalMemory":                   6158152 * 1024,
+		"FreeMemory":                    4700000 * 1024,
+		"LoadAverage1":                  1.5,
+		"LoadAverage5":                  0.5,
+		"LoadAverage15":                 0.25,
+		"NetworkReceiveBytesPerSecond":  2000,
+		"NetworkTransmitBytesPerSecond": 1000,
+		"DiskReadBytesPerSecond":        (300 * 512) / 10,
+		"DiskWriteBytesPerSecond":       (440 * 512) / 10,
+	}, res)
+
+	// counters reset, e.g. after reboot, don't produce rates
+	c.procRoot = "testdata/proc1"
+	now = start.Add(20 * time.Second)
+	res, err = gaugeValues(c.Collect(ctx))
+	require.NoError(t, err)
+	assert.NotContains(t, res, "NetworkReceiveBytesPerSecond")
+	assert.NotContains(t, res, "DiskReadBytesPerSecond")
+	assert.NotContains(t, res, "CPUutilization1")
+}
+
+func TestHostCollector_MissingFiles(t *testing.T) {
+	ctx := context.Background()
+	c := NewHostCollector("testdata/missing")
+	res, err := gaugeValues(c.Collect(ctx))
+	require.Error(t, err)
+	assert.Empty(t, res)
+}
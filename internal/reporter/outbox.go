@@ -0,0 +1,287 @@
+package reporter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/models"
+	"go.uber.org/zap"
+)
+
+const outboxSegment = "outbox.jsonl"
+
+var ErrOutboxFull = errors.New("outbox is full")
+
+// errKept is wrapped into errors of batches which aren't sent but kept in the outbox
+var errKept = errors.New("batch is kept in outbox")
+
+type outboxRecord struct {
+	Time    int64            `json:"time"` // unix time in milliseconds
+	Metrics []models.Metrics `json:"metrics"`
+}
+
+// Outbox keeps batches which weren't sent in an append-only segment file, so they survive agent restarts.
+// Batches older than maxAge are dropped, when the segment grows over maxSize it's compacted into one batch.
+type Outbox struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	size    int64
+	// sent is the size of the segment head which is already sent but isn't removed yet, it's skipped by read
+	sent int64
+	// replaying is set while kept batches are sent, the segment mustn't be compacted meanwhile
+	replaying bool
+	now       func() time.Time
+	lock      sync.Mutex
+}
+
+// NewOutbox opens the segment in dir, batches left by the previous run are sent by the next report
+func NewOutbox(dir string, maxSize int64, maxAge time.Duration) (*Outbox, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	o := &Outbox{
+		path:    filepath.Join(dir, outboxSegment),
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		now:     time.Now,
+	}
+	info, err := os.Stat(o.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		o.size = info.Size()
+	}
+	return o, nil
+}
+
+// Send sends batch together with batches kept in the outbox. If sending fails, batch is added to the outbox,
+// so the caller shouldn't keep it, the returned error wraps errKept then.
+// The lock isn't held while sending, batches kept meanwhile are left in the outbox for the next report.
+func (o *Outbox) Send(batch []models.Metrics, send func([]models.Metrics) error) error {
+	o.lock.Lock()
+	if o.size == o.sent || o.replaying {
+		// nothing to replay or another report replays, don't hold other reports while sending
+		o.lock.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		err := send(batch)
+		if err == nil {
+			return nil
+		}
+		o.lock.Lock()
+		defer o.lock.Unlock()
+		return o.keep(batch, err)
+	}
+	records, err := o.read()
+	if err != nil {
+		o.lock.Unlock()
+		return err
+	}
+	replayed := o.size
+	o.replaying = true
+	o.lock.Unlock()
+
+	batches := make([][]models.Metrics, 0, len(records)+1)
+	for _, r := range records {
+		batches = append(batches, r.Metrics)
+	}
+	err = send(mergeBatches(append(batches, batch)...))
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.replaying = false
+	if err != nil {
+		return o.keep(batch, err)
+	}
+	logger.Log.Info("Outbox is replayed", zap.Int("batches", len(records)))
+	// the replayed head is skipped even if it can't be removed now, so it's never sent twice
+	o.sent = replayed
+	err = o.dropSent()
+	if err != nil {
+		// the batch is sent, so it mustn't be kept by the caller
+		logger.Log.Error("failed to remove replayed batches from outbox", zap.Error(err))
+	}
+	return nil
+}
+
+// keep appends batch which wasn't sent because of sendErr
+func (o *Outbox) keep(batch []models.Metrics, sendErr error) error {
+	err := o.append(batch)
+	if err != nil {
+		return errors.Join(sendErr, fmt.Errorf("failed to keep batch in outbox: %w", err))
+	}
+	logger.Log.Warn("Batch is kept in outbox", zap.Int64("size", o.size), zap.Error(sendErr))
+	return fmt.Errorf("%w: %w", errKept, sendErr)
+}
+
+func (o *Outbox) append(batch []models.Metrics) error {
+	line, err := json.Marshal(outboxRecord{Time: o.now().UnixMilli(), Metrics: batch})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if o.size+int64(len(line)) > o.maxSize {
+		if o.replaying {
+			// the replayed head can't be told apart from the batches kept after it in a compacted segment
+			return ErrOutboxFull
+		}
+		return o.compact(batch)
+	}
+	f, err := os.OpenFile(o.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(line)
+	if err == nil {
+		err = f.Sync()
+	}
+	err = errors.Join(err, f.Close())
+	if err != nil {
+		return err
+	}
+	o.size += int64(len(line))
+	return nil
+}
+
+// compact rewrites the segment as one batch merged with batch, the batch time is the time of the newest one
+func (o *Outbox) compact(batch []models.Metrics) error {
+	records, err := o.read()
+	if err != nil {
+		return err
+	}
+	batches := make([][]models.Metrics, 0, len(records)+1)
+	for _, r := range records {
+		batches = append(batches, r.Metrics)
+	}
+	line, err := json.Marshal(outboxRecord{
+		Time:    o.now().UnixMilli(),
+		Metrics: mergeBatches(append(batches, batch)...),
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if int64(len(line)) > o.maxSize {
+		return ErrOutboxFull
+	}
+	err = o.rewrite(line)
+	if err != nil {
+		return err
+	}
+	logger.Log.Info("Outbox is compacted", zap.Int("batches", len(records)+1))
+	return nil
+}
+
+// dropSent removes the sent head of the segment, batches kept after it are moved to the beginning
+func (o *Outbox) dropSent() error {
+	if o.sent == 0 {
+		return nil
+	}
+	if o.sent == o.size {
+		return o.truncate()
+	}
+	data, err := os.ReadFile(o.path)
+	if err != nil {
+		return err
+	}
+	return o.rewrite(data[o.sent:])
+}
+
+// rewrite replaces the segment with data atomically
+func (o *Outbox) rewrite(data []byte) error {
+	tmp := o.path + ".tmp"
+	err := os.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, o.path)
+	if err != nil {
+		return err
+	}
+	o.size = int64(len(data))
+	o.sent = 0
+	return nil
+}
+
+// read returns batches which aren't expired, damaged lines (e.g. written partially on crash) are skipped
+func (o *Outbox) read() ([]outboxRecord, error) {
+	data, err := os.ReadFile(o.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) >= o.sent {
+		data = data[o.sent:]
+	}
+	var records []outboxRecord
+	expired := 0
+	oldest := o.now().Add(-o.maxAge).UnixMilli()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		var r outboxRecord
+		err := json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			logger.Log.Warn("Damaged outbox record is skipped", zap.Error(err))
+			continue
+		}
+		if r.Time < oldest {
+			expired++
+			continue
+		}
+		records = append(records, r)
+	}
+	if expired > 0 {
+		logger.Log.Warn("Expired outbox batches are dropped", zap.Int("batches", expired))
+	}
+	return records, scanner.Err()
+}
+
+func (o *Outbox) truncate() error {
+	err := os.Truncate(o.path, 0)
+	if err != nil {
+		return err
+	}
+	o.size = 0
+	o.sent = 0
+	return nil
+}
+
+// mergeBatches merges batches in their order, deltas of counters are summed and only the last gauge value is kept
+func mergeBatches(batches ...[]models.Metrics) []models.Metrics {
+	var res []models.Metrics
+	index := make(map[string]int)
+	for _, batch := range batches {
+		for _, m := range batch {
+			key := m.MType + "/" + m.SeriesKey()
+			i, exists := index[key]
+			if !exists {
+				index[key] = len(res)
+				res = append(res, m)
+				continue
+			}
+			switch m.MType {
+			case "counter":
+				delta := *res[i].Delta + *m.Delta
+				res[i].Delta = &delta
+			default:
+				res[i] = m
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,188 @@
+package reporter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/models"
+	"github.com/stretchr/testify/require"
+)
+
+func gaugeValue(t *testing.T, batch []models.Metrics, name string) float64 {
+	t.Helper()
+	for _, m := range batch {
+		if m.MType == "gauge" && m.ID == name {
+			return *m.Value
+		}
+	}
+	t.Fatalf("gauge %s isn't found", name)
+	return 0
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	o, err := NewOutbox(dir, 1024*1024, time.Hour)
+	require.NoError(t, err)
+	c := MockConnection{err: errors.New("connection refused")}
+	m := NewReporter(&c, nil, o)
+
+	value := 1.0
+	collector := MockCollector{metrics: []models.Metrics{
+		{ID: "g", MType: "gauge", Value: &value},
+		{ID: "PollCount", MType: "counter", Delta: new(int64)},
+	}}
+	for i := 1; i <= 3; i++ {
+		value = float64(i)
+		*collector.metrics[1].Delta = int64(i)
+		require.NoError(t, m.Poll(ctx, collector))
+		require.Error(t, m.BatchReport())
+	}
+	// deltas are moved to the outbox
+	require.Empty(t, m.counters)
+
+	// the outbox survives restart
+	o, err = NewOutbox(dir, 1024*1024, time.Hour)
+	require.NoError(t, err)
+	c.err = nil
+	m = NewReporter(&c, nil, o)
+	require.NoError(t, m.BatchReport())
+	require.Equal(t, 2, len(c.batch))
+	require.Equal(t, int64(6), counterDelta(t, c.batch, "PollCount"))
+	require.Equal(t, 3.0, gaugeValue(t, c.batch, "g"))
+
+	// nothing is replayed twice
+	c.batch = nil
+	require.NoError(t, m.BatchReport())
+	require.Nil(t, c.batch)
+	info, err := os.Stat(filepath.Join(dir, outboxSegment))
+	require.NoError(t, err)
+	require.Equal(t, int64(0), info.Size())
+}
+
+func TestOutbox_Limits(t *testing.T) {
+	ctx := context.Background()
+	o, err := NewOutbox(t.TempDir(), 300, time.Hour)
+	require.NoError(t, err)
+	now := time.Now()
+	o.now = func() time.Time { return now }
+	c := MockConnection{err: errors.New("connection refused")}
+	m := NewReporter(&c, nil, o)
+
+	// batches are compacted to fit the size
+	for i := 0; i < 10; i++ {
+		require.NoError(t, m.Poll(ctx, PollCountCollector{}))
+		require.Error(t, m.BatchReport())
+	}
+	require.LessOrEqual(t, o.size, int64(300))
+	records, err := o.read()
+	require.NoError(t, err)
+	batches := make([][]models.Metrics, 0, len(records))
+	for _, r := range records {
+		batches = append(batches, r.Metrics)
+	}
+	require.Equal(t, int64(10), counterDelta(t, mergeBatches(batches...), "PollCount"))
+
+	// deltas are kept in memory if the outbox is full
+	value := 1.0
+	large := MockCollector{metrics: []models.Metrics{{ID: strings.Repeat("x", 300), MType: "gauge", Value: &value}}}
+	require.NoError(t, m.Poll(ctx, large))
+	require.NoError(t, m.Poll(ctx, PollCountCollector{}))
+	err = m.BatchReport()
+	require.ErrorIs(t, err, ErrOutboxFull)
+	require.Equal(t, int64(1), m.counters["PollCount"])
+
+	// expired batches are dropped
+	now = now.Add(2 * time.Hour)
+	m = NewReporter(&c, nil, o)
+	c.err = nil
+	require.NoError(t, m.Poll(ctx, PollCountCollector{}))
+	require.NoError(t, m.BatchReport())
+	require.Equal(t, int64(1), counterDelta(t, c.batch, "PollCount"))
+}
+
+func TestOutbox_ConcurrentReplay(t *testing.T) {
+	dir := t.TempDir()
+	o, err := NewOutbox(dir, 1024*1024, time.Hour)
+	require.NoError(t, err)
+	delta := func(d int64) []models.Metrics {
+		return []models.Metrics{{ID: "c", MType: "counter", Delta: &d}}
+	}
+	refused := errors.New("connection refused")
+	require.ErrorIs(t, o.Send(delta(1), func([]models.Metrics) error { return refused }), errKept)
+
+	// the replay doesn't hold other reports, batches kept meanwhile stay in the outbox
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	var replayed []models.Metrics
+	go func() {
+		done <- o.Send(delta(2), func(batch []models.Metrics) error {
+			replayed = batch
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+	require.ErrorIs(t, o.Send(delta(4), func([]models.Metrics) error { return refused }), errKept)
+	// the replayed head can't be removed, it's skipped by later replays
+	require.NoError(t, os.Mkdir(filepath.Join(dir, outboxSegment+".tmp"), 0o755))
+	close(release)
+	require.NoError(t, <-done)
+	require.Equal(t, int64(3), counterDelta(t, replayed, "c"))
+
+	var sent []models.Metrics
+	send := func(batch []models.Metrics) error {
+		sent = batch
+		return nil
+	}
+	require.NoError(t, os.Remove(filepath.Join(dir, outboxSegment+".tmp")))
+	require.NoError(t, o.Send(delta(8), send))
+	require.Equal(t, int64(12), counterDelta(t, sent, "c"))
+	sent = nil
+	require.NoError(t, o.Send(nil, send))
+	require.Nil(t, sent)
+	require.Equal(t, int64(0), o.size)
+}
+
+func TestOutbox_DamagedRecord(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, outboxSegment), []byte(
+		`{"time":`+strconv.FormatInt(time.Now().UnixMilli(), 10)+`,"metrics":[{"id":"c","type":"counter","delta":2}]}`+"\n"+
+			`{"time":1,"metr`), 0o644))
+	o, err := NewOutbox(dir, 1024, time.Hour)
+	require.NoError(t, err)
+	c := MockConnection{}
+	m := NewReporter(&c, nil, o)
+	require.NoError(t, m.BatchReport())
+	require.Equal(t, int64(2), counterDelta(t, c.batch, "c"))
+}
+
+func TestMergeBatches(t *testing.T) {
+	one, two := 1.0, 2.0
+	d1, d2 := int64(1), int64(2)
+	res := mergeBatches(
+		[]models.Metrics{
+			{ID: "g", MType: "gauge", Value: &one},
+			{ID: "c", MType: "counter", Delta: &d1},
+			{ID: "c", MType: "counter", Delta: &d1, Labels: map[string]string{"host": "a"}},
+		},
+		[]models.Metrics{
+			{ID: "c", MType: "counter", Delta: &d2},
+			{ID: "g", MType: "gauge", Value: &two},
+		},
+	)
+	require.Equal(t, 3, len(res))
+	require.Equal(t, 2.0, *res[0].Value)
+	require.Equal(t, int64(3), *res[1].Delta)
+	require.Equal(t, int64(1), *res[2].Delta)
+	// source batches aren't changed
+	require.Equal(t, int64(1), d1)
+}
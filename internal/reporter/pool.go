@@ -0,0 +1,105 @@
+package reporter
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/models"
+	"github.com/sgladkov/harvester/internal/utils"
+	"go.uber.org/zap"
+)
+
+const samplesBufferSize = 64
+
+type sample struct {
+	collector string
+	metrics   []models.Metrics
+	err       error
+}
+
+// Pool decouples polling from reporting. Collected metrics are passed to the reporter through a channel
+// and reports are sent by a limited number of workers, so no more than limit requests are in flight.
+// Only one report in flight carries gauges, the others carry counter deltas only (see Reporter.takeBatch).
+type Pool struct {
+	reporter *Reporter
+	samples  chan sample
+	jobs     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewPool starts limit report workers, limit less than 1 is treated as 1
+func NewPool(reporter *Reporter, limit int) *Pool {
+	if limit < 1 {
+		limit = 1
+	}
+	p := &Pool{
+		reporter: reporter,
+		samples:  make(chan sample, samplesBufferSize),
+		// one report may wait for a free worker, later ones would send the same data
+		jobs: make(chan struct{}, 1),
+	}
+	p.wg.Add(1)
+	go p.store()
+	for i := 0; i < limit; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// Collect runs collector and passes its metrics to the reporter, it doesn't wait for reports
+func (p *Pool) Collect(ctx context.Context, c Collector) {
+	metrics, err := c.Collect(ctx)
+	p.samples <- sample{collector: c.Name(), metrics: metrics, err: err}
+}
+
+// Report schedules a report. It returns false if all workers are busy and a report is already pending,
+// the metrics are sent by the pending report then.
+func (p *Pool) Report() bool {
+	select {
+	case p.jobs <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop waits for collected metrics to be stored and for scheduled reports to be sent.
+// Collect and Report mustn't be called after Stop.
+func (p *Pool) Stop() {
+	close(p.samples)
+	close(p.jobs)
+	p.wg.Wait()
+}
+
+func (p *Pool) store() {
+	defer p.wg.Done()
+	for s := range p.samples {
+		err := p.reporter.store(s.collector, s.metrics, s.err)
+		if err != nil {
+			logger.Log.Warn("Failed to poll", zap.String("collector", s.collector), zap.Error(err))
+		}
+	}
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+	for range p.jobs {
+		err := utils.RetryOnError(
+			func() error {
+				return p.reporter.BatchReport()
+			},
+			func(err error) bool {
+				// a kept batch is sent by the next report, a retry would send it twice
+				return !errors.Is(err, errKept)
+			},
+		)
+		if err != nil {
+			logger.Log.Warn("Failed to report", zap.Error(err))
+			continue
+		}
+		logger.Log.Info("Metrics are reported")
+	}
+}
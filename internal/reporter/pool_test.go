@@ -0,0 +1,134 @@
+package reporter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/models"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingConnection holds requests until release is closed and tracks the number of requests in flight
+type blockingConnection struct {
+	release  chan struct{}
+	lock     sync.Mutex
+	inFlight int
+	maxSeen  int
+	requests int
+}
+
+func (c *blockingConnection) UpdateMetrics(_ *models.Metrics) error {
+	return c.BatchUpdateMetrics(nil)
+}
+
+func (c *blockingConnection) BatchUpdateMetrics(_ []models.Metrics) error {
+	c.lock.Lock()
+	c.inFlight++
+	c.requests++
+	if c.inFlight > c.maxSeen {
+		c.maxSeen = c.inFlight
+	}
+	c.lock.Unlock()
+	<-c.release
+	c.lock.Lock()
+	c.inFlight--
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *blockingConnection) stats() (int, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.inFlight, c.requests
+}
+
+func TestPool(t *testing.T) {
+	ctx := context.Background()
+	c := blockingConnection{release: make(chan struct{})}
+	m := NewReporter(&c, nil, nil)
+	p := NewPool(m, 2)
+
+	collect := func() {
+		p.Collect(ctx, PollCountCollector{})
+		require.Eventually(t, func() bool {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			return m.counters["PollCount"] > 0
+		}, time.Second, time.Millisecond)
+	}
+	for i := 1; i <= 2; i++ {
+		collect()
+		require.True(t, p.Report())
+		require.Eventually(t, func() bool {
+			inFlight, _ := c.stats()
+			return inFlight == i
+		}, time.Second, time.Millisecond)
+	}
+
+	// polling doesn't wait for the blocked reports
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*samplesBufferSize; i++ {
+			p.Collect(ctx, RandomCollector{})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("polling is blocked by reports")
+	}
+	// one report waits for a free worker, the rest are skipped
+	collect()
+	require.True(t, p.Report())
+	require.False(t, p.Report())
+	inFlight, _ := c.stats()
+	require.Equal(t, 2, inFlight)
+
+	close(c.release)
+	p.Stop()
+	_, requests := c.stats()
+	require.Equal(t, 3, requests)
+	require.Equal(t, 2, c.maxSeen)
+}
+
+// refusingConnection fails all requests and counts them
+type refusingConnection struct {
+	requests atomic.Int32
+}
+
+func (c *refusingConnection) UpdateMetrics(_ *models.Metrics) error {
+	return c.BatchUpdateMetrics(nil)
+}
+
+func (c *refusingConnection) BatchUpdateMetrics(_ []models.Metrics) error {
+	c.requests.Add(1)
+	return errors.New("connection refused")
+}
+
+func TestPool_KeptBatch(t *testing.T) {
+	ctx := context.Background()
+	o, err := NewOutbox(t.TempDir(), 1024*1024, time.Hour)
+	require.NoError(t, err)
+	c := refusingConnection{}
+	m := NewReporter(&c, nil, o)
+	p := NewPool(m, 1)
+	p.Collect(ctx, PollCountCollector{})
+	require.Eventually(t, func() bool {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		return m.counters["PollCount"] > 0
+	}, time.Second, time.Millisecond)
+	require.True(t, p.Report())
+
+	// the batch kept in the outbox isn't retried by the worker
+	p.Stop()
+	require.Equal(t, int32(1), c.requests.Load())
+	records, err := o.read()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+}
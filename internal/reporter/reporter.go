@@ -1,8 +1,9 @@
 package reporter
 
 import (
-	"math/rand"
-	"runtime"
+	"context"
+	"errors"
+	"fmt"
 	"sync"
 
 	"github.com/sgladkov/harvester/internal/interfaces"
@@ -13,101 +14,132 @@ type Reporter struct {
 	connection interfaces.ServerConnection
 	gauges     map[string]float64
 	counters   map[string]int64
+	labels     map[string]string
+	outbox     *Outbox
+	sending    bool // gauges are taken by a report in flight
 	lock       sync.Mutex
 }
 
-func NewReporter(connection interfaces.ServerConnection) *Reporter {
+// NewReporter creates Reporter which attaches labels (e.g. host and instance) to every reported metrics.
+// Batches which fail to be sent are kept in outbox if it isn't nil.
+func NewReporter(connection interfaces.ServerConnection, labels map[string]string, outbox *Outbox) *Reporter {
 	result := Reporter{
 		connection: connection,
 		gauges:     make(map[string]float64),
 		counters:   make(map[string]int64),
+		labels:     labels,
+		outbox:     outbox,
 	}
-	result.counters["PollCount"] = 0
 	return &result
 }
 
-func (m *Reporter) Poll() error {
+// Poll stores metrics returned by collector. Metrics returned together with an error are stored too,
+// so collectors may report partial results.
+func (m *Reporter) Poll(ctx context.Context, c Collector) error {
+	metrics, err := c.Collect(ctx)
+	return m.store(c.Name(), metrics, err)
+}
+
+func (m *Reporter) store(collector string, metrics []models.Metrics, collectErr error) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	data := runtime.MemStats{}
-	runtime.ReadMemStats(&data)
-	m.gauges["Alloc"] = float64(data.Alloc)
-	m.gauges["BuckHashSys"] = float64(data.BuckHashSys)
-	m.gauges["Frees"] = float64(data.Frees)
-	m.gauges["FreeMemory"] = float64(data.Frees)
-	m.gauges["GCCPUFraction"] = data.GCCPUFraction
-	m.gauges["GCSys"] = float64(data.GCSys)
-	m.gauges["HeapAlloc"] = float64(data.HeapAlloc)
-	m.gauges["HeapIdle"] = float64(data.HeapIdle)
-	m.gauges["HeapInuse"] = float64(data.HeapInuse)
-	m.gauges["HeapObjects"] = float64(data.HeapObjects)
-	m.gauges["HeapReleased"] = float64(data.HeapReleased)
-	m.gauges["HeapSys"] = float64(data.HeapSys)
-	m.gauges["LastGC"] = float64(data.LastGC)
-	m.gauges["Lookups"] = float64(data.Lookups)
-	m.gauges["MCacheInuse"] = float64(data.MCacheInuse)
-	m.gauges["MCacheSys"] = float64(data.MCacheSys)
-	m.gauges["MSpanInuse"] = float64(data.MSpanInuse)
-	m.gauges["MSpanSys"] = float64(data.MSpanSys)
-	m.gauges["Mallocs"] = float64(data.Mallocs)
-	m.gauges["NextGC"] = float64(data.NextGC)
-	m.gauges["NumForcedGC"] = float64(data.NumForcedGC)
-	m.gauges["NumGC"] = float64(data.NumGC)
-	m.gauges["OtherSys"] = float64(data.OtherSys)
-	m.gauges["PauseTotalNs"] = float64(data.PauseTotalNs)
-	m.gauges["StackInuse"] = float64(data.StackInuse)
-	m.gauges["StackSys"] = float64(data.StackSys)
-	m.gauges["Sys"] = float64(data.Sys)
-	m.gauges["TotalAlloc"] = float64(data.TotalAlloc)
-	m.gauges["TotalMemory"] = float64(data.TotalAlloc)
-	m.gauges["CPUutilization1"] = float64(1)
-	m.gauges["RandomValue"] = rand.Float64()
-	m.counters["PollCount"]++
-	return nil
+	var errs []error
+	for _, item := range metrics {
+		switch {
+		case item.MType == "gauge" && item.Value != nil:
+			m.gauges[item.ID] = *item.Value
+		case item.MType == "counter" && item.Delta != nil:
+			m.counters[item.ID] += *item.Delta
+		default:
+			errs = append(errs, fmt.Errorf("collector [%s] returned invalid metrics [%s] of type [%s]",
+				collector, item.ID, item.MType))
+		}
+	}
+	if collectErr != nil {
+		errs = append(errs, fmt.Errorf("collector [%s] failed: %w", collector, collectErr))
+	}
+	return errors.Join(errs...)
 }
 
-func (m *Reporter) Report() error {
+// takeBatch returns metrics to report. Counters contain deltas accumulated since the last successful report,
+// they are removed from the reporter until the report result is known. Gauges are taken by one report at a time,
+// otherwise concurrent reports could deliver an older snapshot after a newer one. It returns true if gauges
+// are taken, doneBatch should be called with it when the report is finished.
+func (m *Reporter) takeBatch() ([]models.Metrics, bool) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	metrics := models.Metrics{}
-	for name, value := range m.gauges {
-		metrics.MType = "gauge"
-		metrics.ID = name
-		metrics.Value = &value
-		err := m.connection.UpdateMetrics(&metrics)
-		if err != nil {
-			return err
+	batch := make([]models.Metrics, 0, len(m.gauges)+len(m.counters))
+	withGauges := !m.sending
+	if withGauges {
+		m.sending = true
+		for name, value := range m.gauges {
+			value := value
+			batch = append(batch, models.Metrics{ID: name, MType: "gauge", Value: &value, Labels: m.labels})
 		}
 	}
-	for name, value := range m.counters {
-		metrics.MType = "counter"
-		metrics.ID = name
-		metrics.Delta = &value
-		err := m.connection.UpdateMetrics(&metrics)
+	for name, delta := range m.counters {
+		delta := delta
+		batch = append(batch, models.Metrics{ID: name, MType: "counter", Delta: &delta, Labels: m.labels})
+		delete(m.counters, name)
+	}
+	return batch, withGauges
+}
+
+// doneBatch lets the next report take gauges if the finished one took them
+func (m *Reporter) doneBatch(withGauges bool) {
+	if !withGauges {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sending = false
+}
+
+// restoreDeltas adds deltas of counters which weren't reported back to the reporter
+func (m *Reporter) restoreDeltas(batch []models.Metrics) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, metrics := range batch {
+		if metrics.MType == "counter" {
+			m.counters[metrics.ID] += *metrics.Delta
+		}
+	}
+}
+
+// Report sends metrics one by one. Deltas of counters which aren't sent are kept for the next report.
+func (m *Reporter) Report() error {
+	batch, withGauges := m.takeBatch()
+	defer m.doneBatch(withGauges)
+	for i := range batch {
+		err := m.connection.UpdateMetrics(&batch[i])
 		if err != nil {
+			m.restoreDeltas(batch[i:])
 			return err
 		}
 	}
 	return nil
 }
 
+// BatchReport sends all metrics in one request together with batches kept in the outbox.
+// If it fails, the batch is kept in the outbox or deltas of counters are kept for the next report.
 func (m *Reporter) BatchReport() error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
-	var batch []models.Metrics
-	for name, value := range m.gauges {
-		metrics := models.Metrics{}
-		metrics.MType = "gauge"
-		metrics.ID = name
-		metrics.Value = &value
-		batch = append(batch, metrics)
+	batch, withGauges := m.takeBatch()
+	defer m.doneBatch(withGauges)
+	if len(batch) == 0 && m.outbox == nil {
+		return nil
 	}
-	for name, value := range m.counters {
-		metrics := models.Metrics{}
-		metrics.MType = "counter"
-		metrics.ID = name
-		metrics.Delta = &value
-		batch = append(batch, metrics)
+	var err error
+	if m.outbox != nil {
+		err = m.outbox.Send(batch, m.connection.BatchUpdateMetrics)
+		if err != nil && !errors.Is(err, errKept) {
+			m.restoreDeltas(batch)
+		}
+		return err
+	}
+	err = m.connection.BatchUpdateMetrics(batch)
+	if err != nil {
+		m.restoreDeltas(batch)
+		return err
 	}
-	return m.connection.BatchUpdateMetrics(batch)
+	return nil
 }
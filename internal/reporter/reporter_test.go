@@ -1,33 +1,179 @@
 package reporter
 
 import (
+	"context"
+	"errors"
+	"testing"
+
 	"github.com/sgladkov/harvester/internal/models"
 	"github.com/stretchr/testify/require"
-	"testing"
 )
 
 type MockConnection struct {
+	batch   []models.Metrics
+	updates []models.Metrics
+	err     error
 }
 
-func (c *MockConnection) UpdateMetrics(_ *models.Metrics) error {
+func (c *MockConnection) UpdateMetrics(m *models.Metrics) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.updates = append(c.updates, *m)
 	return nil
 }
 
-func (c *MockConnection) BatchUpdateMetrics(_ []models.Metrics) error {
+func (c *MockConnection) BatchUpdateMetrics(metricsBatch []models.Metrics) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.batch = metricsBatch
 	return nil
 }
 
+func counterDelta(t *testing.T, batch []models.Metrics, name string) int64 {
+	t.Helper()
+	for _, m := range batch {
+		if m.MType == "counter" && m.ID == name {
+			return *m.Delta
+		}
+	}
+	return 0
+}
+
+type MockCollector struct {
+	metrics []models.Metrics
+	err     error
+}
+
+func (c MockCollector) Name() string {
+	return "mock"
+}
+
+func (c MockCollector) Collect(_ context.Context) ([]models.Metrics, error) {
+	return c.metrics, c.err
+}
+
 func TestMetrics(t *testing.T) {
+	ctx := context.Background()
 	c := MockConnection{}
-	m := NewReporter(&c)
-	require.Equal(t, 1, len(m.counters))
-	require.Contains(t, m.counters, "PollCount")
-	require.Equal(t, int64(0), m.counters["PollCount"])
+	m := NewReporter(&c, map[string]string{"host": "localhost"}, nil)
+	require.Equal(t, 0, len(m.counters))
 	require.Equal(t, 0, len(m.gauges))
-	require.NoError(t, m.Poll())
+	registry := NewDefaultRegistry("testdata/proc1")
+	for _, name := range registry.Names() {
+		collector, exists := registry.Get(name)
+		require.True(t, exists)
+		require.NoError(t, m.Poll(ctx, collector))
+	}
 	require.Equal(t, 1, len(m.counters))
 	require.Contains(t, m.counters, "PollCount")
 	require.Equal(t, int64(1), m.counters["PollCount"])
-	require.Equal(t, 31, len(m.gauges))
+	// runtime gauges, random value and host gauges which don't require the previous poll
+	require.Equal(t, 33, len(m.gauges))
+	require.NoError(t, m.BatchReport())
+	require.Equal(t, 34, len(c.batch))
+	for _, metrics := range c.batch {
+		require.Equal(t, map[string]string{"host": "localhost"}, metrics.Labels)
+	}
+	// gauges are reported again, the counter delta is reported already
+	require.NoError(t, m.Report())
+	require.Equal(t, 33, len(c.updates))
+	require.Equal(t, int64(0), counterDelta(t, c.updates, "PollCount"))
+}
+
+func TestCounterDeltas(t *testing.T) {
+	ctx := context.Background()
+	c := MockConnection{}
+	m := NewReporter(&c, nil, nil)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, m.Poll(ctx, PollCountCollector{}))
+	}
+	require.NoError(t, m.BatchReport())
+	require.Equal(t, int64(3), counterDelta(t, c.batch, "PollCount"))
+	// metrics without labels keep the plain series keys
+	for _, metrics := range c.batch {
+		require.Equal(t, metrics.ID, metrics.SeriesKey())
+	}
+
+	// failed reports keep the delta for the next attempt
+	require.NoError(t, m.Poll(ctx, PollCountCollector{}))
+	c.err = errors.New("connection refused")
+	require.Error(t, m.BatchReport())
+	require.Error(t, m.Report())
+	require.NoError(t, m.Poll(ctx, PollCountCollector{}))
+	c.err = nil
+	require.NoError(t, m.BatchReport())
+	require.Equal(t, int64(2), counterDelta(t, c.batch, "PollCount"))
+
+	// nothing to report
+	c.batch = nil
+	require.NoError(t, m.BatchReport())
+	require.Nil(t, c.batch)
+
+	require.NoError(t, m.Poll(ctx, PollCountCollector{}))
 	require.NoError(t, m.Report())
+	require.Equal(t, int64(1), counterDelta(t, c.updates, "PollCount"))
+}
+
+func TestPoll(t *testing.T) {
+	ctx := context.Background()
+	m := NewReporter(&MockConnection{}, nil, nil)
+	value := 1.5
+	delta := int64(2)
+	collector := MockCollector{metrics: []models.Metrics{
+		{ID: "g", MType: "gauge", Value: &value},
+		{ID: "c", MType: "counter", Delta: &delta},
+	}}
+	require.NoError(t, m.Poll(ctx, collector))
+	require.NoError(t, m.Poll(ctx, collector))
+	require.Equal(t, map[string]float64{"g": 1.5}, m.gauges)
+	require.Equal(t, map[string]int64{"c": 4}, m.counters)
+
+	// partial results are stored, invalid metrics are skipped
+	collector.metrics = append(collector.metrics, models.Metrics{ID: "bad", MType: "gauge"})
+	collector.err = errors.New("partial failure")
+	require.Error(t, m.Poll(ctx, collector))
+	require.Equal(t, map[string]float64{"g": 1.5}, m.gauges)
+	require.Equal(t, map[string]int64{"c": 6}, m.counters)
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewDefaultRegistry("")
+	require.Equal(t, []string{"pollcount", "random", "runtime"}, r.Names())
+	require.Error(t, r.Register(RandomCollector{}))
+	require.NoError(t, r.Register(MockCollector{}))
+	_, exists := r.Get("mock")
+	require.True(t, exists)
+	_, exists = r.Get("unknown")
+	require.False(t, exists)
+}
+
+func TestConcurrentReports(t *testing.T) {
+	c := MockConnection{}
+	m := NewReporter(&c, nil, nil)
+	value := 1.5
+	delta := int64(1)
+	metrics := []models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &value},
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+	}
+	require.NoError(t, m.store("test", metrics, nil))
+
+	first, firstGauges := m.takeBatch()
+	require.True(t, firstGauges)
+	require.Len(t, first, 2)
+	// the report started while the first one is in flight doesn't send the gauge snapshot
+	require.NoError(t, m.store("test", metrics, nil))
+	second, secondGauges := m.takeBatch()
+	require.False(t, secondGauges)
+	require.Equal(t, []models.Metrics{{ID: "PollCount", MType: "counter", Delta: &delta}}, second)
+	m.doneBatch(secondGauges)
+	_, gauges := m.takeBatch()
+	require.False(t, gauges)
+
+	m.doneBatch(firstGauges)
+	require.NoError(t, m.BatchReport())
+	require.Len(t, c.batch, 1)
+	require.Equal(t, "Alloc", c.batch[0].ID)
 }
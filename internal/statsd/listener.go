@@ -0,0 +1,139 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/interfaces"
+	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/models"
+	"go.uber.org/zap"
+)
+
+const maxPacketSize = 65535
+
+// Stats is counters of the listener, a packet may contain several lines
+type Stats struct {
+	Packets   uint64
+	Lines     uint64
+	Malformed uint64 // lines which can't be parsed
+	Dropped   uint64 // parsed lines which aren't stored, e.g. with invalid name or because of storage error
+}
+
+// Listener receives StatsD metrics over UDP and writes them to the storage
+type Listener struct {
+	conn           net.PacketConn
+	storage        interfaces.Storage
+	storageTimeout time.Duration
+	packets        atomic.Uint64
+	lines          atomic.Uint64
+	malformed      atomic.Uint64
+	dropped        atomic.Uint64
+}
+
+// NewListener binds UDP address, storageTimeout limits time of storage operations per packet (0 means no limit)
+func NewListener(address string, s interfaces.Storage, storageTimeout time.Duration) (*Listener, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{
+		conn:           conn,
+		storage:        s,
+		storageTimeout: storageTimeout,
+	}, nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *Listener) Stats() Stats {
+	return Stats{
+		Packets:   l.packets.Load(),
+		Lines:     l.lines.Load(),
+		Malformed: l.malformed.Load(),
+		Dropped:   l.dropped.Load(),
+	}
+}
+
+// Serve processes packets until the listener is closed
+func (l *Listener) Serve() error {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		l.process(string(buf[:n]))
+		l.packets.Add(1)
+	}
+}
+
+// Close stops receiving packets, the packet in progress is finished by Serve
+func (l *Listener) Close() error {
+	stats := l.Stats()
+	logger.Log.Info("StatsD listener is stopped",
+		zap.Uint64("packets", stats.Packets),
+		zap.Uint64("lines", stats.Lines),
+		zap.Uint64("malformed", stats.Malformed),
+		zap.Uint64("dropped", stats.Dropped),
+	)
+	return l.conn.Close()
+}
+
+func (l *Listener) process(packet string) {
+	ctx := context.Background()
+	if l.storageTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.storageTimeout)
+		defer cancel()
+	}
+	for _, line := range strings.Split(packet, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		l.lines.Add(1)
+		s, err := parseLine(line)
+		if err != nil {
+			l.malformed.Add(1)
+			logger.Log.Debug("Malformed StatsD line", zap.Error(err))
+			continue
+		}
+		err = l.store(ctx, s)
+		if err != nil {
+			l.dropped.Add(1)
+			logger.Log.Warn("StatsD metrics is dropped", zap.String("line", line), zap.Error(err))
+		}
+	}
+}
+
+func (l *Listener) store(ctx context.Context, s sample) error {
+	id, err := models.SanitizeMetricsID(s.name)
+	if err != nil {
+		return err
+	}
+	err = models.ValidateLabels(s.labels)
+	if err != nil {
+		return err
+	}
+	key := models.Metrics{ID: id, Labels: s.labels}.SeriesKey()
+	switch s.mType {
+	case "counter":
+		return l.storage.SetCounter(ctx, key, int64(s.value))
+	default:
+		if s.relative {
+			_, err := l.storage.AddGauge(ctx, key, s.value)
+			return err
+		}
+		return l.storage.SetGauge(ctx, key, s.value)
+	}
+}
@@ -0,0 +1,56 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/logger"
+	"github.com/sgladkov/harvester/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListener(t *testing.T) {
+	ctx := context.Background()
+	require.NoError(t, logger.Initialize("error"))
+	s := storage.NewMemStorage("", false, 0)
+	l, err := NewListener("127.0.0.1:0", s, time.Second)
+	require.NoError(t, err)
+	served := make(chan error)
+	go func() {
+		served <- l.Serve()
+	}()
+
+	conn, err := net.Dial("udp", l.Addr().String())
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+	packets := []string{
+		"api.hits:2|c\napi.hits:1|c|@0.5\ntemp:10|g",
+		"temp:-3|g\ntemp:+1|g\nlatency:12|ms|#host:a",
+		"broken\n---:1|c\nusers:1|s",
+	}
+	for _, p := range packets {
+		_, err = conn.Write([]byte(p))
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return l.Stats().Packets == 3
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, Stats{Packets: 3, Lines: 9, Malformed: 2, Dropped: 1}, l.Stats())
+
+	hits, err := s.GetCounter(ctx, "apiHits")
+	require.NoError(t, err)
+	require.Equal(t, int64(4), hits)
+	temp, err := s.GetGauge(ctx, "temp")
+	require.NoError(t, err)
+	require.Equal(t, 8.0, temp)
+	latency, err := s.GetGauge(ctx, "latency{host=a}")
+	require.NoError(t, err)
+	require.Equal(t, 12.0, latency)
+
+	require.NoError(t, l.Close())
+	require.NoError(t, <-served)
+}
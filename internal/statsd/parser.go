@@ -0,0 +1,84 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// sample is a parsed StatsD line
+type sample struct {
+	name  string
+	mType string
+	value float64
+	// relative is set for gauges with explicit sign, their value is added to the stored one
+	relative bool
+	labels   map[string]string
+}
+
+// parseLine parses name:value|type[|@rate][|#tag:value,...] line, timers (ms and h) are stored as gauges
+func parseLine(line string) (sample, error) {
+	var res sample
+	name, rest, found := strings.Cut(line, ":")
+	if !found || len(name) == 0 {
+		return res, fmt.Errorf("invalid line [%s], name:value|type is expected", line)
+	}
+	res.name = name
+	fields := strings.Split(rest, "|")
+	if len(fields) < 2 {
+		return res, fmt.Errorf("invalid line [%s], type is missing", line)
+	}
+	value := fields[0]
+	rate := 1.0
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			val, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || val <= 0 || val > 1 {
+				return res, fmt.Errorf("invalid sample rate [%s] in line [%s]", field, line)
+			}
+			rate = val
+		case strings.HasPrefix(field, "#"):
+			res.labels = parseTags(field[1:])
+		default:
+			return res, fmt.Errorf("unknown field [%s] in line [%s]", field, line)
+		}
+	}
+
+	val, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(val) || math.IsInf(val, 0) {
+		return res, fmt.Errorf("invalid value [%s] in line [%s]", value, line)
+	}
+	switch fields[1] {
+	case "c":
+		res.mType = "counter"
+		res.value = math.Round(val / rate)
+		if math.Abs(res.value) >= math.MaxInt64 {
+			return res, fmt.Errorf("counter value [%s] is out of range in line [%s]", value, line)
+		}
+	case "g":
+		res.mType = "gauge"
+		res.value = val
+		res.relative = strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-")
+	case "ms", "h":
+		res.mType = "gauge"
+		res.value = val
+	default:
+		return res, fmt.Errorf("unsupported type [%s] in line [%s]", fields[1], line)
+	}
+	return res, nil
+}
+
+// parseTags parses DogStatsD tags to labels, tags without values are skipped
+func parseTags(tags string) map[string]string {
+	res := make(map[string]string)
+	for _, tag := range strings.Split(tags, ",") {
+		name, value, found := strings.Cut(tag, ":")
+		if !found || len(name) == 0 || len(value) == 0 {
+			continue
+		}
+		res[name] = value
+	}
+	return res
+}
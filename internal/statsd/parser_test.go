@@ -0,0 +1,44 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    sample
+		wantErr bool
+	}{
+		{"counter", "hits:3|c", sample{name: "hits", mType: "counter", value: 3}, false},
+		{"sampled counter", "hits:1|c|@0.1", sample{name: "hits", mType: "counter", value: 10}, false},
+		{"gauge", "temp:-1.5e1|g", sample{name: "temp", mType: "gauge", value: -15, relative: true}, false},
+		{"absolute gauge", "temp:42.5|g", sample{name: "temp", mType: "gauge", value: 42.5}, false},
+		{"gauge increment", "temp:+2|g", sample{name: "temp", mType: "gauge", value: 2, relative: true}, false},
+		{"timer", "api.latency:320|ms|@0.5", sample{name: "api.latency", mType: "gauge", value: 320}, false},
+		{"tags", "hits:1|c|#env:prod,region:eu-1,bare", sample{name: "hits", mType: "counter", value: 1,
+			labels: map[string]string{"env": "prod", "region": "eu-1"}}, false},
+		{"no value", "hits|c", sample{}, true},
+		{"no type", "hits:1", sample{}, true},
+		{"bad value", "hits:one|c", sample{}, true},
+		{"NaN", "temp:NaN|g", sample{}, true},
+		{"bad rate", "hits:1|c|@2", sample{}, true},
+		{"unsupported type", "users:7|s", sample{}, true},
+		{"unknown field", "hits:1|c|x", sample{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseLine(test.line)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
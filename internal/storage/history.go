@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"sort"
+	"time"
+
+	"github.com/sgladkov/harvester/internal/models"
+)
+
+// memHistory keeps timestamped samples of every series for the retention window.
+// It isn't thread safe, the owner storage is responsible for locking.
+type memHistory struct {
+	retention time.Duration
+	series    map[string][]models.Point
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newMemHistory(retention time.Duration) *memHistory {
+	return &memHistory{
+		retention: retention,
+		series:    make(map[string][]models.Point),
+		now:       time.Now,
+	}
+}
+
+func historyKey(mType string, key string) string {
+	return mType + "/" + key
+}
+
+func (h *memHistory) enabled() bool {
+	return h.retention > 0
+}
+
+func (h *memHistory) add(mType string, key string, value float64) {
+	if !h.enabled() {
+		return
+	}
+	now := h.now()
+	hk := historyKey(mType, key)
+	h.series[hk] = append(h.series[hk], models.Point{Timestamp: now.UnixMilli(), Value: value})
+	h.prune(hk, now)
+	// drop series which aren't updated anymore
+	if now.Sub(h.lastSweep) > h.retention {
+		for k := range h.series {
+			h.prune(k, now)
+		}
+		h.lastSweep = now
+	}
+}
+
+func (h *memHistory) prune(hk string, now time.Time) {
+	points := h.series[hk]
+	limit := now.Add(-h.retention).UnixMilli()
+	i := sort.Search(len(points), func(i int) bool { return points[i].Timestamp >= limit })
+	if i == len(points) {
+		delete(h.series, hk)
+		return
+	}
+	h.series[hk] = points[i:]
+}
+
+func (h *memHistory) remove(mType string, key string) {
+	delete(h.series, historyKey(mType, key))
+}
+
+func (h *memHistory) get(mType string, key string, from time.Time, to time.Time) []models.Point {
+	hk := historyKey(mType, key)
+	h.prune(hk, h.now())
+	points := h.series[hk]
+	first := sort.Search(len(points), func(i int) bool { return points[i].Timestamp >= from.UnixMilli() })
+	last := sort.Search(len(points), func(i int) bool { return points[i].Timestamp > to.UnixMilli() })
+	if first >= last {
+		return []models.Point{}
+	}
+	return append([]models.Point(nil), points[first:last]...)
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,92 +9,248 @@ import (
 	"github.com/sgladkov/harvester/internal/models"
 	"go.uber.org/zap"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
+// ErrNotFound is wrapped into errors of reading series which don't exist
+var ErrNotFound = errors.New("not found")
+
 type MemStorage struct {
 	Gauges       map[string]float64
 	Counters     map[string]int64
 	lock         sync.Mutex
 	fileStorage  string
 	saveOnChange bool
+	history      *memHistory
+	updated      map[string]time.Time     // update time of series by history key, for expiration
+	previous     map[string]counterSample // value of counters before the last update, for rate calculation
 }
 
-func NewMemStorage(fileStorage string, saveOnChange bool) *MemStorage {
+// NewMemStorage creates MemStorage, history of values is kept for historyRetention (0 disables history)
+func NewMemStorage(fileStorage string, saveOnChange bool, historyRetention time.Duration) *MemStorage {
 	return &MemStorage{
 		Gauges:       make(map[string]float64),
 		Counters:     make(map[string]int64),
 		fileStorage:  fileStorage,
 		saveOnChange: saveOnChange,
+		history:      newMemHistory(historyRetention),
+		updated:      make(map[string]time.Time),
+		previous:     make(map[string]counterSample),
 	}
 }
 
-func (s *MemStorage) GetGauge(name string) (float64, error) {
+func (s *MemStorage) GetGauge(ctx context.Context, name string) (float64, error) {
+	err := ctx.Err()
+	if err != nil {
+		return 0.0, err
+	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	value, exists := s.Gauges[name]
 	if !exists {
-		return 0.0, fmt.Errorf("no gauge [%s]", name)
+		return 0.0, fmt.Errorf("no gauge [%s]: %w", name, ErrNotFound)
 	}
 	return value, nil
 }
 
-func (s *MemStorage) SetGauge(name string, value float64) error {
+func (s *MemStorage) SetGauge(ctx context.Context, name string, value float64) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	s.Gauges[name] = value
+	s.history.add("gauge", name, value)
+	s.updated[historyKey("gauge", name)] = time.Now()
 	if s.saveOnChange {
 		return s.doSave()
 	}
 	return nil
 }
 
-func (s *MemStorage) GetCounter(name string) (int64, error) {
+// AddGauge adds delta to the gauge atomically and returns its new value, unknown gauge starts from 0
+func (s *MemStorage) AddGauge(ctx context.Context, name string, delta float64) (float64, error) {
+	err := ctx.Err()
+	if err != nil {
+		return 0.0, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Gauges[name] += delta
+	value := s.Gauges[name]
+	s.history.add("gauge", name, value)
+	s.updated[historyKey("gauge", name)] = time.Now()
+	if s.saveOnChange {
+		return value, s.doSave()
+	}
+	return value, nil
+}
+
+func (s *MemStorage) GetCounter(ctx context.Context, name string) (int64, error) {
+	err := ctx.Err()
+	if err != nil {
+		return 0, err
+	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	value, exists := s.Counters[name]
 	if !exists {
-		return 0, fmt.Errorf("no counter [%s]", name)
+		return 0, fmt.Errorf("no counter [%s]: %w", name, ErrNotFound)
 	}
 	return value, nil
 }
 
-func (s *MemStorage) SetCounter(name string, value int64) error {
+func (s *MemStorage) SetCounter(ctx context.Context, name string, value int64) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	s.Counters[name] += value
+	s.addCounter(name, value, time.Now())
 	if s.saveOnChange {
 		return s.doSave()
 	}
 	return nil
 }
 
-func (s *MemStorage) GetAll() string {
+// addCounter adds delta to the counter updated at now and returns its new value, it should be called under lock.
+// Updates with the same time (e.g. of one batch) keep the value before the first one as the previous value.
+func (s *MemStorage) addCounter(key string, delta int64, now time.Time) int64 {
+	hk := historyKey("counter", key)
+	if value, exists := s.Counters[key]; exists && s.updated[hk].Before(now) {
+		s.previous[key] = counterSample{value: value, time: s.updated[hk]}
+	}
+	s.Counters[key] += delta
+	value := s.Counters[key]
+	s.history.add("counter", key, float64(value))
+	s.updated[hk] = now
+	return value
+}
+
+// GetRate returns per second growth of the counter since the update before the last one (see counterRate),
+// 0 if it's updated once only
+func (s *MemStorage) GetRate(ctx context.Context, name string) (float64, error) {
+	err := ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	value, exists := s.Counters[name]
+	if !exists {
+		return 0, fmt.Errorf("no counter [%s]: %w", name, ErrNotFound)
+	}
+	prev, exists := s.previous[name]
+	if !exists {
+		return 0, nil
+	}
+	cur := counterSample{value: value, time: s.updated[historyKey("counter", name)]}
+	return counterRate(prev, cur, time.Now()), nil
+}
+
+func (s *MemStorage) GetAll(ctx context.Context) (string, error) {
+	err := ctx.Err()
+	if err != nil {
+		return "", err
+	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	var res string
+	var res strings.Builder
 	for n, v := range s.Gauges {
-		res += fmt.Sprintf("%s=%g\n", n, v)
+		fmt.Fprintf(&res, "%s=%g\n", n, v)
 	}
 	for n, v := range s.Counters {
-		res += fmt.Sprintf("%s=%d\n", n, v)
+		fmt.Fprintf(&res, "%s=%d\n", n, v)
+	}
+	return res.String(), nil
+}
+
+func (s *MemStorage) GetAllMetrics(ctx context.Context) ([]models.Metrics, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make([]models.Metrics, 0, len(s.Gauges)+len(s.Counters))
+	for key, v := range s.Gauges {
+		id, labels, err := models.ParseSeriesKey(key)
+		if err != nil {
+			return nil, err
+		}
+		value := v
+		res = append(res, models.Metrics{ID: id, MType: "gauge", Value: &value, Labels: labels,
+			Updated: s.updateTime("gauge", key)})
 	}
-	return res
+	for key, v := range s.Counters {
+		id, labels, err := models.ParseSeriesKey(key)
+		if err != nil {
+			return nil, err
+		}
+		delta := v
+		res = append(res, models.Metrics{ID: id, MType: "counter", Delta: &delta, Labels: labels,
+			Updated: s.updateTime("counter", key)})
+	}
+	return res, nil
 }
 
-func (s *MemStorage) SetMetrics(m models.Metrics) (models.Metrics, error) {
+// updateTime returns the update time of the series or nil if it's unknown, it should be called under lock
+func (s *MemStorage) updateTime(mType string, key string) *time.Time {
+	updated, exists := s.updated[historyKey(mType, key)]
+	if !exists {
+		return nil
+	}
+	return &updated
+}
+
+func (s *MemStorage) ListMetrics(ctx context.Context, filter models.MetricsFilter,
+	f func(m models.Metrics) error) error {
+	all, err := s.GetAllMetrics(ctx)
+	if err != nil {
+		return err
+	}
+	// f is called without lock, so it may be slow or use the storage
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].MType != all[j].MType {
+			return all[i].MType < all[j].MType
+		}
+		return all[i].SeriesKey() < all[j].SeriesKey()
+	})
+	count := 0
+	for _, m := range all {
+		if !filter.IsAfter(m) || !filter.Match(m) {
+			continue
+		}
+		if filter.Limit > 0 && count == filter.Limit {
+			break
+		}
+		err = f(m)
+		if err != nil {
+			return err
+		}
+		count++
+	}
+	return nil
+}
+
+func (s *MemStorage) SetMetrics(ctx context.Context, m models.Metrics) (models.Metrics, error) {
 	switch m.MType {
 	case "gauge":
 		if m.Value == nil {
 			logger.Log.Warn("invalid gauge value")
 			return m, errors.New("invalid gauge value")
 		}
-		err := s.SetGauge(m.ID, *m.Value)
+		err := s.SetGauge(ctx, m.SeriesKey(), *m.Value)
 		if err != nil {
 			logger.Log.Warn("error while setting gauge", zap.Error(err))
 			return m, err
 		}
-		val, err := s.GetGauge(m.ID)
+		val, err := s.GetGauge(ctx, m.SeriesKey())
 		if err != nil {
 			logger.Log.Warn("error while setting gauge", zap.Error(err))
 			return m, err
@@ -104,12 +261,12 @@ func (s *MemStorage) SetMetrics(m models.Metrics) (models.Metrics, error) {
 			logger.Log.Warn("invalid counter value")
 			return m, errors.New("invalid counter value")
 		}
-		err := s.SetCounter(m.ID, *m.Delta)
+		err := s.SetCounter(ctx, m.SeriesKey(), *m.Delta)
 		if err != nil {
 			logger.Log.Warn("error while setting counter", zap.Error(err))
 			return m, err
 		}
-		val, err := s.GetCounter(m.ID)
+		val, err := s.GetCounter(ctx, m.SeriesKey())
 		if err != nil {
 			logger.Log.Warn("error while setting counter", zap.Error(err))
 			return m, err
@@ -122,17 +279,17 @@ func (s *MemStorage) SetMetrics(m models.Metrics) (models.Metrics, error) {
 	return m, nil
 }
 
-func (s *MemStorage) GetMetrics(m models.Metrics) (models.Metrics, error) {
+func (s *MemStorage) GetMetrics(ctx context.Context, m models.Metrics) (models.Metrics, error) {
 	switch m.MType {
 	case "gauge":
-		val, err := s.GetGauge(m.ID)
+		val, err := s.GetGauge(ctx, m.SeriesKey())
 		if err != nil {
 			logger.Log.Warn("error while getting gauge", zap.Error(err))
 			return m, err
 		}
 		m.Value = &val
 	case "counter":
-		val, err := s.GetCounter(m.ID)
+		val, err := s.GetCounter(ctx, m.SeriesKey())
 		if err != nil {
 			logger.Log.Warn("error while setting counter", zap.Error(err))
 			return m, err
@@ -145,7 +302,28 @@ func (s *MemStorage) GetMetrics(m models.Metrics) (models.Metrics, error) {
 	return m, nil
 }
 
-func (s *MemStorage) Save() error {
+func (s *MemStorage) GetHistory(ctx context.Context, m models.Metrics, from time.Time, to time.Time) ([]models.Point, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	if m.MType != "gauge" && m.MType != "counter" {
+		logger.Log.Warn("unknown metric type", zap.String("metric", m.MType))
+		return nil, errors.New("unknown metrics type")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.history.enabled() {
+		return nil, errors.New("history is disabled")
+	}
+	return s.history.get(m.MType, m.SeriesKey(), from, to), nil
+}
+
+func (s *MemStorage) Save(ctx context.Context) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
@@ -180,7 +358,11 @@ func (s *MemStorage) doSave() error {
 	return nil
 }
 
-func (s *MemStorage) Read() error {
+func (s *MemStorage) Read(ctx context.Context) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
 	f, err := os.Open(s.fileStorage)
 	if err != nil {
 		logger.Log.Error("failed to open file to read metrics", zap.String("file", s.fileStorage), zap.Error(err))
@@ -216,40 +398,167 @@ func (s *MemStorage) Read() error {
 		logger.Log.Error("failed to decode data for metrics", zap.Error(err))
 		return err
 	}
+	// update times aren't saved, so restored series expire after ttl since the restart
+	// and rates of restored counters are known after their next update only
+	now := time.Now()
+	s.previous = make(map[string]counterSample)
+	for key := range s.Gauges {
+		s.updated[historyKey("gauge", key)] = now
+	}
+	for key := range s.Counters {
+		s.updated[historyKey("counter", key)] = now
+	}
 	return nil
 }
 
-func (s *MemStorage) SetMetricsBatch(metricsBatch []models.Metrics) error {
+// SetMetricsBatch validates the whole batch before applying it, so invalid metrics don't leave it applied partially
+func (s *MemStorage) SetMetricsBatch(ctx context.Context, metricsBatch []models.Metrics) ([]models.Metrics, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range metricsBatch {
+		err := models.ValidateMetrics(m)
+		if err != nil {
+			logger.Log.Warn("invalid metrics", zap.Int("index", i), zap.Error(err))
+			return nil, fmt.Errorf("metrics %d [%s]: %w", i, m.ID, err)
+		}
+	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	// the batch is applied at once, so all its updates have the same time
+	now := time.Now()
+	res := make([]models.Metrics, 0, len(metricsBatch))
 	for _, m := range metricsBatch {
-		err := models.ValidateMetricsID(m.ID)
+		key := m.SeriesKey()
+		switch m.MType {
+		case "gauge":
+			value := *m.Value
+			s.Gauges[key] = value
+			s.history.add("gauge", key, value)
+			s.updated[historyKey("gauge", key)] = now
+			m.Value = &value
+		case "counter":
+			value := s.addCounter(key, *m.Delta, now)
+			m.Delta = &value
+		}
+		res = append(res, m)
+	}
+	if s.saveOnChange {
+		return res, s.doSave()
+	}
+	return res, nil
+}
+
+// Delete removes the series of metrics together with their history and returns the removed metrics
+// with their last values, series which don't exist are skipped
+func (s *MemStorage) Delete(ctx context.Context, metricsBatch []models.Metrics) ([]models.Metrics, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range metricsBatch {
+		err := validateSeries(m)
 		if err != nil {
-			logger.Log.Warn("invalid metrics ID", zap.Error(err))
-			return err
+			logger.Log.Warn("invalid metrics", zap.Int("index", i), zap.Error(err))
+			return nil, fmt.Errorf("metrics %d [%s]: %w", i, m.ID, err)
 		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-		switch m.MType {
-		case "gauge":
-			if m.Value == nil {
-				logger.Log.Warn("invalid gauge value")
-				return errors.New("invalid gauge value")
+	res := make([]models.Metrics, 0, len(metricsBatch))
+	for _, m := range metricsBatch {
+		deleted, exists := s.delete(m.MType, m.SeriesKey())
+		if exists {
+			res = append(res, deleted)
+		}
+	}
+	if s.saveOnChange && len(res) > 0 {
+		return res, s.doSave()
+	}
+	return res, nil
+}
+
+// Expire removes series which aren't updated since before and returns them with their last values
+func (s *MemStorage) Expire(ctx context.Context, before time.Time) ([]models.Metrics, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var res []models.Metrics
+	for _, mType := range []string{"gauge", "counter"} {
+		var keys []string
+		if mType == "gauge" {
+			for key := range s.Gauges {
+				keys = append(keys, key)
 			}
-			s.Gauges[m.ID] = *m.Value
-		case "counter":
-			if m.Delta == nil {
-				logger.Log.Warn("invalid counter value")
-				return errors.New("invalid counter value")
+		} else {
+			for key := range s.Counters {
+				keys = append(keys, key)
+			}
+		}
+		for _, key := range keys {
+			if !s.updated[historyKey(mType, key)].Before(before) {
+				continue
 			}
-			s.Counters[m.ID] += *m.Delta
-		default:
-			logger.Log.Warn("unknown metric type", zap.String("metric", m.MType))
-			return errors.New("unknown metrics type")
+			m, _ := s.delete(mType, key)
+			res = append(res, m)
 		}
 	}
-	if s.saveOnChange {
-		return s.doSave()
+	if s.saveOnChange && len(res) > 0 {
+		return res, s.doSave()
+	}
+	return res, nil
+}
+
+// delete removes the series, it should be called under lock
+func (s *MemStorage) delete(mType string, key string) (models.Metrics, bool) {
+	id, labels, err := models.ParseSeriesKey(key)
+	if err != nil {
+		id = key
+	}
+	m := models.Metrics{ID: id, MType: mType, Labels: labels}
+	switch mType {
+	case "gauge":
+		value, exists := s.Gauges[key]
+		if !exists {
+			return m, false
+		}
+		delete(s.Gauges, key)
+		m.Value = &value
+	case "counter":
+		value, exists := s.Counters[key]
+		if !exists {
+			return m, false
+		}
+		delete(s.Counters, key)
+		m.Delta = &value
+	}
+	s.history.remove(mType, key)
+	delete(s.updated, historyKey(mType, key))
+	if mType == "counter" {
+		delete(s.previous, key)
+	}
+	return m, true
+}
+
+// validateSeries checks metrics which identify a series, i.e. metrics without value
+func validateSeries(m models.Metrics) error {
+	err := models.ValidateMetricsID(m.ID)
+	if err != nil {
+		return err
+	}
+	err = models.ValidateLabels(m.Labels)
+	if err != nil {
+		return err
+	}
+	if m.MType != "gauge" && m.MType != "counter" {
+		return fmt.Errorf("unknown metrics type [%s]", m.MType)
 	}
 	return nil
 }
@@ -1,130 +1,409 @@
 package storage
 
 import (
+	"context"
 	"github.com/sgladkov/harvester/internal/models"
 	"github.com/stretchr/testify/require"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMemStorage_SimpleGetSet(t *testing.T) {
-	s := NewMemStorage("", false)
-	require.NoError(t, s.SetGauge("testg", 1.1))
-	require.NoError(t, s.SetCounter("testc", 1))
-	require.NoError(t, s.SetCounter("testc", 1))
-	gauge, err := s.GetGauge("testg")
+	ctx := context.Background()
+	s := NewMemStorage("", false, 0)
+	require.NoError(t, s.SetGauge(ctx, "testg", 1.1))
+	require.NoError(t, s.SetCounter(ctx, "testc", 1))
+	require.NoError(t, s.SetCounter(ctx, "testc", 1))
+	gauge, err := s.GetGauge(ctx, "testg")
 	require.NoError(t, err)
 	require.Equal(t, 1.1, gauge)
-	counter, err := s.GetCounter("testc")
+	counter, err := s.GetCounter(ctx, "testc")
 	require.NoError(t, err)
 	require.Equal(t, int64(2), counter)
-	_, err = s.GetCounter("testg")
-	require.Error(t, err)
-	_, err = s.GetGauge("testc")
+	_, err = s.GetCounter(ctx, "testg")
 	require.Error(t, err)
+	_, err = s.GetGauge(ctx, "testc")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemStorage_AddGauge(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemStorage("", false, 0)
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.AddGauge(ctx, "g", 0.5)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	value, err := s.AddGauge(ctx, "g", -10)
+	require.NoError(t, err)
+	require.Equal(t, 40.0, value)
+	gauge, err := s.GetGauge(ctx, "g")
+	require.NoError(t, err)
+	require.Equal(t, 40.0, gauge)
 }
 
 func TestMemStorage_MetricsGetSet(t *testing.T) {
-	s := NewMemStorage("", false)
+	ctx := context.Background()
+	s := NewMemStorage("", false, 0)
 	value := 1.1
 	delta := int64(1)
-	m, err := s.SetMetrics(models.Metrics{ID: "testg", MType: "gauge", Value: &value})
+	m, err := s.SetMetrics(ctx, models.Metrics{ID: "testg", MType: "gauge", Value: &value})
 	require.NoError(t, err)
 	require.Equal(t, 1.1, *m.Value)
-	m, err = s.SetMetrics(models.Metrics{ID: "testg", MType: "gauge", Value: &value})
+	m, err = s.SetMetrics(ctx, models.Metrics{ID: "testg", MType: "gauge", Value: &value})
 	require.NoError(t, err)
 	require.Equal(t, 1.1, *m.Value)
-	m, err = s.SetMetrics(models.Metrics{ID: "testc", MType: "counter", Delta: &delta})
+	m, err = s.SetMetrics(ctx, models.Metrics{ID: "testc", MType: "counter", Delta: &delta})
 	require.NoError(t, err)
 	require.Equal(t, int64(1), *m.Delta)
-	m, err = s.SetMetrics(models.Metrics{ID: "testc", MType: "counter", Delta: &delta})
+	m, err = s.SetMetrics(ctx, models.Metrics{ID: "testc", MType: "counter", Delta: &delta})
 	require.NoError(t, err)
 	require.Equal(t, int64(2), *m.Delta)
-	m, err = s.SetMetrics(models.Metrics{ID: "testc", MType: "counter", Value: &value})
+	m, err = s.SetMetrics(ctx, models.Metrics{ID: "testc", MType: "counter", Value: &value})
 	require.Error(t, err)
-	m, err = s.SetMetrics(models.Metrics{ID: "testc", MType: "gauge", Delta: &delta})
+	m, err = s.SetMetrics(ctx, models.Metrics{ID: "testc", MType: "gauge", Delta: &delta})
 	require.Error(t, err)
-	m, err = s.SetMetrics(models.Metrics{ID: "testc", MType: "counter"})
+	m, err = s.SetMetrics(ctx, models.Metrics{ID: "testc", MType: "counter"})
 	require.Error(t, err)
-	m, err = s.SetMetrics(models.Metrics{ID: "testc", MType: "gauge"})
+	m, err = s.SetMetrics(ctx, models.Metrics{ID: "testc", MType: "gauge"})
 	require.Error(t, err)
-	m, err = s.SetMetrics(models.Metrics{ID: "testc", MType: "unknown", Delta: &delta, Value: &value})
+	m, err = s.SetMetrics(ctx, models.Metrics{ID: "testc", MType: "unknown", Delta: &delta, Value: &value})
 	require.Error(t, err)
 
-	gauge, err := s.GetGauge("testg")
+	gauge, err := s.GetGauge(ctx, "testg")
 	require.NoError(t, err)
 	require.Equal(t, 1.1, gauge)
-	counter, err := s.GetCounter("testc")
+	counter, err := s.GetCounter(ctx, "testc")
 	require.NoError(t, err)
 	require.Equal(t, int64(2), counter)
-	_, err = s.GetCounter("testg")
+	_, err = s.GetCounter(ctx, "testg")
 	require.Error(t, err)
-	_, err = s.GetGauge("testc")
+	_, err = s.GetGauge(ctx, "testc")
 	require.Error(t, err)
 
-	m, err = s.GetMetrics(models.Metrics{ID: "testg", MType: "gauge"})
+	m, err = s.GetMetrics(ctx, models.Metrics{ID: "testg", MType: "gauge"})
 	require.NoError(t, err)
 	require.Equal(t, 1.1, *m.Value)
-	m, err = s.GetMetrics(models.Metrics{ID: "testc", MType: "counter"})
+	m, err = s.GetMetrics(ctx, models.Metrics{ID: "testc", MType: "counter"})
 	require.NoError(t, err)
 	require.Equal(t, int64(2), *m.Delta)
 
-	m, err = s.GetMetrics(models.Metrics{ID: "testg", MType: "counter"})
+	m, err = s.GetMetrics(ctx, models.Metrics{ID: "testg", MType: "counter"})
 	require.Error(t, err)
-	m, err = s.GetMetrics(models.Metrics{ID: "testc", MType: "gauge"})
+	m, err = s.GetMetrics(ctx, models.Metrics{ID: "testc", MType: "gauge"})
 	require.Error(t, err)
-	m, err = s.GetMetrics(models.Metrics{ID: "testg"})
+	m, err = s.GetMetrics(ctx, models.Metrics{ID: "testg"})
 	require.Error(t, err)
-	m, err = s.GetMetrics(models.Metrics{ID: "testc"})
+	m, err = s.GetMetrics(ctx, models.Metrics{ID: "testc"})
 	require.Error(t, err)
 }
 
 func TestMemStorage_StoreRestore(t *testing.T) {
-	s := NewMemStorage("./test.storage", false)
-	require.NoError(t, s.SetGauge("testg", 1.1))
-	require.NoError(t, s.SetCounter("testc", 1))
-	require.NoError(t, s.SetCounter("testc", 1))
-	s.Save()
+	ctx := context.Background()
+	s := NewMemStorage("./test.storage", false, 0)
+	require.NoError(t, s.SetGauge(ctx, "testg", 1.1))
+	require.NoError(t, s.SetCounter(ctx, "testc", 1))
+	require.NoError(t, s.SetCounter(ctx, "testc", 1))
+	require.NoError(t, s.Save(ctx))
 
-	s = NewMemStorage("./test.storage", false)
-	_, err := s.GetCounter("testc")
+	s = NewMemStorage("./test.storage", false, 0)
+	_, err := s.GetCounter(ctx, "testc")
 	require.Error(t, err)
-	_, err = s.GetGauge("testg")
+	_, err = s.GetGauge(ctx, "testg")
 	require.Error(t, err)
 
-	s.Read()
-	gauge, err := s.GetGauge("testg")
+	require.NoError(t, s.Read(ctx))
+	gauge, err := s.GetGauge(ctx, "testg")
 	require.NoError(t, err)
 	require.Equal(t, 1.1, gauge)
-	counter, err := s.GetCounter("testc")
+	counter, err := s.GetCounter(ctx, "testc")
 	require.NoError(t, err)
 	require.Equal(t, int64(2), counter)
-	_, err = s.GetCounter("testg")
+	_, err = s.GetCounter(ctx, "testg")
 	require.Error(t, err)
-	_, err = s.GetGauge("testc")
+	_, err = s.GetGauge(ctx, "testc")
 	require.Error(t, err)
 }
 
 func TestMemStorage_SaveOnChange(t *testing.T) {
-	s := NewMemStorage("./test.storage", true)
-	require.NoError(t, s.SetGauge("testg", 1.1))
-	require.NoError(t, s.SetCounter("testc", 1))
-	require.NoError(t, s.SetCounter("testc", 1))
+	ctx := context.Background()
+	s := NewMemStorage("./test.storage", true, 0)
+	require.NoError(t, s.SetGauge(ctx, "testg", 1.1))
+	require.NoError(t, s.SetCounter(ctx, "testc", 1))
+	require.NoError(t, s.SetCounter(ctx, "testc", 1))
 
-	s = NewMemStorage("./test.storage", true)
-	_, err := s.GetCounter("testc")
+	s = NewMemStorage("./test.storage", true, 0)
+	_, err := s.GetCounter(ctx, "testc")
 	require.Error(t, err)
-	_, err = s.GetGauge("testg")
+	_, err = s.GetGauge(ctx, "testg")
 	require.Error(t, err)
 
-	s.Read()
-	gauge, err := s.GetGauge("testg")
+	require.NoError(t, s.Read(ctx))
+	gauge, err := s.GetGauge(ctx, "testg")
 	require.NoError(t, err)
 	require.Equal(t, 1.1, gauge)
-	counter, err := s.GetCounter("testc")
+	counter, err := s.GetCounter(ctx, "testc")
 	require.NoError(t, err)
 	require.Equal(t, int64(2), counter)
-	_, err = s.GetCounter("testg")
+	_, err = s.GetCounter(ctx, "testg")
+	require.Error(t, err)
+	_, err = s.GetGauge(ctx, "testc")
+	require.Error(t, err)
+}
+
+func TestMemStorage_Labels(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemStorage("", false, 0)
+	valueA := 1.1
+	valueB := 2.2
+	delta := int64(1)
+	hostA := map[string]string{"host": "a", "instance": "1"}
+	hostB := map[string]string{"host": "b"}
+	_, err := s.SetMetrics(ctx, models.Metrics{ID: "Alloc", MType: "gauge", Value: &valueA, Labels: hostA})
+	require.NoError(t, err)
+	_, err = s.SetMetrics(ctx, models.Metrics{ID: "Alloc", MType: "gauge", Value: &valueB, Labels: hostB})
+	require.NoError(t, err)
+	res, err := s.SetMetricsBatch(ctx, []models.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta, Labels: hostA},
+		{ID: "PollCount", MType: "counter", Delta: &delta, Labels: hostA},
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+	})
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+	require.Equal(t, int64(2), *res[1].Delta)
+	// invalid metrics reject the whole batch
+	_, err = s.SetMetricsBatch(ctx, []models.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+		{ID: "PollCount", MType: "counter", Delta: &delta, Labels: map[string]string{"host": "a b"}},
+	})
+	require.Error(t, err)
+
+	m, err := s.GetMetrics(ctx, models.Metrics{ID: "Alloc", MType: "gauge", Labels: hostA})
+	require.NoError(t, err)
+	require.Equal(t, 1.1, *m.Value)
+	m, err = s.GetMetrics(ctx, models.Metrics{ID: "Alloc", MType: "gauge", Labels: hostB})
+	require.NoError(t, err)
+	require.Equal(t, 2.2, *m.Value)
+	_, err = s.GetMetrics(ctx, models.Metrics{ID: "Alloc", MType: "gauge"})
+	require.Error(t, err)
+	m, err = s.GetMetrics(ctx, models.Metrics{ID: "PollCount", MType: "counter", Labels: hostA})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), *m.Delta)
+	counter, err := s.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), counter)
+
+	all, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(all))
+	for i := range all {
+		require.NotNil(t, all[i].Updated)
+		all[i].Updated = nil
+	}
+	require.Contains(t, all, models.Metrics{ID: "Alloc", MType: "gauge", Value: &valueB, Labels: hostB})
+}
+
+func TestMemStorage_History(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemStorage("", false, time.Minute)
+	now := time.UnixMilli(1000000)
+	s.history.now = func() time.Time { return now }
+	require.NoError(t, s.SetGauge(ctx, "testg", 1))
+	require.NoError(t, s.SetCounter(ctx, "testc", 1))
+	now = now.Add(30 * time.Second)
+	require.NoError(t, s.SetGauge(ctx, "testg", 2))
+	require.NoError(t, s.SetCounter(ctx, "testc", 2))
+	now = now.Add(40 * time.Second)
+	require.NoError(t, s.SetGauge(ctx, "testg", 3))
+
+	points, err := s.GetHistory(ctx, models.Metrics{ID: "testg", MType: "gauge"}, time.UnixMilli(0), now)
+	require.NoError(t, err)
+	require.Equal(t, []models.Point{{Timestamp: 1030000, Value: 2}, {Timestamp: 1070000, Value: 3}}, points)
+	points, err = s.GetHistory(ctx, models.Metrics{ID: "testg", MType: "gauge"}, now, now)
+	require.NoError(t, err)
+	require.Equal(t, []models.Point{{Timestamp: 1070000, Value: 3}}, points)
+	points, err = s.GetHistory(ctx, models.Metrics{ID: "testc", MType: "counter"}, time.UnixMilli(0), now)
+	require.NoError(t, err)
+	require.Equal(t, []models.Point{{Timestamp: 1030000, Value: 3}}, points)
+	points, err = s.GetHistory(ctx, models.Metrics{ID: "testc", MType: "gauge"}, time.UnixMilli(0), now)
+	require.NoError(t, err)
+	require.Empty(t, points)
+	now = now.Add(time.Hour)
+	points, err = s.GetHistory(ctx, models.Metrics{ID: "testg", MType: "gauge"}, time.UnixMilli(0), now)
+	require.NoError(t, err)
+	require.Empty(t, points)
+
+	_, err = NewMemStorage("", false, 0).GetHistory(ctx, models.Metrics{ID: "testg", MType: "gauge"}, time.UnixMilli(0), now)
+	require.Error(t, err)
+}
+
+func TestMemStorage_CanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewMemStorage("", false, 0)
+	require.NoError(t, s.SetGauge(ctx, "testg", 1.1))
+	cancel()
+	require.ErrorIs(t, s.SetGauge(ctx, "testg", 2.2), context.Canceled)
+	_, err := s.GetGauge(ctx, "testg")
+	require.ErrorIs(t, err, context.Canceled)
+	gauge, err := s.GetGauge(context.Background(), "testg")
+	require.NoError(t, err)
+	require.Equal(t, 1.1, gauge)
+}
+
+func TestMemStorage_Delete(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemStorage("", false, time.Hour)
+	require.NoError(t, s.SetGauge(ctx, "Alloc{host=a}", 1.5))
+	require.NoError(t, s.SetGauge(ctx, "Alloc{host=b}", 2.5))
+	require.NoError(t, s.SetCounter(ctx, "PollCount", 3))
+
+	deleted, err := s.Delete(ctx, []models.Metrics{
+		{ID: "Alloc", MType: "gauge", Labels: map[string]string{"host": "a"}},
+		{ID: "PollCount", MType: "counter"},
+		{ID: "PollCount", MType: "gauge"},
+	})
+	require.NoError(t, err)
+	require.Len(t, deleted, 2)
+	require.Equal(t, 1.5, *deleted[0].Value)
+	require.Equal(t, map[string]string{"host": "a"}, deleted[0].Labels)
+	require.Equal(t, int64(3), *deleted[1].Delta)
+	_, err = s.GetGauge(ctx, "Alloc{host=a}")
 	require.Error(t, err)
-	_, err = s.GetGauge("testc")
+	_, err = s.GetCounter(ctx, "PollCount")
 	require.Error(t, err)
+	history, err := s.GetHistory(ctx, models.Metrics{ID: "PollCount", MType: "counter"},
+		time.Now().Add(-time.Minute), time.Now())
+	require.NoError(t, err)
+	require.Empty(t, history)
+	value, err := s.GetGauge(ctx, "Alloc{host=b}")
+	require.NoError(t, err)
+	require.Equal(t, 2.5, value)
+
+	_, err = s.Delete(ctx, []models.Metrics{{ID: "Alloc", MType: "histogram"}})
+	require.Error(t, err)
+}
+
+func TestMemStorage_Expire(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemStorage("", false, 0)
+	require.NoError(t, s.SetGauge(ctx, "old", 1))
+	require.NoError(t, s.SetCounter(ctx, "old", 2))
+	before := time.Now().Add(time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	require.NoError(t, s.SetGauge(ctx, "new", 3))
+
+	expired, err := s.Expire(ctx, before)
+	require.NoError(t, err)
+	require.Len(t, expired, 2)
+	require.Equal(t, "gauge", expired[0].MType)
+	require.Equal(t, 1.0, *expired[0].Value)
+	require.Equal(t, "counter", expired[1].MType)
+	require.Equal(t, int64(2), *expired[1].Delta)
+	_, err = s.GetGauge(ctx, "old")
+	require.Error(t, err)
+	_, err = s.GetGauge(ctx, "new")
+	require.NoError(t, err)
+
+	expired, err = s.Expire(ctx, before)
+	require.NoError(t, err)
+	require.Empty(t, expired)
+}
+
+func TestCounterRate(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	after := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+	tests := []struct {
+		name string
+		prev counterSample
+		cur  counterSample
+		now  time.Time
+		want float64
+	}{
+		{name: "growth", prev: counterSample{10, start}, cur: counterSample{30, after(10)}, now: after(10), want: 2},
+		{name: "idle", prev: counterSample{10, start}, cur: counterSample{30, after(10)}, now: after(20), want: 1},
+		{name: "stale", prev: counterSample{10, start}, cur: counterSample{30, after(10)},
+			now: after(10).Add(rateStaleAfter), want: 0},
+		{name: "no growth", prev: counterSample{10, start}, cur: counterSample{10, after(1)}, now: after(1), want: 0},
+		{name: "reset", prev: counterSample{100, start}, cur: counterSample{20, after(10)}, now: after(10), want: 2},
+		{name: "negative", prev: counterSample{100, start}, cur: counterSample{-20, after(1)}, now: after(1), want: 0},
+		{name: "same time", prev: counterSample{10, start}, cur: counterSample{30, start}, now: start, want: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.want, counterRate(test.prev, test.cur, test.now))
+		})
+	}
+}
+
+func TestMemStorage_GetRate(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemStorage("", false, 0)
+	_, err := s.GetRate(ctx, "requests")
+	require.Error(t, err)
+
+	require.NoError(t, s.SetCounter(ctx, "requests", 100))
+	rate, err := s.GetRate(ctx, "requests")
+	require.NoError(t, err)
+	require.Equal(t, 0.0, rate)
+
+	// pretend the first update was 10 seconds ago, the batch updates the counter twice at the same time,
+	// so the rate is calculated from the value before the batch
+	s.updated[historyKey("counter", "requests")] = time.Now().Add(-10 * time.Second)
+	delta := int64(10)
+	counter := models.Metrics{ID: "requests", MType: "counter", Delta: &delta}
+	_, err = s.SetMetricsBatch(ctx, []models.Metrics{counter, counter})
+	require.NoError(t, err)
+	rate, err = s.GetRate(ctx, "requests")
+	require.NoError(t, err)
+	require.InDelta(t, 2.0, rate, 0.01)
+
+	// the rate of the counter which isn't updated decreases to 0
+	s.previous["requests"] = counterSample{value: 100, time: time.Now().Add(-20 * time.Second)}
+	s.updated[historyKey("counter", "requests")] = time.Now().Add(-10 * time.Second)
+	rate, err = s.GetRate(ctx, "requests")
+	require.NoError(t, err)
+	require.InDelta(t, 1.0, rate, 0.01)
+	s.updated[historyKey("counter", "requests")] = time.Now().Add(-rateStaleAfter)
+	rate, err = s.GetRate(ctx, "requests")
+	require.NoError(t, err)
+	require.Equal(t, 0.0, rate)
+
+	// the counter decreased below zero, so the rate is zero rather than negative
+	require.NoError(t, s.SetCounter(ctx, "requests", -200))
+	rate, err = s.GetRate(ctx, "requests")
+	require.NoError(t, err)
+	require.Equal(t, 0.0, rate)
+
+	// the counter created again has no previous value
+	_, err = s.Delete(ctx, []models.Metrics{{ID: "requests", MType: "counter"}})
+	require.NoError(t, err)
+	require.NoError(t, s.SetCounter(ctx, "requests", 5))
+	rate, err = s.GetRate(ctx, "requests")
+	require.NoError(t, err)
+	require.Equal(t, 0.0, rate)
+}
+
+func TestLockOrder(t *testing.T) {
+	batch := []models.Metrics{
+		{ID: "b", MType: "gauge"},
+		{ID: "a", MType: "gauge", Labels: map[string]string{"host": "x"}},
+		{ID: "a", MType: "counter"},
+		{ID: "a", MType: "gauge"},
+		{ID: "a", MType: "counter"},
+	}
+	// duplicated series keep their order
+	require.Equal(t, []int{2, 4, 3, 1, 0}, lockOrder(batch))
 }
@@ -1,133 +1,379 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	"sync"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/sgladkov/harvester/internal/logger"
 	"github.com/sgladkov/harvester/internal/models"
 	"go.uber.org/zap"
 )
 
+// PgStorage keeps metrics in PostgreSQL database. Every call reads or writes the database directly,
+// so several servers can share the same database.
 type PgStorage struct {
-	Gauges       map[string]float64
-	Counters     map[string]int64
-	lock         sync.Mutex
-	db           *sql.DB
-	saveOnChange bool
+	db        *sql.DB
+	retention time.Duration
 }
 
-func NewPgStorage(db *sql.DB, saveOnChange bool) (*PgStorage, error) {
-	err := initDB(db)
+// NewPgStorage creates PgStorage, history of values is kept in Samples table for historyRetention
+// (0 disables history)
+func NewPgStorage(ctx context.Context, db *sql.DB, historyRetention time.Duration) (*PgStorage, error) {
+	err := initDB(ctx, db)
 	if err != nil {
 		logger.Log.Error("Failed to init database", zap.Error(err))
 		return nil, err
 	}
 	return &PgStorage{
-		Gauges:       make(map[string]float64),
-		Counters:     make(map[string]int64),
-		db:           db,
-		saveOnChange: saveOnChange,
+		db:        db,
+		retention: historyRetention,
 	}, nil
 }
 
-func initDB(db *sql.DB) error {
-	tx, err := db.Begin()
+func initDB(ctx context.Context, db *sql.DB) error {
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		// id keeps the series key, i.e. metrics id together with its labels
+		_, err := tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS Gauges (id varchar(1024) PRIMARY KEY, value double precision)")
+		if err != nil {
+			logger.Log.Error("Failed to create db table", zap.Error(err))
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS Counters (id varchar(1024) PRIMARY KEY, value BIGINT)")
+		if err != nil {
+			logger.Log.Error("Failed to create db table", zap.Error(err))
+			return err
+		}
+		// updated is used to expire series, the column is added to tables created by previous versions
+		for _, table := range []string{"Gauges", "Counters"} {
+			_, err = tx.ExecContext(ctx, "ALTER TABLE "+table+
+				" ADD COLUMN IF NOT EXISTS updated timestamp with time zone NOT NULL DEFAULT now()")
+			if err != nil {
+				logger.Log.Error("Failed to alter db table", zap.Error(err))
+				return err
+			}
+		}
+		// previous value of counters and its update time are used to calculate rates
+		_, err = tx.ExecContext(ctx, "ALTER TABLE Counters ADD COLUMN IF NOT EXISTS prev_value BIGINT, "+
+			"ADD COLUMN IF NOT EXISTS prev_updated timestamp with time zone")
+		if err != nil {
+			logger.Log.Error("Failed to alter db table", zap.Error(err))
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS Samples "+
+			"(id varchar(1024), type varchar(16), ts timestamp with time zone, value double precision)")
+		if err != nil {
+			logger.Log.Error("Failed to create db table", zap.Error(err))
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS samples_series_ts ON Samples (type, id, ts)")
+		if err != nil {
+			logger.Log.Error("Failed to create db index", zap.Error(err))
+			return err
+		}
+		return nil
+	})
+}
+
+// inTx runs f in the transaction which is committed if f succeeds and rolled back otherwise
+func inTx(ctx context.Context, db *sql.DB, f func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		logger.Log.Error("Failed to create db transaction", zap.Error(err))
 		return err
 	}
 	defer func() {
-		err = tx.Rollback()
-		if err != nil {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
 			logger.Log.Info("Failed to rollback db transaction", zap.String("error", err.Error()))
 		}
 	}()
 
-	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS Gauges (id varchar(1024) PRIMARY KEY, value double precision)")
+	err = f(tx)
 	if err != nil {
-		logger.Log.Error("Failed to create db table", zap.Error(err))
 		return err
 	}
-	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS Counters (id varchar(1024) PRIMARY KEY, value BIGINT)")
+	return tx.Commit()
+}
+
+func setGauge(ctx context.Context, tx *sql.Tx, key string, value float64) (float64, error) {
+	var res float64
+	err := tx.QueryRowContext(ctx, "INSERT INTO Gauges (id, value) VALUES ($1, $2) "+
+		"ON CONFLICT (id) DO UPDATE SET value = EXCLUDED.value, updated = now() RETURNING value", key, value).Scan(&res)
 	if err != nil {
-		logger.Log.Error("Failed to create db table", zap.Error(err))
-		return err
+		logger.Log.Error("Failed to update gauge", zap.String("id", key), zap.Error(err))
+		return 0.0, err
 	}
+	return res, nil
+}
 
-	return tx.Commit()
+// setCounter adds delta to the counter and keeps its previous value. Updates in one transaction have the same time,
+// so the previous value is the one before the transaction.
+func setCounter(ctx context.Context, tx *sql.Tx, key string, delta int64) (int64, error) {
+	var res int64
+	err := tx.QueryRowContext(ctx, "INSERT INTO Counters (id, value) VALUES ($1, $2) "+
+		"ON CONFLICT (id) DO UPDATE SET value = Counters.value + EXCLUDED.value, updated = now(), "+
+		"prev_value = CASE WHEN Counters.updated < now() THEN Counters.value ELSE Counters.prev_value END, "+
+		"prev_updated = CASE WHEN Counters.updated < now() THEN Counters.updated ELSE Counters.prev_updated END "+
+		"RETURNING value", key, delta).Scan(&res)
+	if err != nil {
+		logger.Log.Error("Failed to update counter", zap.String("id", key), zap.Error(err))
+		return 0, err
+	}
+	return res, nil
 }
 
-func (s *PgStorage) GetGauge(name string) (float64, error) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	value, exists := s.Gauges[name]
-	if !exists {
-		return 0.0, fmt.Errorf("no gauge [%s]", name)
+func (s *PgStorage) GetGauge(ctx context.Context, name string) (float64, error) {
+	var value float64
+	err := s.db.QueryRowContext(ctx, "SELECT value FROM Gauges WHERE id = $1", name).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0.0, fmt.Errorf("no gauge [%s]: %w", name, ErrNotFound)
+	}
+	if err != nil {
+		logger.Log.Error("Failed to query gauge", zap.String("id", name), zap.Error(err))
+		return 0.0, err
 	}
 	return value, nil
 }
 
-func (s *PgStorage) SetGauge(name string, value float64) error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.Gauges[name] = value
-	if s.saveOnChange {
-		return s.doSave()
-	}
-	return nil
+func (s *PgStorage) SetGauge(ctx context.Context, name string, value float64) error {
+	return inTx(ctx, s.db, func(tx *sql.Tx) error {
+		value, err := setGauge(ctx, tx, name, value)
+		if err != nil {
+			return err
+		}
+		return s.addSample(ctx, tx, "gauge", name, value)
+	})
 }
 
-func (s *PgStorage) GetCounter(name string) (int64, error) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	value, exists := s.Counters[name]
-	if !exists {
-		return 0, fmt.Errorf("no counter [%s]", name)
+// AddGauge adds delta to the gauge atomically and returns its new value, unknown gauge starts from 0
+func (s *PgStorage) AddGauge(ctx context.Context, name string, delta float64) (float64, error) {
+	var res float64
+	err := inTx(ctx, s.db, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, "INSERT INTO Gauges (id, value) VALUES ($1, $2) "+
+			"ON CONFLICT (id) DO UPDATE SET value = Gauges.value + EXCLUDED.value, updated = now() RETURNING value",
+			name, delta).Scan(&res)
+		if err != nil {
+			logger.Log.Error("Failed to update gauge", zap.String("id", name), zap.Error(err))
+			return err
+		}
+		return s.addSample(ctx, tx, "gauge", name, res)
+	})
+	return res, err
+}
+
+func (s *PgStorage) GetCounter(ctx context.Context, name string) (int64, error) {
+	var value int64
+	err := s.db.QueryRowContext(ctx, "SELECT value FROM Counters WHERE id = $1", name).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("no counter [%s]: %w", name, ErrNotFound)
+	}
+	if err != nil {
+		logger.Log.Error("Failed to query counter", zap.String("id", name), zap.Error(err))
+		return 0, err
 	}
 	return value, nil
 }
 
-func (s *PgStorage) SetCounter(name string, value int64) error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.Counters[name] += value
-	if s.saveOnChange {
-		return s.doSave()
+// GetRate returns per second growth of the counter since the update before the last one (see counterRate),
+// 0 if it's updated once only. The current time is taken from the database like update times.
+func (s *PgStorage) GetRate(ctx context.Context, name string) (float64, error) {
+	var cur counterSample
+	var prevValue sql.NullInt64
+	var prevUpdated sql.NullTime
+	var now time.Time
+	err := s.db.QueryRowContext(ctx, "SELECT value, updated, prev_value, prev_updated, now() FROM Counters "+
+		"WHERE id = $1", name).Scan(&cur.value, &cur.time, &prevValue, &prevUpdated, &now)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("no counter [%s]: %w", name, ErrNotFound)
 	}
-	return nil
+	if err != nil {
+		logger.Log.Error("Failed to query counter rate", zap.String("id", name), zap.Error(err))
+		return 0, err
+	}
+	if !prevValue.Valid || !prevUpdated.Valid {
+		return 0, nil
+	}
+	return counterRate(counterSample{value: prevValue.Int64, time: prevUpdated.Time}, cur, now), nil
+}
+
+func (s *PgStorage) SetCounter(ctx context.Context, name string, value int64) error {
+	return inTx(ctx, s.db, func(tx *sql.Tx) error {
+		value, err := setCounter(ctx, tx, name, value)
+		if err != nil {
+			return err
+		}
+		return s.addSample(ctx, tx, "counter", name, float64(value))
+	})
 }
 
-func (s *PgStorage) GetAll() string {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	var res string
-	for n, v := range s.Gauges {
-		res += fmt.Sprintf("%s=%g\n", n, v)
+func (s *PgStorage) GetAll(ctx context.Context) (string, error) {
+	metrics, err := s.GetAllMetrics(ctx)
+	if err != nil {
+		return "", err
 	}
-	for n, v := range s.Counters {
-		res += fmt.Sprintf("%s=%d\n", n, v)
+	var res strings.Builder
+	for _, m := range metrics {
+		switch m.MType {
+		case "gauge":
+			fmt.Fprintf(&res, "%s=%g\n", m.SeriesKey(), *m.Value)
+		case "counter":
+			fmt.Fprintf(&res, "%s=%d\n", m.SeriesKey(), *m.Delta)
+		}
 	}
-	return res
+	return res.String(), nil
 }
 
-func (s *PgStorage) SetMetrics(m models.Metrics) (models.Metrics, error) {
+func (s *PgStorage) GetAllMetrics(ctx context.Context) ([]models.Metrics, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT 'gauge', id, value, 0, updated FROM Gauges "+
+		"UNION ALL SELECT 'counter', id, 0, value, updated FROM Counters")
+	if err != nil {
+		logger.Log.Error("Failed to query metrics", zap.Error(err))
+		return nil, err
+	}
+	defer func() {
+		err = rows.Close()
+		if err != nil {
+			logger.Log.Error("Failed to close rowset", zap.Error(err))
+		}
+	}()
+
+	res := make([]models.Metrics, 0)
+	for rows.Next() {
+		var mType, key string
+		var value float64
+		var delta int64
+		var updated time.Time
+		err = rows.Scan(&mType, &key, &value, &delta, &updated)
+		if err != nil {
+			logger.Log.Error("Failed to get data from rowset", zap.Error(err))
+			return nil, err
+		}
+		id, labels, err := models.ParseSeriesKey(key)
+		if err != nil {
+			return nil, err
+		}
+		m := models.Metrics{ID: id, MType: mType, Labels: labels, Updated: &updated}
+		if mType == "gauge" {
+			m.Value = &value
+		} else {
+			m.Delta = &delta
+		}
+		res = append(res, m)
+	}
+	err = rows.Err()
+	if err != nil {
+		logger.Log.Error("error while iterating rows", zap.Error(err))
+		return nil, err
+	}
+	return res, nil
+}
+
+// ListMetrics pages at the database level, if filter has Pattern it's checked while reading rows,
+// so the limit is applied by stopping the iteration then
+func (s *PgStorage) ListMetrics(ctx context.Context, filter models.MetricsFilter,
+	f func(m models.Metrics) error) error {
+	var conditions []string
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if len(filter.MType) > 0 {
+		conditions = append(conditions, "type = "+arg(filter.MType))
+	}
+	if len(filter.Prefix) > 0 {
+		prefix := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(filter.Prefix)
+		conditions = append(conditions, "id LIKE "+arg(prefix+"%"))
+	}
+	if len(filter.After) > 0 {
+		mType, key := models.ParseCursor(filter.After)
+		// byte order of ids is the order of MemStorage and cursors
+		conditions = append(conditions, fmt.Sprintf("(type > %s OR (type = %s AND id COLLATE \"C\" > %s))",
+			arg(mType), arg(mType), arg(key)))
+	}
+	query := "SELECT type, id, value, delta, updated FROM (" +
+		"SELECT 'gauge' AS type, id, value, 0 AS delta, updated FROM Gauges " +
+		"UNION ALL SELECT 'counter', id, 0, value, updated FROM Counters) AS series"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += ` ORDER BY type, id COLLATE "C"`
+	if filter.Limit > 0 && filter.Pattern == nil {
+		query += " LIMIT " + arg(filter.Limit)
+	}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		logger.Log.Error("Failed to query metrics", zap.Error(err))
+		return err
+	}
+	defer func() {
+		err := rows.Close()
+		if err != nil {
+			logger.Log.Error("Failed to close rowset", zap.Error(err))
+		}
+	}()
+
+	count := 0
+	for rows.Next() {
+		if filter.Limit > 0 && count == filter.Limit {
+			return nil
+		}
+		var mType, key string
+		var value float64
+		var delta int64
+		var updated time.Time
+		err = rows.Scan(&mType, &key, &value, &delta, &updated)
+		if err != nil {
+			logger.Log.Error("Failed to get data from rowset", zap.Error(err))
+			return err
+		}
+		id, labels, err := models.ParseSeriesKey(key)
+		if err != nil {
+			return err
+		}
+		m := models.Metrics{ID: id, MType: mType, Labels: labels, Updated: &updated}
+		if mType == "gauge" {
+			m.Value = &value
+		} else {
+			m.Delta = &delta
+		}
+		if !filter.Match(m) {
+			continue
+		}
+		err = f(m)
+		if err != nil {
+			return err
+		}
+		count++
+	}
+	err = rows.Err()
+	if err != nil {
+		logger.Log.Error("error while iterating rows", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// setMetrics applies m within tx and returns m with the resulting value
+func (s *PgStorage) setMetrics(ctx context.Context, tx *sql.Tx, m models.Metrics) (models.Metrics, error) {
 	switch m.MType {
 	case "gauge":
 		if m.Value == nil {
 			logger.Log.Warn("invalid gauge value")
 			return m, errors.New("invalid gauge value")
 		}
-		err := s.SetGauge(m.ID, *m.Value)
+		val, err := setGauge(ctx, tx, m.SeriesKey(), *m.Value)
 		if err != nil {
 			logger.Log.Warn("error while setting gauge", zap.Error(err))
 			return m, err
 		}
-		val, err := s.GetGauge(m.ID)
+		err = s.addSample(ctx, tx, "gauge", m.SeriesKey(), val)
 		if err != nil {
-			logger.Log.Warn("error while setting gauge", zap.Error(err))
 			return m, err
 		}
 		m.Value = &val
@@ -136,14 +382,13 @@ func (s *PgStorage) SetMetrics(m models.Metrics) (models.Metrics, error) {
 			logger.Log.Warn("invalid counter value")
 			return m, errors.New("invalid counter value")
 		}
-		err := s.SetCounter(m.ID, *m.Delta)
+		val, err := setCounter(ctx, tx, m.SeriesKey(), *m.Delta)
 		if err != nil {
 			logger.Log.Warn("error while setting counter", zap.Error(err))
 			return m, err
 		}
-		val, err := s.GetCounter(m.ID)
+		err = s.addSample(ctx, tx, "counter", m.SeriesKey(), float64(val))
 		if err != nil {
-			logger.Log.Warn("error while setting counter", zap.Error(err))
 			return m, err
 		}
 		m.Delta = &val
@@ -154,17 +399,30 @@ func (s *PgStorage) SetMetrics(m models.Metrics) (models.Metrics, error) {
 	return m, nil
 }
 
-func (s *PgStorage) GetMetrics(m models.Metrics) (models.Metrics, error) {
+func (s *PgStorage) SetMetrics(ctx context.Context, m models.Metrics) (models.Metrics, error) {
+	var res models.Metrics
+	err := inTx(ctx, s.db, func(tx *sql.Tx) error {
+		var err error
+		res, err = s.setMetrics(ctx, tx, m)
+		return err
+	})
+	if err != nil {
+		return m, err
+	}
+	return res, nil
+}
+
+func (s *PgStorage) GetMetrics(ctx context.Context, m models.Metrics) (models.Metrics, error) {
 	switch m.MType {
 	case "gauge":
-		val, err := s.GetGauge(m.ID)
+		val, err := s.GetGauge(ctx, m.SeriesKey())
 		if err != nil {
 			logger.Log.Warn("error while getting gauge", zap.Error(err))
 			return m, err
 		}
 		m.Value = &val
 	case "counter":
-		val, err := s.GetCounter(m.ID)
+		val, err := s.GetCounter(ctx, m.SeriesKey())
 		if err != nil {
 			logger.Log.Warn("error while setting counter", zap.Error(err))
 			return m, err
@@ -177,164 +435,249 @@ func (s *PgStorage) GetMetrics(m models.Metrics) (models.Metrics, error) {
 	return m, nil
 }
 
-func (s *PgStorage) Save() error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
-	return s.doSave()
-}
-
-func (s *PgStorage) doSave() error {
-	tx, err := s.db.Begin()
+func (s *PgStorage) addSample(ctx context.Context, tx *sql.Tx, mType string, key string, value float64) error {
+	if s.retention <= 0 {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO Samples (id, type, ts, value) VALUES ($1, $2, $3, $4)",
+		key, mType, time.Now(), value)
 	if err != nil {
-		logger.Log.Error("Failed to create db transaction", zap.Error(err))
+		logger.Log.Error("Failed to add sample", zap.Error(err))
 		return err
 	}
-	defer func() {
-		err = tx.Rollback()
-		if err != nil {
-			logger.Log.Info("Failed to rollback db transaction", zap.String("error", err.Error()))
-		}
-	}()
+	return nil
+}
 
-	stmtGauges, err := tx.Prepare("INSERT INTO Gauges (id, value) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET value=EXCLUDED.value")
+// PruneHistory deletes samples older than the history retention. It's called periodically
+// rather than on writes, so writes don't wait for it.
+func (s *PgStorage) PruneHistory(ctx context.Context) error {
+	if s.retention <= 0 {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, "DELETE FROM Samples WHERE ts < $1", time.Now().Add(-s.retention))
 	if err != nil {
-		logger.Log.Error("Failed to prepare query", zap.Error(err))
+		logger.Log.Error("Failed to delete outdated samples", zap.Error(err))
 		return err
 	}
-	defer func() {
-		err = stmtGauges.Close()
-		if err != nil {
-			logger.Log.Error("Failed to close statement", zap.Error(err))
-		}
-	}()
+	return nil
+}
 
-	stmtCounters, err := tx.Prepare("INSERT INTO Counters (id, value) VALUES ($1, $2) " +
-		"ON CONFLICT (id) DO UPDATE SET value=EXCLUDED.value")
+func (s *PgStorage) GetHistory(ctx context.Context, m models.Metrics, from time.Time, to time.Time) ([]models.Point, error) {
+	if m.MType != "gauge" && m.MType != "counter" {
+		logger.Log.Warn("unknown metric type", zap.String("metric", m.MType))
+		return nil, errors.New("unknown metrics type")
+	}
+	if s.retention <= 0 {
+		return nil, errors.New("history is disabled")
+	}
+	rows, err := s.db.QueryContext(ctx, "SELECT ts, value FROM Samples WHERE type = $1 AND id = $2 AND ts >= $3 AND ts <= $4 "+
+		"ORDER BY ts", m.MType, m.SeriesKey(), from, to)
 	if err != nil {
-		logger.Log.Error("Failed to prepare query", zap.Error(err))
-		return err
+		logger.Log.Error("Failed to query Samples data", zap.Error(err))
+		return nil, err
 	}
 	defer func() {
-		err = stmtCounters.Close()
+		err = rows.Close()
 		if err != nil {
-			logger.Log.Error("Failed to close statement", zap.Error(err))
+			logger.Log.Error("Failed to close rowset", zap.Error(err))
 		}
 	}()
 
-	for id, value := range s.Gauges {
-		_, err = stmtGauges.Exec(id, value)
+	points := make([]models.Point, 0)
+	var ts time.Time
+	var value float64
+	for rows.Next() {
+		err = rows.Scan(&ts, &value)
 		if err != nil {
-			logger.Log.Error("Failed to execute query", zap.Error(err))
-			return err
+			logger.Log.Error("Failed to get data from rowset", zap.Error(err))
+			return nil, err
 		}
+		points = append(points, models.Point{Timestamp: ts.UnixMilli(), Value: value})
 	}
-	for id, value := range s.Counters {
-		_, err = stmtCounters.Exec(id, value)
-		if err != nil {
-			logger.Log.Error("Failed to execute query", zap.Error(err))
-			return err
-		}
+	err = rows.Err()
+	if err != nil {
+		logger.Log.Error("error while iterating rows", zap.Error(err))
+		return nil, err
 	}
+	return points, nil
+}
 
-	return tx.Commit()
+// Save does nothing since every change is written to the database immediately
+func (s *PgStorage) Save(_ context.Context) error {
+	return nil
 }
 
-func (s *PgStorage) Read() error {
-	rowsGauges, err := s.db.Query("SELECT * FROM Gauges")
-	if err != nil {
-		logger.Log.Error("Failed to query Gauges data", zap.Error(err))
-		return err
+// Read checks the database is available, metrics are read from the database on demand
+func (s *PgStorage) Read(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// lockOrder returns indexes of the batch sorted by type and series key, so concurrent transactions lock rows
+// in the same order and don't deadlock. Updates of the same series keep their order.
+func lockOrder(metricsBatch []models.Metrics) []int {
+	keys := make([]string, len(metricsBatch))
+	order := make([]int, len(metricsBatch))
+	for i, m := range metricsBatch {
+		keys[i] = historyKey(m.MType, m.SeriesKey())
+		order[i] = i
 	}
-	defer func() {
-		err = rowsGauges.Close()
+	sort.SliceStable(order, func(i, j int) bool {
+		return keys[order[i]] < keys[order[j]]
+	})
+	return order
+}
+
+// SetMetricsBatch applies the batch in one transaction and returns results in the order of the batch
+func (s *PgStorage) SetMetricsBatch(ctx context.Context, metricsBatch []models.Metrics) ([]models.Metrics, error) {
+	for i, m := range metricsBatch {
+		err := models.ValidateMetrics(m)
 		if err != nil {
-			logger.Log.Error("Failed to close rowset", zap.Error(err))
+			logger.Log.Warn("invalid metrics", zap.Int("index", i), zap.Error(err))
+			return nil, fmt.Errorf("metrics %d [%s]: %w", i, m.ID, err)
 		}
-	}()
-	rowsCounters, err := s.db.Query("SELECT * FROM Counters")
-	if err != nil {
-		logger.Log.Error("Failed to query Counters data", zap.Error(err))
-		return err
 	}
-	defer func() {
-		err = rowsCounters.Close()
-		if err != nil {
-			logger.Log.Error("Failed to close rowset", zap.Error(err))
+	res := make([]models.Metrics, len(metricsBatch))
+	err := inTx(ctx, s.db, func(tx *sql.Tx) error {
+		for _, i := range lockOrder(metricsBatch) {
+			m, err := s.setMetrics(ctx, tx, metricsBatch[i])
+			if err != nil {
+				return err
+			}
+			res[i] = m
 		}
-	}()
-
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
-	s.Gauges = make(map[string]float64)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
 
-	var id string
-	var valueG float64
-	for rowsGauges.Next() {
-		err = rowsGauges.Scan(&id, &valueG)
-		if err != nil {
-			logger.Log.Error("Failed to get data from rowset", zap.Error(err))
-			return err
-		}
-		s.Gauges[id] = valueG
+// deleteSeries removes the series and its samples within tx, it returns false if the series doesn't exist
+func deleteSeries(ctx context.Context, tx *sql.Tx, m *models.Metrics) (bool, error) {
+	key := m.SeriesKey()
+	var err error
+	switch m.MType {
+	case "gauge":
+		var value float64
+		err = tx.QueryRowContext(ctx, "DELETE FROM Gauges WHERE id = $1 RETURNING value", key).Scan(&value)
+		m.Value = &value
+	case "counter":
+		var value int64
+		err = tx.QueryRowContext(ctx, "DELETE FROM Counters WHERE id = $1 RETURNING value", key).Scan(&value)
+		m.Delta = &value
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
 	}
-	err = rowsGauges.Err()
 	if err != nil {
-		logger.Log.Error("error while iterating rows", zap.Error(err))
-		return err
+		logger.Log.Error("Failed to delete series", zap.String("id", key), zap.Error(err))
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM Samples WHERE type = $1 AND id = $2", m.MType, key)
+	if err != nil {
+		logger.Log.Error("Failed to delete samples", zap.String("id", key), zap.Error(err))
+		return false, err
 	}
+	return true, nil
+}
 
-	s.Counters = make(map[string]int64)
-	var valueC int64
-	for rowsCounters.Next() {
-		err = rowsCounters.Scan(&id, &valueC)
+func (s *PgStorage) Delete(ctx context.Context, metricsBatch []models.Metrics) ([]models.Metrics, error) {
+	for i, m := range metricsBatch {
+		err := validateSeries(m)
 		if err != nil {
-			logger.Log.Error("Failed to get data from rowset", zap.Error(err))
-			return err
+			logger.Log.Warn("invalid metrics", zap.Int("index", i), zap.Error(err))
+			return nil, fmt.Errorf("metrics %d [%s]: %w", i, m.ID, err)
 		}
-		s.Counters[id] = valueC
 	}
-	err = rowsCounters.Err()
+	removed := make([]*models.Metrics, len(metricsBatch))
+	err := inTx(ctx, s.db, func(tx *sql.Tx) error {
+		for _, i := range lockOrder(metricsBatch) {
+			m := metricsBatch[i]
+			deleted := models.Metrics{ID: m.ID, MType: m.MType, Labels: m.Labels}
+			exists, err := deleteSeries(ctx, tx, &deleted)
+			if err != nil {
+				return err
+			}
+			if exists {
+				removed[i] = &deleted
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		logger.Log.Error("error while iterating rows", zap.Error(err))
-		return err
+		return nil, err
 	}
-
-	return nil
+	res := make([]models.Metrics, 0, len(metricsBatch))
+	for _, m := range removed {
+		if m != nil {
+			res = append(res, *m)
+		}
+	}
+	return res, nil
 }
 
-func (s *PgStorage) SetMetricsBatch(metricsBatch []models.Metrics) error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
-	for _, m := range metricsBatch {
-		err := models.ValidateMetricsID(m.ID)
+func (s *PgStorage) Expire(ctx context.Context, before time.Time) ([]models.Metrics, error) {
+	var res []models.Metrics
+	err := inTx(ctx, s.db, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, "DELETE FROM Gauges WHERE updated < $1 RETURNING 'gauge', id, value, 0", before)
+		if err == nil {
+			res, err = scanExpired(rows, res)
+		}
 		if err != nil {
-			logger.Log.Warn("invalid metrics ID", zap.Error(err))
+			logger.Log.Error("Failed to expire gauges", zap.Error(err))
 			return err
 		}
-
-		switch m.MType {
-		case "gauge":
-			if m.Value == nil {
-				logger.Log.Warn("invalid gauge value")
-				return errors.New("invalid gauge value")
-			}
-			s.Gauges[m.ID] = *m.Value
-		case "counter":
-			if m.Delta == nil {
-				logger.Log.Warn("invalid counter value")
-				return errors.New("invalid counter value")
+		rows, err = tx.QueryContext(ctx, "DELETE FROM Counters WHERE updated < $1 RETURNING 'counter', id, 0, value", before)
+		if err == nil {
+			res, err = scanExpired(rows, res)
+		}
+		if err != nil {
+			logger.Log.Error("Failed to expire counters", zap.Error(err))
+			return err
+		}
+		for _, m := range res {
+			_, err = tx.ExecContext(ctx, "DELETE FROM Samples WHERE type = $1 AND id = $2", m.MType, m.SeriesKey())
+			if err != nil {
+				logger.Log.Error("Failed to delete samples", zap.String("id", m.SeriesKey()), zap.Error(err))
+				return err
 			}
-			s.Counters[m.ID] += *m.Delta
-		default:
-			logger.Log.Warn("unknown metric type", zap.String("metric", m.MType))
-			return errors.New("unknown metrics type")
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	if s.saveOnChange {
-		return s.doSave()
+	return res, nil
+}
+
+// scanExpired appends metrics of rows with type, id, value and delta columns to res and closes rows
+func scanExpired(rows *sql.Rows, res []models.Metrics) ([]models.Metrics, error) {
+	defer func() {
+		err := rows.Close()
+		if err != nil {
+			logger.Log.Error("Failed to close rowset", zap.Error(err))
+		}
+	}()
+	for rows.Next() {
+		var mType, key string
+		var value float64
+		var delta int64
+		err := rows.Scan(&mType, &key, &value, &delta)
+		if err != nil {
+			return nil, err
+		}
+		id, labels, err := models.ParseSeriesKey(key)
+		if err != nil {
+			return nil, err
+		}
+		m := models.Metrics{ID: id, MType: mType, Labels: labels}
+		if mType == "gauge" {
+			m.Value = &value
+		} else {
+			m.Delta = &delta
+		}
+		res = append(res, m)
 	}
-	return nil
+	return res, rows.Err()
 }
@@ -0,0 +1,33 @@
+package storage
+
+import "time"
+
+// rateStaleAfter is the period after the last update the counter rate becomes 0 after
+const rateStaleAfter = 5 * time.Minute
+
+// counterSample is the counter value at the time of its update
+type counterSample struct {
+	value int64
+	time  time.Time
+}
+
+// counterRate returns per second growth of the counter from prev to cur averaged over the time from prev to now,
+// so the rate of the counter which isn't updated anymore decreases and becomes 0 after rateStaleAfter.
+// The counter is considered reset to zero if its value decreased, so the rate is never negative.
+func counterRate(prev counterSample, cur counterSample, now time.Time) float64 {
+	if now.Sub(cur.time) >= rateStaleAfter {
+		return 0
+	}
+	elapsed := now.Sub(prev.time).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	growth := cur.value - prev.value
+	if growth < 0 {
+		growth = cur.value
+	}
+	if growth < 0 {
+		return 0
+	}
+	return float64(growth) / elapsed
+}
@@ -7,22 +7,26 @@ import (
 	"go.uber.org/zap"
 )
 
+// retryTimeouts are pauses before attempts to call f again
+var retryTimeouts = []time.Duration{time.Second, 3 * time.Second, 5 * time.Second}
+
+// RetryOnError calls f until it succeeds, fails with the error errCheck doesn't consider retryable
+// or retries are over, it returns the last error of f
 func RetryOnError(f func() error, errCheck func(error) bool) error {
 	var count = 0
-	timeouts := [3]int{1, 3, 5}
 	for {
 		err := f()
 		if err != nil {
 			if errCheck(err) {
 				logger.Log.Warn("error, retry", zap.Error(err))
-				time.Sleep(time.Duration(timeouts[count]) * time.Second)
+				time.Sleep(retryTimeouts[count])
 				count++
-				if count >= len(timeouts) {
+				if count >= len(retryTimeouts) {
 					return err
 				}
 				continue
 			}
 		}
-		return nil
+		return err
 	}
 }
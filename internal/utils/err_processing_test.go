@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryOnError(t *testing.T) {
+	retryTimeouts = []time.Duration{time.Millisecond, time.Millisecond}
+	errRetryable := errors.New("retryable")
+	errFatal := errors.New("fatal")
+	tests := []struct {
+		name  string
+		errs  []error
+		want  error
+		calls int
+	}{
+		{name: "success", errs: []error{nil}, want: nil, calls: 1},
+		{name: "retried", errs: []error{errRetryable, nil}, want: nil, calls: 2},
+		{name: "not retryable", errs: []error{errFatal}, want: errFatal, calls: 1},
+		{name: "not retryable after retry", errs: []error{errRetryable, errFatal}, want: errFatal, calls: 2},
+		{name: "retries are over", errs: []error{errRetryable, errRetryable, errRetryable}, want: errRetryable, calls: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			err := RetryOnError(
+				func() error {
+					err := test.errs[calls]
+					calls++
+					return err
+				},
+				func(err error) bool {
+					return errors.Is(err, errRetryable)
+				},
+			)
+			require.Equal(t, test.want, err)
+			require.Equal(t, test.calls, calls)
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// HashHeader is the HTTP header to pass the signature of the body
+const HashHeader = "HashSHA256"
+
+// CalculateHash returns hex encoded HMAC-SHA256 signature of data with key
+func CalculateHash(data []byte, key string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// CheckHash checks hash is the valid HMAC-SHA256 signature of data with key
+func CheckHash(data []byte, key string, hash string) bool {
+	expected, err := hex.DecodeString(hash)
+	if err != nil {
+		return false
+	}
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(data)
+	return hmac.Equal(h.Sum(nil), expected)
+}